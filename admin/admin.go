@@ -0,0 +1,462 @@
+// Package admin implements the authenticated administrative HTTP API. It is
+// intended to be served on a private listener alongside expvar.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/breaker"
+	"github.com/bepress/camo/logging"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/bepress/camo/transform"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// maxBodySize limits the size of admin request bodies.
+	maxBodySize = 1024 * 1024
+
+	// prefetchWorkers is the number of concurrent prefetch fetches.
+	prefetchWorkers = 8
+)
+
+// MustNew returns an admin API handler or panics. Requests must present token
+// as a bearer token in the Authorization header.
+func MustNew(p *proxy.Proxy, token string, logger zerolog.Logger) *Handler {
+	if token == "" {
+		panic("admin token must not be empty")
+	}
+	if p == nil {
+		panic("proxy must not be nil")
+	}
+
+	h := &Handler{
+		proxy:  p,
+		token:  []byte(token),
+		logger: logger,
+		mux:    http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/admin/purge", h.purge)
+	h.mux.HandleFunc("/admin/prefetch", h.prefetch)
+	h.mux.HandleFunc("/admin/breakers", h.breakers)
+	h.mux.HandleFunc("/admin/hashes", h.hashes)
+	h.mux.HandleFunc("/admin/hashes/reload", h.reloadHashes)
+	h.mux.HandleFunc("/admin/takedowns", h.takedowns)
+	h.mux.HandleFunc("/admin/takedowns/reload", h.reloadTakedowns)
+
+	return h
+}
+
+// Handler serves the admin API.
+type Handler struct {
+	proxy  *proxy.Proxy
+	token  []byte
+	logger zerolog.Logger
+	mux    *http.ServeMux
+}
+
+// Request is the body of a purge or prefetch request. Signed holds signed
+// camo URLs (or their paths), URLs holds decoded upstream URLs and Prefixes
+// holds host and path prefixes such as "example.com/images/". Prefixes are
+// only valid for purges.
+type Request struct {
+	Signed   []string `json:"signed,omitempty"`
+	URLs     []string `json:"urls,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// PurgeResult is the outcome of a purge for a single input.
+type PurgeResult struct {
+	Input  string `json:"input"`
+	URL    string `json:"url,omitempty"`
+	Purged int    `json:"purged"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PurgeResponse is the body of a purge response.
+type PurgeResponse struct {
+	Results []PurgeResult `json:"results"`
+}
+
+// PrefetchResult is the outcome of a prefetch for a single input. Status is
+// the upstream response code, if we got that far.
+type PrefetchResult struct {
+	Input  string `json:"input"`
+	URL    string `json:"url,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Bytes  int64  `json:"bytes"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PrefetchResponse is the body of a prefetch response.
+type PrefetchResponse struct {
+	Results []PrefetchResult `json:"results"`
+}
+
+// BreakersResponse is the body of a breakers response, keyed by upstream host.
+type BreakersResponse struct {
+	Hosts map[string]breaker.Status `json:"hosts"`
+}
+
+// HashesRequest is the body of a request to add hex encoded SHA-256 sums of
+// bodies to the blocklist.
+type HashesRequest struct {
+	Hashes []string `json:"hashes"`
+}
+
+// HashesResponse is the body of a hashes response. Added is how many of the
+// request's hashes were new and Count how many the blocklist holds.
+type HashesResponse struct {
+	Added int `json:"added"`
+	Count int `json:"count"`
+}
+
+// TakedownsRequest is the body of a request to add (POST) or remove (DELETE)
+// takedowns. Signed holds signed camo URLs (or their paths) whose decoded URLs
+// are added or removed like those in URLs.
+type TakedownsRequest struct {
+	Signed []string `json:"signed,omitempty"`
+	blocklist.Takedowns
+}
+
+// TakedownsResponse is the body of a takedowns response. Takedowns is the
+// whole list once the request is done.
+type TakedownsResponse struct {
+	Added     int                 `json:"added,omitempty"`
+	Removed   int                 `json:"removed,omitempty"`
+	Takedowns blocklist.Takedowns `json:"takedowns"`
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="camo-admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// authorized checks the bearer token in constant time.
+func (h *Handler) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), h.token) == 1
+}
+
+func (h *Handler) purge(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.decodeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	resp := PurgeResponse{Results: []PurgeResult{}}
+	for _, s := range req.Signed {
+		res := PurgeResult{Input: s}
+		if res.URL, _, res.Error = h.decodeSigned(s); res.Error == "" {
+			res.Purged, res.Error = errString(h.proxy.Purge(res.URL))
+		}
+		resp.Results = append(resp.Results, res)
+	}
+	for _, u := range req.URLs {
+		res := PurgeResult{Input: u, URL: u}
+		res.Purged, res.Error = errString(h.proxy.Purge(u))
+		resp.Results = append(resp.Results, res)
+	}
+	for _, prefix := range req.Prefixes {
+		res := PurgeResult{Input: prefix}
+		res.Purged, res.Error = errString(h.proxy.PurgePrefix(prefix))
+		resp.Results = append(resp.Results, res)
+	}
+
+	var failed int
+	for _, res := range resp.Results {
+		if res.Error != "" {
+			failed++
+		}
+	}
+
+	h.log(r, "purge", len(resp.Results), failed)
+	h.writeJSON(w, resp)
+}
+
+func (h *Handler) prefetch(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.decodeRequest(w, r)
+	if !ok {
+		return
+	}
+	if len(req.Prefixes) > 0 {
+		http.Error(w, "prefixes may not be prefetched", http.StatusBadRequest)
+		return
+	}
+
+	// opts[i] are the transform options of the signed URL behind
+	// resp.Results[i], if there is one.
+	resp := PrefetchResponse{Results: make([]PrefetchResult, 0, len(req.Signed)+len(req.URLs))}
+	opts := make([]transform.Options, len(req.Signed)+len(req.URLs))
+	for i, s := range req.Signed {
+		res := PrefetchResult{Input: s}
+		res.URL, opts[i], res.Error = h.decodeSigned(s)
+		resp.Results = append(resp.Results, res)
+	}
+	for _, u := range req.URLs {
+		resp.Results = append(resp.Results, PrefetchResult{Input: u, URL: u})
+	}
+
+	// Fetch concurrently, each worker filling in its own results.
+	var (
+		wg   sync.WaitGroup
+		jobs = make(chan int)
+	)
+	for i := 0; i < prefetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res := &resp.Results[i]
+				var err error
+				res.Status, res.Bytes, err = h.proxy.Prefetch(r.Context(), res.URL, opts[i])
+				if err != nil {
+					res.Error = err.Error()
+				}
+			}
+		}()
+	}
+	for i := range resp.Results {
+		if resp.Results[i].Error == "" {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	var failed int
+	for _, res := range resp.Results {
+		if res.Error != "" {
+			failed++
+		}
+	}
+
+	h.log(r, "prefetch", len(resp.Results), failed)
+	h.writeJSON(w, resp)
+}
+
+func (h *Handler) breakers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Add("Allowed", "GET")
+		http.Error(w, fmt.Sprintf("Method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if h.proxy.Breakers == nil {
+		http.Error(w, "circuit breakers are not enabled", http.StatusNotImplemented)
+		return
+	}
+	h.writeJSON(w, BreakersResponse{Hosts: h.proxy.Breakers.States()})
+}
+
+func (h *Handler) hashes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Add("Allowed", "GET,POST")
+		http.Error(w, fmt.Sprintf("Method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	list := h.proxy.BlockedHashes
+	if list == nil {
+		http.Error(w, "the hash blocklist is not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method == "GET" {
+		h.writeJSON(w, HashesResponse{Count: list.Len()})
+		return
+	}
+
+	req := &HashesRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(req); err != nil {
+		h.logger.Error().Err(err).Str("request_id", rxid.FromContext(r.Context())).Msg(logging.ErrDetails())
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, s := range req.Hashes {
+		if _, err := blocklist.ParseSum(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	added, err := list.Add(req.Hashes)
+	if err != nil {
+		h.logger.Error().Err(err).Str("request_id", rxid.FromContext(r.Context())).Msg(logging.ErrDetails())
+		http.Error(w, "unable to add hashes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.log(r, "add_hashes", len(req.Hashes), 0)
+	h.writeJSON(w, HashesResponse{Added: added, Count: list.Len()})
+}
+
+func (h *Handler) reloadHashes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Add("Allowed", "POST")
+		http.Error(w, fmt.Sprintf("Method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if h.proxy.BlockedHashes == nil {
+		http.Error(w, "the hash blocklist is not enabled", http.StatusNotImplemented)
+		return
+	}
+	n, err := h.proxy.BlockedHashes.Reload()
+	if err != nil {
+		h.logger.Error().Err(err).Str("request_id", rxid.FromContext(r.Context())).Msg(logging.ErrDetails())
+		http.Error(w, "unable to reload hashes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.log(r, "reload_hashes", n, 0)
+	h.writeJSON(w, HashesResponse{Count: n})
+}
+
+func (h *Handler) takedowns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		w.Header().Add("Allowed", "GET,POST,DELETE")
+		http.Error(w, fmt.Sprintf("Method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	list := h.proxy.BlockedURLs
+	if list == nil {
+		http.Error(w, "the takedown list is not enabled", http.StatusNotImplemented)
+		return
+	}
+	if r.Method == "GET" {
+		h.writeJSON(w, TakedownsResponse{Takedowns: list.List()})
+		return
+	}
+
+	req := &TakedownsRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(req); err != nil {
+		h.logger.Error().Err(err).Str("request_id", rxid.FromContext(r.Context())).Msg(logging.ErrDetails())
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, s := range req.Signed {
+		u, _, errStr := h.decodeSigned(s)
+		if errStr != "" {
+			http.Error(w, fmt.Sprintf("invalid signed URL %q: %s", s, errStr), http.StatusBadRequest)
+			return
+		}
+		req.URLs = append(req.URLs, u)
+	}
+	for _, s := range req.Regexps {
+		if _, err := regexp.Compile(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var (
+		resp   TakedownsResponse
+		action string
+		err    error
+	)
+	if r.Method == "POST" {
+		action = "add_takedowns"
+		resp.Added, err = list.Add(req.Takedowns)
+	} else {
+		action = "remove_takedowns"
+		resp.Removed, err = list.Remove(req.Takedowns)
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Str("request_id", rxid.FromContext(r.Context())).Msg(logging.ErrDetails())
+		http.Error(w, "unable to update takedowns: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.log(r, action, req.Takedowns.Len(), 0)
+	resp.Takedowns = list.List()
+	h.writeJSON(w, resp)
+}
+
+func (h *Handler) reloadTakedowns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Add("Allowed", "POST")
+		http.Error(w, fmt.Sprintf("Method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if h.proxy.BlockedURLs == nil {
+		http.Error(w, "the takedown list is not enabled", http.StatusNotImplemented)
+		return
+	}
+	n, err := h.proxy.BlockedURLs.Reload()
+	if err != nil {
+		h.logger.Error().Err(err).Str("request_id", rxid.FromContext(r.Context())).Msg(logging.ErrDetails())
+		http.Error(w, "unable to reload takedowns: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.log(r, "reload_takedowns", n, 0)
+	h.writeJSON(w, TakedownsResponse{Takedowns: h.proxy.BlockedURLs.List()})
+}
+
+// decodeRequest checks the method and decodes the request body. It writes an
+// error response and returns false on failure.
+func (h *Handler) decodeRequest(w http.ResponseWriter, r *http.Request) (*Request, bool) {
+	if r.Method != "POST" {
+		w.Header().Add("Allowed", "POST")
+		http.Error(w, fmt.Sprintf("Method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if h.proxy.Cache == nil {
+		http.Error(w, proxy.ErrNoCache.Error(), http.StatusNotImplemented)
+		return nil, false
+	}
+
+	req := &Request{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(req); err != nil {
+		h.logger.Error().Err(err).Str("request_id", rxid.FromContext(r.Context())).Msg(logging.ErrDetails())
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return req, true
+}
+
+// decodeSigned decodes a signed camo URL returning the error as a string for
+// the result.
+func (h *Handler) decodeSigned(s string) (string, transform.Options, string) {
+	u, opts, err := h.proxy.DecodeSigned(s)
+	if err != nil {
+		return "", transform.Options{}, err.Error()
+	}
+	return u, opts, ""
+}
+
+func (h *Handler) log(r *http.Request, action string, count, failed int) {
+	h.logger.Info().
+		Str("type", "admin").
+		Str("request_id", rxid.FromContext(r.Context())).
+		Str("action", action).
+		Int("count", count).
+		Int("failed", failed).Msg("")
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.Error().Err(err).Msg(logging.ErrDetails())
+	}
+}
+
+func errString(n int, err error) (int, string) {
+	if err != nil {
+		return n, err.Error()
+	}
+	return n, ""
+}
@@ -0,0 +1,314 @@
+package admin_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bepress/camo/admin"
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/breaker"
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	testKey   = "test"
+	testToken = "sekrit"
+)
+
+func TestAdminPanicsEmptyToken(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("admin.MustNew failed to panic")
+		}
+	}()
+
+	_ = admin.MustNew(proxy.MustNew([]byte(testKey), zerolog.New(ioutil.Discard)), "", zerolog.New(ioutil.Discard))
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	ts, be, _ := newTestAdmin(t)
+	defer ts.Close()
+	defer be.Close()
+
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + testToken, testToken} {
+		req, err := http.NewRequest("POST", ts.URL+"/admin/purge", bytes.NewBufferString("{}"))
+		checkers.OK(t, err)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		checkers.OK(t, err)
+		resp.Body.Close()
+		checkers.Equals(t, resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestAdminMethodNotAllowed(t *testing.T) {
+	ts, be, _ := newTestAdmin(t)
+	defer ts.Close()
+	defer be.Close()
+
+	resp := do(t, "GET", ts.URL+"/admin/purge", "")
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusMethodNotAllowed)
+}
+
+func TestAdminPrefetchAndPurge(t *testing.T) {
+	ts, be, c := newTestAdmin(t)
+	defer ts.Close()
+	defer be.Close()
+
+	a := be.URL + "/images/a.png"
+	b := be.URL + "/images/b.png"
+
+	// Prefetch one decoded and one signed URL, and one with a bad signature.
+	body, _ := json.Marshal(admin.Request{
+		Signed: []string{"https://camo.example.com" + sign(b), "/bad/sig"},
+		URLs:   []string{a},
+	})
+	resp := do(t, "POST", ts.URL+"/admin/prefetch", string(body))
+	checkers.Equals(t, resp.StatusCode, http.StatusOK)
+	pf := admin.PrefetchResponse{}
+	checkers.OK(t, json.NewDecoder(resp.Body).Decode(&pf))
+	resp.Body.Close()
+
+	checkers.Equals(t, len(pf.Results), 3)
+	checkers.Equals(t, pf.Results[0].URL, b)
+	checkers.Equals(t, pf.Results[0].Status, http.StatusOK)
+	checkers.Equals(t, pf.Results[0].Bytes, int64(len("/images/b.png")))
+	checkers.Equals(t, pf.Results[0].Error, "")
+	checkers.Assert(t, pf.Results[1].Error != "", "expected an error for a bad signature")
+	checkers.Equals(t, pf.Results[2].URL, a)
+	checkers.Equals(t, pf.Results[2].Status, http.StatusOK)
+	checkers.Equals(t, c.Len(), 2)
+
+	// Purge by signed URL, then by prefix.
+	body, _ = json.Marshal(admin.Request{Signed: []string{sign(b)}})
+	resp = do(t, "POST", ts.URL+"/admin/purge", string(body))
+	checkers.Equals(t, resp.StatusCode, http.StatusOK)
+	pr := admin.PurgeResponse{}
+	checkers.OK(t, json.NewDecoder(resp.Body).Decode(&pr))
+	resp.Body.Close()
+	checkers.Equals(t, pr.Results, []admin.PurgeResult{{Input: sign(b), URL: b, Purged: 1}})
+
+	prefix := be.Listener.Addr().String() + "/images/"
+	body, _ = json.Marshal(admin.Request{Prefixes: []string{prefix}})
+	resp = do(t, "POST", ts.URL+"/admin/purge", string(body))
+	pr = admin.PurgeResponse{}
+	checkers.OK(t, json.NewDecoder(resp.Body).Decode(&pr))
+	resp.Body.Close()
+	checkers.Equals(t, pr.Results, []admin.PurgeResult{{Input: prefix, Purged: 1}})
+	checkers.Equals(t, c.Len(), 0)
+}
+
+func TestAdminBadRequest(t *testing.T) {
+	ts, be, _ := newTestAdmin(t)
+	defer ts.Close()
+	defer be.Close()
+
+	table := []struct {
+		path string
+		body string
+	}{
+		{"/admin/purge", "not json"},
+		{"/admin/prefetch", `{"prefixes": ["example.com"]}`},
+	}
+	for _, test := range table {
+		resp := do(t, "POST", ts.URL+test.path, test.body)
+		resp.Body.Close()
+		checkers.Equals(t, resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestAdminBreakers(t *testing.T) {
+	ts, be, _ := newTestAdmin(t)
+	defer ts.Close()
+	defer be.Close()
+
+	resp := do(t, "GET", ts.URL+"/admin/breakers", "")
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusNotImplemented)
+
+	set := breaker.MustNew(func(s *breaker.Set) { s.MinRequests = 1 })
+	done, err := set.Allow("down.example.com")
+	checkers.OK(t, err)
+	done(true)
+	done, err = set.Allow("up.example.com")
+	checkers.OK(t, err)
+	done(false)
+
+	p := proxy.MustNew([]byte(testKey), zerolog.New(ioutil.Discard), func(p *proxy.Proxy) { p.Breakers = set })
+	tsB := httptest.NewServer(rxid.Handler(admin.MustNew(p, testToken, zerolog.New(ioutil.Discard))))
+	defer tsB.Close()
+
+	resp = do(t, "GET", tsB.URL+"/admin/breakers", "")
+	checkers.Equals(t, resp.StatusCode, http.StatusOK)
+	var br admin.BreakersResponse
+	checkers.OK(t, json.NewDecoder(resp.Body).Decode(&br))
+	resp.Body.Close()
+	checkers.Equals(t, len(br.Hosts), 2)
+	checkers.Equals(t, br.Hosts["down.example.com"].State, breaker.Open)
+	checkers.Equals(t, br.Hosts["up.example.com"].State, breaker.Closed)
+	checkers.Equals(t, br.Hosts["up.example.com"].Requests, 1)
+}
+
+func TestAdminHashes(t *testing.T) {
+	ts, be, _ := newTestAdmin(t)
+	defer ts.Close()
+	defer be.Close()
+
+	resp := do(t, "GET", ts.URL+"/admin/hashes", "")
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusNotImplemented)
+
+	dir, err := ioutil.TempDir("", "admin")
+	checkers.OK(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hashes")
+	checkers.OK(t, ioutil.WriteFile(path, nil, 0644))
+	list, err := blocklist.LoadHashes(path)
+	checkers.OK(t, err)
+
+	p := proxy.MustNew([]byte(testKey), zerolog.New(ioutil.Discard), func(p *proxy.Proxy) { p.BlockedHashes = list })
+	tsH := httptest.NewServer(rxid.Handler(admin.MustNew(p, testToken, zerolog.New(ioutil.Discard))))
+	defer tsH.Close()
+
+	sum := sha256.Sum256([]byte("bad"))
+	hexSum := hex.EncodeToString(sum[:])
+	table := []struct {
+		method   string
+		path     string
+		body     string
+		wantCode int
+		want     admin.HashesResponse
+	}{
+		{"POST", "/admin/hashes", `{"hashes": ["` + hexSum + `", "` + hexSum + `"]}`, http.StatusOK, admin.HashesResponse{Added: 1, Count: 1}},
+		{"POST", "/admin/hashes", `{"hashes": ["` + hexSum + `"]}`, http.StatusOK, admin.HashesResponse{Count: 1}},
+		{"POST", "/admin/hashes", `{"hashes": ["nope"]}`, http.StatusBadRequest, admin.HashesResponse{}},
+		{"GET", "/admin/hashes", "", http.StatusOK, admin.HashesResponse{Count: 1}},
+		{"GET", "/admin/hashes/reload", "", http.StatusMethodNotAllowed, admin.HashesResponse{}},
+		{"POST", "/admin/hashes/reload", "", http.StatusOK, admin.HashesResponse{Count: 1}},
+	}
+	for _, test := range table {
+		resp := do(t, test.method, tsH.URL+test.path, test.body)
+		checkers.Assert(t, resp.StatusCode == test.wantCode, "%s %s: got %d want %d", test.method, test.path, resp.StatusCode, test.wantCode)
+		if test.wantCode == http.StatusOK {
+			var got admin.HashesResponse
+			checkers.OK(t, json.NewDecoder(resp.Body).Decode(&got))
+			checkers.Equals(t, got, test.want)
+		}
+		resp.Body.Close()
+	}
+	checkers.Assert(t, list.Contains(sum), "hash not added")
+}
+
+func TestAdminTakedowns(t *testing.T) {
+	ts, be, _ := newTestAdmin(t)
+	defer ts.Close()
+	defer be.Close()
+
+	resp := do(t, "GET", ts.URL+"/admin/takedowns", "")
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusNotImplemented)
+
+	dir, err := ioutil.TempDir("", "admin")
+	checkers.OK(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "takedowns.json")
+	checkers.OK(t, ioutil.WriteFile(path, nil, 0644))
+	list, err := blocklist.LoadURLs(path)
+	checkers.OK(t, err)
+
+	p := proxy.MustNew([]byte(testKey), zerolog.New(ioutil.Discard), func(p *proxy.Proxy) { p.BlockedURLs = list })
+	tsT := httptest.NewServer(rxid.Handler(admin.MustNew(p, testToken, zerolog.New(ioutil.Discard))))
+	defer tsT.Close()
+
+	const (
+		a = "https://a.example/a.png"
+		b = "https://b.example/b.png"
+	)
+	table := []struct {
+		method   string
+		path     string
+		body     string
+		wantCode int
+		want     admin.TakedownsResponse
+	}{
+		{"POST", "/admin/takedowns", `{"signed": ["` + sign(a) + `"], "urls": ["` + b + `"], "prefixes": ["https://c.example/"]}`, http.StatusOK,
+			admin.TakedownsResponse{Added: 3, Takedowns: blocklist.Takedowns{URLs: []string{b, a}, Prefixes: []string{"https://c.example/"}}}},
+		{"POST", "/admin/takedowns", `{"regexps": ["("]}`, http.StatusBadRequest, admin.TakedownsResponse{}},
+		{"POST", "/admin/takedowns", `{"signed": ["/bad/sig"]}`, http.StatusBadRequest, admin.TakedownsResponse{}},
+		{"DELETE", "/admin/takedowns", `{"urls": ["` + b + `"]}`, http.StatusOK,
+			admin.TakedownsResponse{Removed: 1, Takedowns: blocklist.Takedowns{URLs: []string{a}, Prefixes: []string{"https://c.example/"}}}},
+		{"GET", "/admin/takedowns", "", http.StatusOK,
+			admin.TakedownsResponse{Takedowns: blocklist.Takedowns{URLs: []string{a}, Prefixes: []string{"https://c.example/"}}}},
+		{"PUT", "/admin/takedowns", "", http.StatusMethodNotAllowed, admin.TakedownsResponse{}},
+		{"POST", "/admin/takedowns/reload", "", http.StatusOK,
+			admin.TakedownsResponse{Takedowns: blocklist.Takedowns{URLs: []string{a}, Prefixes: []string{"https://c.example/"}}}},
+	}
+	for _, test := range table {
+		resp := do(t, test.method, tsT.URL+test.path, test.body)
+		checkers.Assert(t, resp.StatusCode == test.wantCode, "%s %s: got %d want %d", test.method, test.path, resp.StatusCode, test.wantCode)
+		if test.wantCode == http.StatusOK {
+			var got admin.TakedownsResponse
+			checkers.OK(t, json.NewDecoder(resp.Body).Decode(&got))
+			checkers.Equals(t, got, test.want)
+		}
+		resp.Body.Close()
+	}
+	checkers.Assert(t, list.Match(a), "signed URL not taken down")
+}
+
+func newTestAdmin(t *testing.T) (*httptest.Server, *httptest.Server, *cache.Memory) {
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(r.URL.Path))
+	}))
+
+	c := cache.MustNewMemory(1024 * 1024)
+	p := proxy.MustNew([]byte(testKey),
+		zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.Cache = c },
+		func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+		func(p *proxy.Proxy) {
+			p.LookupIP = func(string) ([]net.IP, error) { return []net.IP{net.ParseIP("127.0.0.1")}, nil }
+		},
+		func(p *proxy.Proxy) { p.CheckUnicast = false },
+	)
+	ts := httptest.NewServer(rxid.Handler(admin.MustNew(p, testToken, zerolog.New(ioutil.Discard))))
+	return ts, be, c
+}
+
+func do(t *testing.T, method, url, body string) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	checkers.OK(t, err)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	checkers.OK(t, err)
+	return resp
+}
+
+// sign returns the camo path for u.
+func sign(u string) string {
+	mac := hmac.New(sha1.New, []byte(testKey))
+	mac.Write([]byte(u))
+	return "/" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) +
+		"/" + base64.RawURLEncoding.EncodeToString([]byte(u))
+}
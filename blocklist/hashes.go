@@ -0,0 +1,154 @@
+// Package blocklist keeps track of content we've been told not to serve.
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Sum is the SHA-256 of a body.
+type Sum [sha256.Size]byte
+
+// ParseSum parses a hex encoded SHA-256.
+func ParseSum(s string) (Sum, error) {
+	var sum Sum
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != len(sum) {
+		return sum, fmt.Errorf("invalid SHA-256: %q", s)
+	}
+	copy(sum[:], b)
+	return sum, nil
+}
+
+// Hashes is a set of SHA-256 sums of bodies we mustn't serve, kept in a file
+// of one hex sum per line. It is safe for concurrent use.
+type Hashes struct {
+	path string
+
+	mu   sync.RWMutex // protects sums and writes to the file
+	sums map[Sum]bool
+}
+
+// LoadHashes reads the sums in the file at path. Blank lines and lines
+// starting with # are skipped. Anything after the sum on a line is ignored so
+// the output of sha256sum can be used as it is.
+func LoadHashes(path string) (*Hashes, error) {
+	h := &Hashes{path: path}
+	if _, err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reads the file again, replacing the sums we have, and returns how
+// many it holds. On error the sums we have are kept.
+func (h *Hashes) Reload() (int, error) {
+	b, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		return 0, err
+	}
+	sums := map[Sum]bool{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		sum, err := ParseSum(fields[0])
+		if err != nil {
+			return 0, fmt.Errorf("%s:%d: %v", h.path, line, err)
+		}
+		sums[sum] = true
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+
+	h.mu.Lock()
+	h.sums = sums
+	h.mu.Unlock()
+	return len(sums), nil
+}
+
+// Contains tells us if sum is on the list.
+func (h *Hashes) Contains(sum Sum) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sums[sum]
+}
+
+// Len is the number of sums on the list.
+func (h *Hashes) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.sums)
+}
+
+// Add adds the hex encoded sums to the list and appends those it didn't
+// already have to the file, so they survive a reload. It returns the number
+// added. Nothing is added if any of them is invalid.
+func (h *Hashes) Add(hexSums []string) (int, error) {
+	sums := make([]Sum, 0, len(hexSums))
+	for _, s := range hexSums {
+		sum, err := ParseSum(s)
+		if err != nil {
+			return 0, err
+		}
+		sums = append(sums, sum)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var (
+		buf   bytes.Buffer
+		added = map[Sum]bool{}
+	)
+	for _, sum := range sums {
+		if h.sums[sum] || added[sum] {
+			continue
+		}
+		added[sum] = true
+		fmt.Fprintf(&buf, "%x\n", sum[:])
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	if !endsInNewline(f) {
+		f.Write([]byte("\n"))
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	for sum := range added {
+		h.sums[sum] = true
+	}
+	return len(added), nil
+}
+
+// endsInNewline tells us if f is empty or its last line is finished, so we can
+// append to it.
+func endsInNewline(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return true
+	}
+	last := make([]byte, 1)
+	_, err = f.ReadAt(last, fi.Size()-1)
+	return err != nil || last[0] == '\n'
+}
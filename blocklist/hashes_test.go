@@ -0,0 +1,60 @@
+package blocklist_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/checkers"
+)
+
+func TestHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	checkers.OK(t, err)
+	defer os.RemoveAll(dir)
+
+	var (
+		bad   = sha256.Sum256([]byte("bad"))
+		worse = sha256.Sum256([]byte("worse"))
+		fine  = sha256.Sum256([]byte("fine"))
+		path  = filepath.Join(dir, "hashes")
+	)
+	// The last line is left unfinished.
+	list := fmt.Sprintf("# takedowns\n\n%x  bad.jpg\n%X", bad[:], worse[:])
+	checkers.OK(t, ioutil.WriteFile(path, []byte(list), 0644))
+
+	h, err := blocklist.LoadHashes(path)
+	checkers.OK(t, err)
+	checkers.Equals(t, h.Len(), 2)
+	checkers.Assert(t, h.Contains(bad), "bad not blocked")
+	checkers.Assert(t, h.Contains(worse), "worse not blocked")
+	checkers.Assert(t, !h.Contains(fine), "fine blocked")
+
+	_, err = h.Add([]string{fmt.Sprintf("%x", fine[:]), "nope"})
+	checkers.Assert(t, err != nil, "invalid sum added")
+	checkers.Assert(t, !h.Contains(fine), "fine added with an invalid sum")
+
+	n, err := h.Add([]string{fmt.Sprintf("%x", fine[:]), fmt.Sprintf("%x", bad[:]), fmt.Sprintf("%x", fine[:])})
+	checkers.OK(t, err)
+	checkers.Equals(t, n, 1)
+	checkers.Assert(t, h.Contains(fine), "fine not added")
+
+	// What was added is in the file.
+	n, err = h.Reload()
+	checkers.OK(t, err)
+	checkers.Equals(t, n, 3)
+	checkers.Assert(t, h.Contains(fine), "fine lost on reload")
+
+	// A bad file leaves the list as it was.
+	checkers.OK(t, ioutil.WriteFile(path, []byte("not a sum\n"), 0644))
+	_, err = h.Reload()
+	checkers.Assert(t, err != nil, "bad file loaded")
+	checkers.Equals(t, h.Len(), 3)
+
+	_, err = blocklist.LoadHashes(filepath.Join(dir, "missing"))
+	checkers.Assert(t, err != nil, "missing file loaded")
+}
@@ -0,0 +1,275 @@
+package blocklist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Takedowns are the upstream URLs we've been told not to serve: exact decoded
+// URLs, URL prefixes and regular expressions matched against the whole URL.
+// URLs and prefixes are kept, and URLs matched, escaped the way net/url
+// escapes them and with the scheme and host in lower case, so neither how a
+// URL was escaped nor the case of its scheme and host matters.
+type Takedowns struct {
+	URLs     []string `json:"urls,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+	Regexps  []string `json:"regexps,omitempty"`
+}
+
+// Len is the number of takedowns.
+func (t Takedowns) Len() int {
+	return len(t.URLs) + len(t.Prefixes) + len(t.Regexps)
+}
+
+// URLs is a takedown list kept in a JSON file of Takedowns. It is safe for
+// concurrent use.
+type URLs struct {
+	path string
+
+	mu      sync.RWMutex // protects everything below and writes to the file
+	t       Takedowns
+	exact   map[string]bool
+	regexps []*regexp.Regexp
+}
+
+// LoadURLs reads the takedowns in the file at path. An empty file has none.
+func LoadURLs(path string) (*URLs, error) {
+	l := &URLs{path: path}
+	if _, err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload reads the file again, replacing the takedowns we have, and returns
+// how many it holds. On error the takedowns we have are kept.
+func (l *URLs) Reload() (int, error) {
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return 0, err
+	}
+	var t Takedowns
+	if len(strings.TrimSpace(string(b))) > 0 {
+		if err := json.Unmarshal(b, &t); err != nil {
+			return 0, fmt.Errorf("%s: %v", l.path, err)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.set(t); err != nil {
+		return 0, fmt.Errorf("%s: %v", l.path, err)
+	}
+	return t.Len(), nil
+}
+
+// Match tells us if the upstream URL u is taken down.
+func (l *URLs) Match(u string) bool {
+	u = normalize(u)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.exact[u] {
+		return true
+	}
+	for _, prefix := range l.t.Prefixes {
+		if strings.HasPrefix(u, prefix) {
+			return true
+		}
+	}
+	for _, re := range l.regexps {
+		if re.MatchString(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns a copy of the takedowns.
+func (l *URLs) List() Takedowns {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return Takedowns{
+		URLs:     append([]string(nil), l.t.URLs...),
+		Prefixes: append([]string(nil), l.t.Prefixes...),
+		Regexps:  append([]string(nil), l.t.Regexps...),
+	}
+}
+
+// Len is the number of takedowns.
+func (l *URLs) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.t.Len()
+}
+
+// Add adds the takedowns in t we don't already have, writes the list to the
+// file and returns the number added. Nothing is added if a regexp in t is
+// invalid or the file can't be written.
+func (l *URLs) Add(t Takedowns) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t = t.normalized()
+	next := Takedowns{
+		URLs:     union(l.t.URLs, t.URLs),
+		Prefixes: union(l.t.Prefixes, t.Prefixes),
+		Regexps:  union(l.t.Regexps, t.Regexps),
+	}
+	added := next.Len() - l.t.Len()
+	if err := l.save(next); err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// Remove removes the takedowns in t, writes the list to the file and returns
+// the number removed.
+func (l *URLs) Remove(t Takedowns) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t = t.normalized()
+	next := Takedowns{
+		URLs:     difference(l.t.URLs, t.URLs),
+		Prefixes: difference(l.t.Prefixes, t.Prefixes),
+		Regexps:  difference(l.t.Regexps, t.Regexps),
+	}
+	removed := l.t.Len() - next.Len()
+	if err := l.save(next); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// save writes t to the file, replacing it whole so a reader never sees half a
+// list, then makes it the list we match against. l.mu must be held.
+func (l *URLs) save(t Takedowns) error {
+	old := l.t
+	if err := l.set(t); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err == nil {
+		err = writeFile(l.path, append(b, '\n'))
+	}
+	if err != nil {
+		l.set(old)
+		return err
+	}
+	return nil
+}
+
+// set makes t the list we match against. l.mu must be held.
+func (l *URLs) set(t Takedowns) error {
+	for _, prefix := range t.Prefixes {
+		if prefix == "" {
+			return errors.New("empty prefix")
+		}
+	}
+	t = t.normalized()
+	regexps := make([]*regexp.Regexp, 0, len(t.Regexps))
+	for _, s := range t.Regexps {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return err
+		}
+		regexps = append(regexps, re)
+	}
+	exact := make(map[string]bool, len(t.URLs))
+	for _, u := range t.URLs {
+		exact[u] = true
+	}
+	l.t, l.exact, l.regexps = t, exact, regexps
+	return nil
+}
+
+// normalize puts the URL s in the form we match takedowns in: escaped the way
+// net/url escapes it, with the scheme and host in lower case. s is returned as
+// it is if it doesn't parse.
+func normalize(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// normalized returns t with its URLs and prefixes normalized, dropping any
+// that become duplicates.
+func (t Takedowns) normalized() Takedowns {
+	return Takedowns{
+		URLs:     union(nil, normalizeAll(t.URLs)),
+		Prefixes: union(nil, normalizeAll(t.Prefixes)),
+		Regexps:  t.Regexps,
+	}
+}
+
+// normalizeAll returns a copy of ss with each one normalized.
+func normalizeAll(ss []string) []string {
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = normalize(s)
+	}
+	return out
+}
+
+// writeFile replaces the file at path with b by way of a temporary file next
+// to it.
+func writeFile(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		os.Chmod(f.Name(), fi.Mode())
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// union returns a with the strings in b it doesn't have added, dropping empty
+// ones.
+func union(a, b []string) []string {
+	have := make(map[string]bool, len(a))
+	out := append([]string(nil), a...)
+	for _, s := range a {
+		have[s] = true
+	}
+	for _, s := range b {
+		if s != "" && !have[s] {
+			have[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// difference returns a without the strings in b.
+func difference(a, b []string) []string {
+	drop := make(map[string]bool, len(b))
+	for _, s := range b {
+		drop[s] = true
+	}
+	var out []string
+	for _, s := range a {
+		if !drop[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package blocklist_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/checkers"
+)
+
+func TestURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	checkers.OK(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "takedowns.json")
+	checkers.OK(t, ioutil.WriteFile(path, nil, 0644))
+
+	l, err := blocklist.LoadURLs(path)
+	checkers.OK(t, err)
+	checkers.Equals(t, l.Len(), 0)
+
+	n, err := l.Add(blocklist.Takedowns{
+		URLs:     []string{"https://a.example/bad.png", "https://a.example/bad.png"},
+		Prefixes: []string{"https://b.example/private/"},
+		Regexps:  []string{`^https?://c\.example/.*\.gif$`},
+	})
+	checkers.OK(t, err)
+	checkers.Equals(t, n, 3)
+
+	_, err = l.Add(blocklist.Takedowns{URLs: []string{"https://d.example/"}, Regexps: []string{"("}})
+	checkers.Assert(t, err != nil, "invalid regexp added")
+	checkers.Equals(t, l.Len(), 3)
+
+	table := []struct {
+		url  string
+		want bool
+	}{
+		{"https://a.example/bad.png", true},
+		{"https://a.example/bad.png?x=1", false},
+		{"https://b.example/private/x.jpg", true},
+		{"https://b.example/public/x.jpg", false},
+		{"http://c.example/x/y.gif", true},
+		{"http://c.example/x/y.gif.png", false},
+		{"https://d.example/", false},
+	}
+	for _, test := range table {
+		checkers.Assert(t, l.Match(test.url) == test.want, "%s: got %v want %v", test.url, !test.want, test.want)
+	}
+
+	// Changes are in the file.
+	n, err = l.Remove(blocklist.Takedowns{URLs: []string{"https://a.example/bad.png", "https://e.example/"}})
+	checkers.OK(t, err)
+	checkers.Equals(t, n, 1)
+	reloaded, err := blocklist.LoadURLs(path)
+	checkers.OK(t, err)
+	checkers.Equals(t, reloaded.List(), blocklist.Takedowns{
+		Prefixes: []string{"https://b.example/private/"},
+		Regexps:  []string{`^https?://c\.example/.*\.gif$`},
+	})
+
+	// A bad file leaves the list as it was.
+	checkers.OK(t, ioutil.WriteFile(path, []byte(`{"prefixes": [""]}`), 0644))
+	_, err = l.Reload()
+	checkers.Assert(t, err != nil, "empty prefix loaded")
+	checkers.Equals(t, l.Len(), 2)
+}
+
+func TestURLsNormalized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	checkers.OK(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "takedowns.json")
+	checkers.OK(t, ioutil.WriteFile(path, nil, 0644))
+
+	l, err := blocklist.LoadURLs(path)
+	checkers.OK(t, err)
+	n, err := l.Add(blocklist.Takedowns{
+		URLs:     []string{"https://a.example/a b.png", "https://a.example/a%20b.png", "HTTPS://A.Example/Up.png", "https://a.example/café.png"},
+		Prefixes: []string{"HTTPS://B.Example/private/"},
+	})
+	checkers.OK(t, err)
+	checkers.Equals(t, n, 4)
+
+	table := []struct {
+		url  string
+		want bool
+	}{
+		{"https://a.example/a b.png", true},
+		{"https://a.example/a%20b.png", true},
+		{"https://a.example/Up.png", true},
+		{"HTTPS://a.example/Up.png", true},
+		{"https://a.example/up.png", false},
+		{"https://a.example/caf%C3%A9.png", true},
+		{"https://a.example/café.png", true},
+		{"https://b.example/private/x.jpg", true},
+		{"HTTPS://B.EXAMPLE/private/x.jpg", true},
+		{"https://b.example/PRIVATE/x.jpg", false},
+	}
+	for _, test := range table {
+		checkers.Assert(t, l.Match(test.url) == test.want, "%s: got %v want %v", test.url, !test.want, test.want)
+	}
+
+	n, err = l.Remove(blocklist.Takedowns{URLs: []string{"https://a.example/caf%C3%A9.png"}})
+	checkers.OK(t, err)
+	checkers.Equals(t, n, 1)
+}
@@ -0,0 +1,198 @@
+// Package breaker implements circuit breakers keyed by upstream host.
+package breaker
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultErrorRate is the fraction of failed requests that opens a
+	// breaker.
+	DefaultErrorRate = 0.5
+
+	// DefaultMinRequests is the number of requests a window needs before its
+	// error rate counts.
+	DefaultMinRequests = 20
+
+	// DefaultOpenFor is how long a breaker stays open before it lets a probe
+	// through.
+	DefaultOpenFor = 30 * time.Second
+
+	// DefaultWindow is the period over which the error rate is measured.
+	DefaultWindow = 10 * time.Second
+)
+
+// ErrOpen is returned by Allow when a host's breaker is open.
+var ErrOpen = errors.New("circuit breaker open")
+
+// transitions counts breakers entering each State.
+var transitions = expvar.NewMap("breakerTransitions")
+
+// State is the state of a breaker.
+type State string
+
+// Breaker states.
+const (
+	Closed   State = "closed"
+	Open     State = "open"
+	HalfOpen State = "half_open"
+)
+
+// Status is a snapshot of a host's breaker. Requests and Failures count the
+// current window.
+type Status struct {
+	State    State     `json:"state"`
+	Since    time.Time `json:"since"`
+	Requests int       `json:"requests"`
+	Failures int       `json:"failures"`
+}
+
+// MustNew returns a Set of breakers or panics.
+func MustNew(options ...func(*Set)) *Set {
+	s := &Set{
+		ErrorRate:   DefaultErrorRate,
+		MinRequests: DefaultMinRequests,
+		OpenFor:     DefaultOpenFor,
+		Window:      DefaultWindow,
+
+		hosts: make(map[string]*breaker),
+	}
+
+	for _, opt := range options {
+		opt(s)
+	}
+
+	if s.ErrorRate <= 0 || s.ErrorRate > 1 {
+		panic("error rate must be greater than 0 and at most 1")
+	}
+	if s.OpenFor <= 0 || s.Window <= 0 {
+		panic("open period and window must be positive")
+	}
+	return s
+}
+
+// Set holds a breaker per host. A breaker opens when the error rate over a
+// window of at least MinRequests reaches ErrorRate. After OpenFor it lets a
+// single probe through, closing if that succeeds and opening again if not.
+type Set struct {
+	ErrorRate   float64
+	MinRequests int
+	OpenFor     time.Duration
+	Window      time.Duration
+
+	mu    sync.Mutex // protects everything below
+	hosts map[string]*breaker
+	swept time.Time
+}
+
+type breaker struct {
+	state   State
+	since   time.Time
+	start   time.Time // of the current window
+	probing bool
+
+	requests, failures int
+}
+
+func (b *breaker) set(state State, now time.Time) {
+	b.state, b.since = state, now
+	b.start, b.requests, b.failures = now, 0, 0
+	transitions.Add(string(state), 1)
+}
+
+// Allow asks to send a request to host. It returns ErrOpen if the request
+// should not be made, otherwise the caller must report the outcome by
+// calling done once.
+func (s *Set) Allow(host string) (done func(failed bool), err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	b, ok := s.hosts[host]
+	if !ok {
+		b = &breaker{state: Closed, since: now, start: now}
+		s.hosts[host] = b
+	}
+
+	switch b.state {
+	case Open:
+		if now.Sub(b.since) < s.OpenFor {
+			return nil, ErrOpen
+		}
+		b.set(HalfOpen, now)
+		fallthrough
+	case HalfOpen:
+		if b.probing {
+			return nil, ErrOpen
+		}
+		b.probing = true
+		return s.done(b, true), nil
+	}
+	return s.done(b, false), nil
+}
+
+func (s *Set) done(b *breaker, probe bool) func(bool) {
+	var once sync.Once
+	return func(failed bool) {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			now := time.Now()
+			if probe {
+				b.probing = false
+				if failed {
+					b.set(Open, now)
+				} else {
+					b.set(Closed, now)
+				}
+				return
+			}
+			// Another request may have opened it meanwhile.
+			if b.state != Closed {
+				return
+			}
+			if now.Sub(b.start) > s.Window {
+				b.start, b.requests, b.failures = now, 0, 0
+			}
+			b.requests++
+			if failed {
+				b.failures++
+			}
+			if b.requests >= s.MinRequests && float64(b.failures) >= s.ErrorRate*float64(b.requests) {
+				b.set(Open, now)
+			}
+		})
+	}
+}
+
+// sweep forgets closed breakers with nothing in their window so the set
+// doesn't grow with every host we have ever seen.
+func (s *Set) sweep(now time.Time) {
+	if now.Sub(s.swept) < s.Window {
+		return
+	}
+	s.swept = now
+	for host, b := range s.hosts {
+		if b.state == Closed && now.Sub(b.start) > s.Window {
+			delete(s.hosts, host)
+		}
+	}
+}
+
+// States returns the status of every breaker we know of, keyed by host.
+func (s *Set) States() map[string]Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := make(map[string]Status, len(s.hosts))
+	for host, b := range s.hosts {
+		states[host] = Status{State: b.state, Since: b.since, Requests: b.requests, Failures: b.failures}
+	}
+	return states
+}
@@ -0,0 +1,102 @@
+package breaker_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/breaker"
+	"github.com/bepress/camo/checkers"
+)
+
+func TestBreakerOpens(t *testing.T) {
+	tut := breaker.MustNew(
+		func(s *breaker.Set) { s.MinRequests = 4 },
+		func(s *breaker.Set) { s.ErrorRate = 0.5 },
+	)
+
+	for _, failed := range []bool{false, true, false, true} {
+		done, err := tut.Allow("example.com")
+		checkers.OK(t, err)
+		done(failed)
+	}
+
+	_, err := tut.Allow("example.com")
+	checkers.Equals(t, err, breaker.ErrOpen)
+	checkers.Equals(t, tut.States()["example.com"].State, breaker.Open)
+
+	// Other hosts are unaffected.
+	done, err := tut.Allow("example.org")
+	checkers.OK(t, err)
+	done(false)
+	checkers.Equals(t, tut.States()["example.org"].State, breaker.Closed)
+}
+
+func TestBreakerNeedsMinRequests(t *testing.T) {
+	tut := breaker.MustNew(func(s *breaker.Set) { s.MinRequests = 3 })
+
+	for i := 0; i < 2; i++ {
+		done, err := tut.Allow("example.com")
+		checkers.OK(t, err)
+		done(true)
+	}
+	st := tut.States()["example.com"]
+	checkers.Equals(t, st.State, breaker.Closed)
+	checkers.Equals(t, st.Requests, 2)
+	checkers.Equals(t, st.Failures, 2)
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	table := []struct {
+		desc        string
+		probeFailed bool
+		want        breaker.State
+	}{
+		{"probe succeeds", false, breaker.Closed},
+		{"probe fails", true, breaker.Open},
+	}
+
+	for _, test := range table {
+		tut := breaker.MustNew(
+			func(s *breaker.Set) { s.MinRequests = 1 },
+			func(s *breaker.Set) { s.OpenFor = 10 * time.Millisecond },
+		)
+		done, err := tut.Allow("example.com")
+		checkers.OK(t, err)
+		done(true)
+		checkers.Equals(t, tut.States()["example.com"].State, breaker.Open)
+
+		time.Sleep(20 * time.Millisecond)
+
+		probe, err := tut.Allow("example.com")
+		checkers.OK(t, err)
+		checkers.Equals(t, tut.States()["example.com"].State, breaker.HalfOpen)
+
+		// Only one probe at a time.
+		_, err = tut.Allow("example.com")
+		checkers.Equals(t, err, breaker.ErrOpen)
+
+		probe(test.probeFailed)
+		probe(false) // Extra calls are ignored.
+		checkers.Equals(t, tut.States()["example.com"].State, test.want)
+	}
+}
+
+func TestMustNewPanics(t *testing.T) {
+	table := []func(*breaker.Set){
+		func(s *breaker.Set) { s.ErrorRate = 0 },
+		func(s *breaker.Set) { s.ErrorRate = 1.5 },
+		func(s *breaker.Set) { s.OpenFor = 0 },
+		func(s *breaker.Set) { s.Window = -time.Second },
+	}
+
+	for _, opt := range table {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Error("breaker.MustNew failed to panic")
+				}
+			}()
+			breaker.MustNew(opt)
+		}()
+	}
+}
@@ -0,0 +1,68 @@
+// Package cache implements storage for proxied upstream responses.
+package cache
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"time"
+)
+
+// Entry is a stored upstream response.
+type Entry struct {
+	// URL is the decoded upstream URL the entry was fetched from. Several
+	// entries (variants) may share a URL.
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Stored     time.Time
+	Expires    time.Time
+
+	// GeneratedETag is set when the ETag header was computed from the body
+	// because upstream didn't send one. It can't be used to revalidate.
+	GeneratedETag bool
+
+	// Sum is the SHA-256 of the upstream body the entry was made from, which
+	// for a transformed entry isn't its Body.
+	Sum [sha256.Size]byte
+
+	// Vary, if set, makes the entry a marker with no response of its own.
+	// The URL's responses vary on these request headers and are stored under
+	// keys that add the request's values of them.
+	Vary []string
+}
+
+// Fresh tells us if the entry may be served without revalidation.
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// Size is the approximate number of bytes the entry occupies.
+func (e *Entry) Size() int64 {
+	size := int64(len(e.URL) + len(e.Body))
+	for _, v := range e.Vary {
+		size += int64(len(v))
+	}
+	for k, vv := range e.Header {
+		size += int64(len(k))
+		for _, v := range vv {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+// Cache is the interface the proxy uses to store and retrieve responses.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the entry stored under key.
+	Get(key string) (*Entry, bool)
+	// Set stores the entry under key, replacing any existing entry.
+	Set(key string, e *Entry)
+	// Delete removes the entry stored under key. It reports whether there
+	// was one.
+	Delete(key string) bool
+	// Purge removes every entry for which match returns true and returns the
+	// number removed.
+	Purge(match func(key string, e *Entry) bool) int
+}
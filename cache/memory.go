@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// MustNewMemory returns an in-memory LRU cache holding at most maxBytes of
+// entries or panics.
+func MustNewMemory(maxBytes int64) *Memory {
+	if maxBytes <= 0 {
+		panic("cache size must be positive")
+	}
+	return &Memory{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Memory is an in-memory least recently used cache bounded by size in bytes.
+type Memory struct {
+	maxBytes int64
+
+	mu    sync.Mutex // protects everything below
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type item struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+// Get implements Cache.
+func (m *Memory) Get(key string) (*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.ll.MoveToFront(el)
+	return el.Value.(*item).entry, true
+}
+
+// Set implements Cache. Entries larger than the cache are not stored.
+func (m *Memory) Set(key string, e *Entry) {
+	size := e.Size() + int64(len(key))
+	if size > m.maxBytes {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.items[key]; ok {
+		m.remove(el)
+	}
+	m.items[key] = m.ll.PushFront(&item{key: key, entry: e, size: size})
+	m.size += size
+
+	for m.size > m.maxBytes {
+		m.remove(m.ll.Back())
+	}
+}
+
+// Delete implements Cache.
+func (m *Memory) Delete(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[key]
+	if !ok {
+		return false
+	}
+	m.remove(el)
+	return true
+}
+
+// Purge implements Cache.
+func (m *Memory) Purge(match func(string, *Entry) bool) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int
+	for el := m.ll.Front(); el != nil; {
+		next := el.Next()
+		it := el.Value.(*item)
+		if match(it.key, it.entry) {
+			m.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// Len returns the number of entries in the cache.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ll.Len()
+}
+
+// Bytes returns the approximate size of the cache contents.
+func (m *Memory) Bytes() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+// remove must be called with mu held.
+func (m *Memory) remove(el *list.Element) {
+	it := el.Value.(*item)
+	m.ll.Remove(el)
+	delete(m.items, it.key)
+	m.size -= it.size
+}
@@ -0,0 +1,92 @@
+package cache_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+)
+
+func TestMemoryGetSet(t *testing.T) {
+	tut := cache.MustNewMemory(1024)
+
+	_, ok := tut.Get("missing")
+	checkers.Equals(t, ok, false)
+
+	e := &cache.Entry{URL: "http://example.com/a.png", StatusCode: 200, Body: []byte("a")}
+	tut.Set("a", e)
+	got, ok := tut.Get("a")
+	checkers.Equals(t, ok, true)
+	checkers.Equals(t, got, e)
+	checkers.Equals(t, tut.Len(), 1)
+	checkers.Equals(t, tut.Bytes(), e.Size()+1)
+
+	// Replacing an entry doesn't grow the cache.
+	tut.Set("a", e)
+	checkers.Equals(t, tut.Len(), 1)
+	checkers.Equals(t, tut.Bytes(), e.Size()+1)
+
+	checkers.Equals(t, tut.Delete("a"), true)
+	checkers.Equals(t, tut.Delete("a"), false)
+	checkers.Equals(t, tut.Len(), 0)
+	checkers.Equals(t, tut.Bytes(), int64(0))
+}
+
+func TestMemoryEvictsLeastRecentlyUsed(t *testing.T) {
+	body := []byte(strings.Repeat("x", 100))
+	tut := cache.MustNewMemory(350)
+
+	tut.Set("a", &cache.Entry{Body: body})
+	tut.Set("b", &cache.Entry{Body: body})
+	tut.Set("c", &cache.Entry{Body: body})
+
+	// Touch a so b is the oldest.
+	_, ok := tut.Get("a")
+	checkers.Equals(t, ok, true)
+
+	tut.Set("d", &cache.Entry{Body: body})
+
+	_, ok = tut.Get("b")
+	checkers.Equals(t, ok, false)
+	for _, k := range []string{"a", "c", "d"} {
+		_, ok = tut.Get(k)
+		checkers.Assert(t, ok, "expected %q to be cached", k)
+	}
+
+	// Too large to ever fit.
+	tut.Set("big", &cache.Entry{Body: make([]byte, 400)})
+	_, ok = tut.Get("big")
+	checkers.Equals(t, ok, false)
+}
+
+func TestMemoryPurge(t *testing.T) {
+	tut := cache.MustNewMemory(1024)
+	tut.Set("1", &cache.Entry{URL: "http://example.com/a.png"})
+	tut.Set("2", &cache.Entry{URL: "http://example.com/a.png"})
+	tut.Set("3", &cache.Entry{URL: "http://example.org/b.png"})
+
+	n := tut.Purge(func(_ string, e *cache.Entry) bool {
+		return e.URL == "http://example.com/a.png"
+	})
+	checkers.Equals(t, n, 2)
+	checkers.Equals(t, tut.Len(), 1)
+}
+
+func TestEntryFresh(t *testing.T) {
+	now := time.Now()
+	e := &cache.Entry{Expires: now.Add(time.Minute)}
+	checkers.Equals(t, e.Fresh(now), true)
+	checkers.Equals(t, e.Fresh(now.Add(time.Hour)), false)
+}
+
+func TestMustNewMemoryPanics(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("cache.MustNewMemory failed to panic")
+		}
+	}()
+
+	_ = cache.MustNewMemory(0)
+}
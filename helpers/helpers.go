@@ -17,3 +17,16 @@ func GetHMAC(s string) string {
 	hmac = os.Getenv(HMACEnvKey)
 	return hmac
 }
+
+// AdminTokenEnvKey is the string key for storing the admin API token in an
+// environment variable.
+const AdminTokenEnvKey = "CAMO_ADMIN_TOKEN"
+
+// GetAdminToken gets the admin API token from the passed in value or the
+// environment if the parameter provided is empty.
+func GetAdminToken(s string) string {
+	if s != "" {
+		return s
+	}
+	return os.Getenv(AdminTokenEnvKey)
+}
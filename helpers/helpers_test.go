@@ -28,3 +28,24 @@ func TestGetHMAC(t *testing.T) {
 		checkers.Equals(t, got, test.want)
 	}
 }
+
+func TestGetAdminToken(t *testing.T) {
+	table := []struct {
+		env   string
+		token string
+		want  string
+	}{
+		{"", "token", "token"},
+		{"env", "", "env"},
+		{"env", "token", "token"},
+		{"", "", ""},
+	}
+	for _, test := range table {
+		os.Unsetenv(helpers.AdminTokenEnvKey)
+		if test.env != "" {
+			os.Setenv(helpers.AdminTokenEnvKey, test.env)
+		}
+		got := helpers.GetAdminToken(test.token)
+		checkers.Equals(t, got, test.want)
+	}
+}
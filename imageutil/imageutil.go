@@ -0,0 +1,36 @@
+// Package imageutil holds the small pieces of image format handling that the
+// proxy and the strip, transform and meta packages share.
+package imageutil
+
+import "io"
+
+// VP8XAnimation is the VP8X flag for an animated WebP.
+const VP8XAnimation = 0x02
+
+// PrefixMatches tells us if b and magic agree as far as both go, ? in magic
+// matching any byte.
+func PrefixMatches(b []byte, magic string) bool {
+	for i := 0; i < len(magic) && i < len(b); i++ {
+		if magic[i] != '?' && magic[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// AtLeastOne returns n, or 1 if n is less, so a scaled dimension never drops
+// to nothing.
+func AtLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Unexpected turns io.EOF in the middle of an image into io.ErrUnexpectedEOF.
+func Unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package imageutil_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/imageutil"
+)
+
+func TestPrefixMatches(t *testing.T) {
+	table := []struct {
+		b     string
+		magic string
+		want  bool
+	}{
+		{"\xff\xd8\xff", "\xff\xd8", true},
+		{"\xff", "\xff\xd8", true},
+		{"", "\xff\xd8", true},
+		{"\xff\xd9", "\xff\xd8", false},
+		{"RIFF\x01\x02\x03\x04WEBP", "RIFF????WEBP", true},
+		{"RIFF\x01\x02\x03\x04WAVE", "RIFF????WEBP", false},
+	}
+	for _, test := range table {
+		checkers.Assert(t, imageutil.PrefixMatches([]byte(test.b), test.magic) == test.want, "%q %q: got %v", test.b, test.magic, !test.want)
+	}
+}
+
+func TestAtLeastOne(t *testing.T) {
+	table := []struct {
+		n    int
+		want int
+	}{
+		{-3, 1},
+		{0, 1},
+		{1, 1},
+		{7, 7},
+	}
+	for _, test := range table {
+		checkers.Equals(t, imageutil.AtLeastOne(test.n), test.want)
+	}
+}
+
+func TestUnexpected(t *testing.T) {
+	other := errors.New("other")
+	table := []struct {
+		err  error
+		want error
+	}{
+		{io.EOF, io.ErrUnexpectedEOF},
+		{other, other},
+		{nil, nil},
+	}
+	for _, test := range table {
+		checkers.Equals(t, imageutil.Unexpected(test.err), test.want)
+	}
+}
@@ -0,0 +1,174 @@
+// Package inflight limits concurrent upstream requests per host and overall.
+package inflight
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPerHost is the most concurrent requests to one host.
+	DefaultPerHost = 32
+
+	// DefaultQueue is the most requests that may wait for one host.
+	DefaultQueue = 64
+
+	// DefaultGlobal is the most concurrent requests to all hosts.
+	DefaultGlobal = 512
+
+	// DefaultMaxWait is the longest a request waits for a slot.
+	DefaultMaxWait = time.Second
+)
+
+var (
+	// ErrHostLimit is returned when a host has too many requests in flight
+	// and waiting.
+	ErrHostLimit = errors.New("too many requests to host")
+
+	// ErrGlobalLimit is returned when no slot frees up in time.
+	ErrGlobalLimit = errors.New("too many upstream requests")
+)
+
+// MustNew returns a Limiter or panics.
+func MustNew(options ...func(*Limiter)) *Limiter {
+	l := &Limiter{
+		PerHost: DefaultPerHost,
+		Queue:   DefaultQueue,
+		Global:  DefaultGlobal,
+		MaxWait: DefaultMaxWait,
+
+		hosts: make(map[string]*host),
+	}
+
+	for _, opt := range options {
+		opt(l)
+	}
+
+	if l.PerHost <= 0 || l.Global <= 0 {
+		panic("concurrency limits must be positive")
+	}
+	if l.Queue < 0 || l.MaxWait < 0 {
+		panic("queue and wait must not be negative")
+	}
+	l.global = make(chan struct{}, l.Global)
+	return l
+}
+
+// Limiter caps the requests in flight to each host at PerHost, with up to
+// Queue more waiting their turn in order, and caps requests to all hosts at
+// Global. A slow host fills its own queue without holding more than PerHost
+// of the global slots.
+type Limiter struct {
+	PerHost int
+	Queue   int
+	Global  int
+	MaxWait time.Duration
+
+	global chan struct{}
+
+	mu    sync.Mutex // protects hosts
+	hosts map[string]*host
+}
+
+type host struct {
+	active int
+	queue  []chan struct{}
+}
+
+// Acquire waits for a slot for a request to name. The wait ends at MaxWait
+// or when ctx is done, whichever is first. On success the caller must call
+// release once the request is finished, including reading the body.
+func (l *Limiter) Acquire(ctx context.Context, name string) (release func(), err error) {
+	timer := time.NewTimer(l.MaxWait)
+	defer timer.Stop()
+
+	if err := l.acquireHost(ctx, timer.C, name); err != nil {
+		return nil, err
+	}
+
+	select {
+	case l.global <- struct{}{}:
+	default:
+		select {
+		case l.global <- struct{}{}:
+		case <-timer.C:
+			l.releaseHost(name)
+			return nil, ErrGlobalLimit
+		case <-ctx.Done():
+			l.releaseHost(name)
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.global
+			l.releaseHost(name)
+		})
+	}, nil
+}
+
+func (l *Limiter) acquireHost(ctx context.Context, timeout <-chan time.Time, name string) error {
+	l.mu.Lock()
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &host{}
+		l.hosts[name] = h
+	}
+	if h.active < l.PerHost {
+		h.active++
+		l.mu.Unlock()
+		return nil
+	}
+	if len(h.queue) >= l.Queue {
+		l.mu.Unlock()
+		return ErrHostLimit
+	}
+	ready := make(chan struct{})
+	h.queue = append(h.queue, ready)
+	l.mu.Unlock()
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timeout:
+		err = ErrHostLimit
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ch := range h.queue {
+		if ch == ready {
+			h.queue = append(h.queue[:i], h.queue[i+1:]...)
+			return err
+		}
+	}
+	// We were handed the slot as we gave up, so pass it on.
+	l.releaseHostLocked(name, h)
+	return err
+}
+
+func (l *Limiter) releaseHost(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseHostLocked(name, l.hosts[name])
+}
+
+// releaseHostLocked hands the slot to the next in the queue or gives it up.
+func (l *Limiter) releaseHostLocked(name string, h *host) {
+	if len(h.queue) > 0 {
+		close(h.queue[0])
+		h.queue = h.queue[1:]
+		return
+	}
+	h.active--
+	if h.active == 0 {
+		delete(l.hosts, name)
+	}
+}
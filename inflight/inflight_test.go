@@ -0,0 +1,106 @@
+package inflight_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/inflight"
+)
+
+func TestHostLimitQueues(t *testing.T) {
+	tut := inflight.MustNew(
+		func(l *inflight.Limiter) { l.PerHost = 1 },
+		func(l *inflight.Limiter) { l.Queue = 1 },
+	)
+
+	release, err := tut.Acquire(context.Background(), "slow.example.com")
+	checkers.OK(t, err)
+
+	// The next one waits its turn.
+	got := make(chan error)
+	go func() {
+		release, err := tut.Acquire(context.Background(), "slow.example.com")
+		if err == nil {
+			release()
+		}
+		got <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// The queue is full.
+	_, err = tut.Acquire(context.Background(), "slow.example.com")
+	checkers.Equals(t, err, inflight.ErrHostLimit)
+
+	// Other hosts are unaffected.
+	other, err := tut.Acquire(context.Background(), "fast.example.com")
+	checkers.OK(t, err)
+	other()
+
+	release()
+	release() // Extra calls are ignored.
+	checkers.OK(t, <-got)
+
+	// Everything was given back.
+	release, err = tut.Acquire(context.Background(), "slow.example.com")
+	checkers.OK(t, err)
+	release()
+}
+
+func TestLimitWaits(t *testing.T) {
+	table := []struct {
+		desc    string
+		perHost int
+		global  int
+		second  string
+		want    error
+	}{
+		{"host", 1, 10, "example.com", inflight.ErrHostLimit},
+		{"global", 10, 1, "example.org", inflight.ErrGlobalLimit},
+	}
+
+	for _, test := range table {
+		tut := inflight.MustNew(
+			func(l *inflight.Limiter) { l.PerHost = test.perHost },
+			func(l *inflight.Limiter) { l.Global = test.global },
+			func(l *inflight.Limiter) { l.MaxWait = 20 * time.Millisecond },
+		)
+		release, err := tut.Acquire(context.Background(), "example.com")
+		checkers.OK(t, err)
+
+		start := time.Now()
+		_, err = tut.Acquire(context.Background(), test.second)
+		checkers.Equals(t, err, test.want)
+		checkers.Assert(t, time.Since(start) >= 20*time.Millisecond, "%s: gave up after %s", test.desc, time.Since(start))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = tut.Acquire(ctx, test.second)
+		checkers.Equals(t, err, context.Canceled)
+
+		release()
+		release, err = tut.Acquire(context.Background(), test.second)
+		checkers.OK(t, err)
+		release()
+	}
+}
+
+func TestMustNewPanics(t *testing.T) {
+	table := []func(*inflight.Limiter){
+		func(l *inflight.Limiter) { l.PerHost = 0 },
+		func(l *inflight.Limiter) { l.Global = 0 },
+		func(l *inflight.Limiter) { l.Queue = -1 },
+	}
+
+	for _, opt := range table {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Error("inflight.MustNew failed to panic")
+				}
+			}()
+			inflight.MustNew(opt)
+		}()
+	}
+}
@@ -43,6 +43,7 @@ const (
 	err500    = "500"
 	requests  = "requests"
 	completed = "completed"
+	aborted   = "aborted"
 	bytes     = "bytes_transferred"
 )
 
@@ -99,39 +100,52 @@ func (al *AccessLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	start := time.Now()
 
-	al.handler.ServeHTTP(bc, r)
-	dur := time.Since(start)
-
-	al.logger.Info().
-		Str("request_id", rxid.FromContext(r.Context())).
-		Str("client_ip", clientIP).
-		Strs("x_forwarded_for", strings.Split(r.Header.Get("X-Forwarded-For"), ", ")).
-		Dur("duration", dur).
-		Str("domain", r.Host).
-		Str("method", r.Method).
-		Str("uri", r.RequestURI).
-		Str("protocol", r.Proto).
-		Int("status", bc.status).
-		Int64("reponse_bytes", bc.responseBytes).
-		Str("referrer", r.Referer()).
-		Str("user_agent", r.UserAgent()).Msg("")
-
-	switch {
-	case bc.status == 404:
-		proxyCounter.Add(err404, 1)
-	case bc.status > 399 && bc.status < 500:
-		proxyCounter.Add(err400, 1)
-	case bc.status > 499:
-		proxyCounter.Add(err500, 1)
-	}
-
-	proxyCounter.Add(bytes, bc.responseBytes)
-	proxyCounter.Add(completed, 1)
-	rps.Incr(1)
-	bps.Incr(bc.responseBytes)
-	durAvg.Incr(dur.Nanoseconds())
-
-	reqSecond.Set(rps.Rate())
-	bytesSecond.Set(bps.Rate())
-	avgDuration.Set(durAvg.Rate())
+	// Logged in a defer so responses the handler cuts short by panicking,
+	// with http.ErrAbortHandler or otherwise, are counted too. The panic
+	// carries on once we're done.
+	var returned bool
+	defer func() {
+		dur := time.Since(start)
+
+		al.logger.Info().
+			Str("request_id", rxid.FromContext(r.Context())).
+			Str("client_ip", clientIP).
+			Strs("x_forwarded_for", strings.Split(r.Header.Get("X-Forwarded-For"), ", ")).
+			Dur("duration", dur).
+			Str("domain", r.Host).
+			Str("method", r.Method).
+			Str("uri", r.RequestURI).
+			Str("protocol", r.Proto).
+			Int("status", bc.status).
+			Int64("reponse_bytes", bc.responseBytes).
+			Str("referrer", r.Referer()).
+			Str("user_agent", r.UserAgent()).
+			Bool("aborted", !returned).Msg("")
+
+		switch {
+		case bc.status == 404:
+			proxyCounter.Add(err404, 1)
+		case bc.status > 399 && bc.status < 500:
+			proxyCounter.Add(err400, 1)
+		case bc.status > 499:
+			proxyCounter.Add(err500, 1)
+		}
+
+		proxyCounter.Add(bytes, bc.responseBytes)
+		if returned {
+			proxyCounter.Add(completed, 1)
+		} else {
+			proxyCounter.Add(aborted, 1)
+		}
+		rps.Incr(1)
+		bps.Incr(bc.responseBytes)
+		durAvg.Incr(dur.Nanoseconds())
+
+		reqSecond.Set(rps.Rate())
+		bytesSecond.Set(bps.Rate())
+		avgDuration.Set(durAvg.Rate())
+	}()
+
+	al.handler.ServeHTTP(wrapWriter(bc), r)
+	returned = true
 }
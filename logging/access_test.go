@@ -3,6 +3,8 @@ package logging_test
 import (
 	"bytes"
 	"encoding/json"
+	"expvar"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -105,4 +107,99 @@ type proxyLogRecord struct {
 	Referrer      string   `json:"referrer"`
 	UserAgent     string   `json:"user_agent"`
 	XForwardedFor []string `json:"x_forwarded_for"`
+	Aborted       bool     `json:"aborted"`
+}
+
+func TestAccessLoggerPreservesInterfaces(t *testing.T) {
+	table := []struct {
+		desc  string
+		http2 bool
+		want  map[string]bool
+	}{
+		{"HTTP/1.1", false, map[string]bool{"flusher": true, "close_notifier": true, "hijacker": true, "reader_from": true, "pusher": false}},
+		{"HTTP/2", true, map[string]bool{"flusher": true, "close_notifier": true, "hijacker": false, "reader_from": false, "pusher": true}},
+	}
+
+	for _, test := range table {
+		got := map[string]bool{}
+		ts := httptest.NewUnstartedServer(rxid.Handler(logging.NewAccessLogger(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				_, got["flusher"] = w.(http.Flusher)
+				_, got["close_notifier"] = w.(http.CloseNotifier)
+				_, got["hijacker"] = w.(http.Hijacker)
+				_, got["reader_from"] = w.(io.ReaderFrom)
+				_, got["pusher"] = w.(http.Pusher)
+			}), zerolog.New(ioutil.Discard))))
+		ts.EnableHTTP2 = test.http2
+		ts.StartTLS()
+
+		res, err := ts.Client().Get(ts.URL)
+		checkers.OK(t, err)
+		res.Body.Close()
+		checkers.Equals(t, res.ProtoMajor, map[bool]int{false: 1, true: 2}[test.http2])
+		checkers.Equals(t, got, test.want)
+		ts.Close()
+	}
+}
+
+func TestAccessLoggerCountsReadFrom(t *testing.T) {
+	const body = "copied through ReadFrom"
+	out := &bytes.Buffer{}
+	ts := httptest.NewServer(rxid.Handler(logging.NewAccessLogger(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.(io.ReaderFrom).ReadFrom(strings.NewReader(body))
+		}), zerolog.New(out))))
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	checkers.OK(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	checkers.OK(t, err)
+	res.Body.Close()
+	checkers.Equals(t, string(b), body)
+
+	got := &proxyLogRecord{}
+	checkers.OK(t, json.Unmarshal(out.Bytes(), got))
+	checkers.Equals(t, got.ReponseBytes, len(body))
+}
+
+func TestAccessLoggerLogsAborted(t *testing.T) {
+	const body = "the start of a response"
+	logs := make(chan []byte, 1)
+	ts := httptest.NewServer(rxid.Handler(logging.NewAccessLogger(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}), zerolog.New(chanWriter(logs)))))
+	defer ts.Close()
+
+	aborted := func() int64 {
+		if v, ok := expvar.Get("proxyCounter").(*expvar.Map).Get("aborted").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := aborted()
+
+	res, err := ts.Client().Get(ts.URL)
+	checkers.OK(t, err)
+	_, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	checkers.Assert(t, err != nil, "response was not cut short")
+
+	got := &proxyLogRecord{}
+	checkers.OK(t, json.Unmarshal(<-logs, got))
+	checkers.Equals(t, got.Status, http.StatusOK)
+	checkers.Equals(t, got.ReponseBytes, len(body))
+	checkers.Equals(t, got.Aborted, true)
+	checkers.Equals(t, aborted(), before+1)
+}
+
+// chanWriter sends what is written to it on the channel.
+type chanWriter chan []byte
+
+func (c chanWriter) Write(b []byte) (int, error) {
+	c <- append([]byte(nil), b...)
+	return len(b), nil
 }
@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"fmt"
 	"io"
 	stdliblog "log"
 	"os"
@@ -43,3 +44,15 @@ func NewLogger(app string, verbose bool, out io.Writer) zerolog.Logger {
 
 	return logger
 }
+
+// ErrDetails describes where it was called from, for error logs.
+func ErrDetails() string {
+	return CallerDetails(2)
+}
+
+// CallerDetails describes the caller skip frames up, for error logs. A skip
+// of 1 is the function calling CallerDetails.
+func CallerDetails(skip int) string {
+	pc, fn, line, _ := runtime.Caller(skip)
+	return fmt.Sprintf("[error] in %s[%s:%d]", runtime.FuncForPC(pc).Name(), fn, line)
+}
@@ -30,3 +30,8 @@ func TestVerboseNewLogger(t *testing.T) {
 	l.Info().Msg("foo")
 	checkers.Assert(t, strings.Contains(out.String(), "foo"), "expected string 'foo' missing")
 }
+
+func TestErrDetails(t *testing.T) {
+	got := logging.ErrDetails()
+	checkers.Assert(t, strings.Contains(got, "logging_test.TestErrDetails") && strings.Contains(got, "logger_test.go:"), "got %q", got)
+}
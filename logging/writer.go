@@ -0,0 +1,267 @@
+package logging
+
+import (
+	"io"
+	"net/http"
+)
+
+// Optional interfaces a ResponseWriter may implement.
+const (
+	flusher = 1 << iota
+	closeNotifier
+	hijacker
+	readerFrom
+	pusher
+)
+
+// wrapWriter returns bc with the optional interfaces of the ResponseWriter it
+// wraps, so things like flushing and hijacking keep working through the
+// access logger. Type assertions only see the methods of the static type,
+// so each combination needs its own type.
+func wrapWriter(bc *byteCounter) http.ResponseWriter {
+	var (
+		fl, isFl = bc.ResponseWriter.(http.Flusher)
+		cn, isCn = bc.ResponseWriter.(http.CloseNotifier)
+		hj, isHj = bc.ResponseWriter.(http.Hijacker)
+		_, isRf  = bc.ResponseWriter.(io.ReaderFrom)
+		pu, isPu = bc.ResponseWriter.(http.Pusher)
+		rf       = countingReaderFrom{bc}
+		has      int
+	)
+	if isFl {
+		has |= flusher
+	}
+	if isCn {
+		has |= closeNotifier
+	}
+	if isHj {
+		has |= hijacker
+	}
+	if isRf {
+		has |= readerFrom
+	}
+	if isPu {
+		has |= pusher
+	}
+
+	switch has {
+	case flusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{bc, fl}
+	case closeNotifier:
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+		}{bc, cn}
+	case flusher | closeNotifier:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.CloseNotifier
+		}{bc, fl, cn}
+	case hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{bc, hj}
+	case flusher | hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{bc, fl, hj}
+	case closeNotifier | hijacker:
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+		}{bc, cn, hj}
+	case flusher | closeNotifier | hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.CloseNotifier
+			http.Hijacker
+		}{bc, fl, cn, hj}
+	case readerFrom:
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+		}{bc, rf}
+	case flusher | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{bc, fl, rf}
+	case closeNotifier | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			io.ReaderFrom
+		}{bc, cn, rf}
+	case flusher | closeNotifier | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.CloseNotifier
+			io.ReaderFrom
+		}{bc, fl, cn, rf}
+	case hijacker | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{bc, hj, rf}
+	case flusher | hijacker | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{bc, fl, hj, rf}
+	case closeNotifier | hijacker | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+		}{bc, cn, hj, rf}
+	case flusher | closeNotifier | hijacker | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+		}{bc, fl, cn, hj, rf}
+	case pusher:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+		}{bc, pu}
+	case flusher | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{bc, fl, pu}
+	case closeNotifier | pusher:
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Pusher
+		}{bc, cn, pu}
+	case flusher | closeNotifier | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.CloseNotifier
+			http.Pusher
+		}{bc, fl, cn, pu}
+	case hijacker | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{bc, hj, pu}
+	case flusher | hijacker | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{bc, fl, hj, pu}
+	case closeNotifier | hijacker | pusher:
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+			http.Pusher
+		}{bc, cn, hj, pu}
+	case flusher | closeNotifier | hijacker | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.CloseNotifier
+			http.Hijacker
+			http.Pusher
+		}{bc, fl, cn, hj, pu}
+	case readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+			http.Pusher
+		}{bc, rf, pu}
+	case flusher | readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{bc, fl, rf, pu}
+	case closeNotifier | readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			io.ReaderFrom
+			http.Pusher
+		}{bc, cn, rf, pu}
+	case flusher | closeNotifier | readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.CloseNotifier
+			io.ReaderFrom
+			http.Pusher
+		}{bc, fl, cn, rf, pu}
+	case hijacker | readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{bc, hj, rf, pu}
+	case flusher | hijacker | readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{bc, fl, hj, rf, pu}
+	case closeNotifier | hijacker | readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{bc, cn, hj, rf, pu}
+	case flusher | closeNotifier | hijacker | readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{bc, fl, cn, hj, rf, pu}
+	}
+	return bc
+}
+
+// countingReaderFrom counts the bytes written by the wrapped ResponseWriter's
+// ReadFrom.
+type countingReaderFrom struct {
+	bc *byteCounter
+}
+
+// ReadFrom implements io.ReaderFrom.
+func (c countingReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	n, err := c.bc.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	c.bc.responseBytes += n
+	return n, err
+}
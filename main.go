@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
@@ -11,18 +12,24 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
-	_ "expvar"
-
 	proxyproto "github.com/armon/go-proxyproto"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/bepress/camo/admin"
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/breaker"
+	"github.com/bepress/camo/cache"
 	"github.com/bepress/camo/helpers"
+	"github.com/bepress/camo/inflight"
 	"github.com/bepress/camo/logging"
 	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/ratelimit"
 	"github.com/bepress/camo/rxid"
+	"github.com/bepress/camo/shed"
 	"github.com/reedobrien/cowl"
 	"github.com/rs/zerolog"
 )
@@ -48,15 +55,55 @@ var (
 
 func main() {
 	var (
-		addr        = flag.String("addr", ":443", "The address and port to listen on")
-		flushPeriod = flag.Duration("flushPeriod", 10*time.Second, "The maximum period to wait before flushing")
-		flushSize   = flag.Int("flushSize", 7000, "The maximum size the log buffer may reach before flushing")
-		maxsize     = flag.Int64("maxsize", 5, "Maximum size to proxy in whole MB (no decimal)")
-		secret      = flag.String("secret", "", "The 'shared secret' hmac key")
-		tlscert     = flag.String("cert", "cert.pem", "The TLS certificate to use")
-		tlskey      = flag.String("key", "key.pem", "The TLS key to use")
-		verbose     = flag.Bool("verbose", false, "If verbose logging should take place (No-op at this time as there's no debug log statements)")
-		version     = flag.Bool("version", false, "Display version and build info, then exit")
+		addr            = flag.String("addr", ":443", "The address and port to listen on")
+		adminToken      = flag.String("adminToken", "", "The bearer token for the admin API on the expvar listener, the admin API is disabled if empty")
+		blockedHashes   = flag.String("blockedHashes", "", "A file of SHA-256 sums, one per line, of bodies we refuse with a 451, reloaded on SIGHUP. Streamed bodies are checked as they end, so the first client to get a blocked one has all but its last byte")
+		blockedMessage  = flag.String("blockedMessage", proxy.DefaultBlockedMessage, "The body of our 451 response for blocked content")
+		blockedURLs     = flag.String("blockedURLs", "", "A JSON file of upstream URLs, URL prefixes and regexps we refuse with a 451, kept up to date by the admin API and reloaded on SIGHUP")
+		breakerOpenFor  = flag.Duration("breakerOpenFor", breaker.DefaultOpenFor, "How long an upstream host's circuit breaker stays open before probing")
+		breakerRate     = flag.Float64("breakerRate", breaker.DefaultErrorRate, "The upstream error rate that opens a host's circuit breaker, 0 disables circuit breakers")
+		breakerRequests = flag.Int("breakerRequests", breaker.DefaultMinRequests, "The fewest requests to a host in a window before its circuit breaker can open")
+		cacheSize       = flag.Int64("cacheSize", 0, "Maximum size of the in-memory response cache in whole MB, 0 disables caching")
+		clientHints     = flag.Bool("clientHints", false, "Serve smaller variants of resized images to clients whose Save-Data, Width and DPR hints ask for them")
+		connectTimeout  = flag.Duration("connectTimeout", proxy.DefaultConnectTimeout, "How long to wait to connect to an upstream host")
+		etags           = flag.Bool("etags", false, "Give responses without an ETag a strong one computed from the body, which means buffering them whole")
+		flushPeriod     = flag.Duration("flushPeriod", 10*time.Second, "The maximum period to wait before flushing")
+		flushSize       = flag.Int("flushSize", 7000, "The maximum size the log buffer may reach before flushing")
+		headerTimeout   = flag.Duration("headerTimeout", proxy.DefaultHeaderTimeout, "How long to wait for the first byte of an upstream response")
+		hostConcurrency = flag.Int("hostConcurrency", inflight.DefaultPerHost, "The most concurrent fetches from one upstream host, 0 disables concurrency limits")
+		hostQueue       = flag.Int("hostQueue", inflight.DefaultQueue, "The most fetches that may wait for one upstream host")
+		keepOrientation = flag.Bool("keepOrientation", true, "Keep the EXIF orientation when stripping image metadata")
+		maxDimension    = flag.Int("maxDimension", proxy.DefaultMaxDimension, "The widest or tallest image we proxy in pixels, 0 disables the limit")
+		maxInflight     = flag.Int("maxInflight", inflight.DefaultGlobal, "The most concurrent fetches from all upstream hosts")
+		maxPixels       = flag.Int64("maxPixels", proxy.DefaultMaxPixels, "The most pixels an image we proxy may have, 0 disables the limit")
+		maxQueued       = flag.Int("maxQueued", shed.DefaultMaxQueue, "The most requests that may wait for a turn before we shed load")
+		maxQueueWait    = flag.Duration("maxQueueWait", shed.DefaultMaxWait, "The longest a request may wait for a turn before it is shed")
+		maxRequests     = flag.Int("maxRequests", shed.DefaultMaxInflight, "The most requests served at once, 0 disables load shedding")
+		maxSVGSize      = flag.Int64("maxSVGSize", proxy.DefaultMaxSVGSize/1024, "Maximum size of an SVG to sanitize in whole KB (no decimal)")
+		maxsize         = flag.Int64("maxsize", 5, "Maximum size to proxy in whole MB (no decimal)")
+		minRate         = flag.Int64("minRate", 0, "The slowest an upstream body may arrive in bytes per second, 0 disables the minimum")
+		placeholderDir  = flag.String("placeholderDir", "", "A directory of images, named for the failure they stand in for (not_found, blocked, too_large, error or default), served to image requests we can't satisfy")
+		queueTarget     = flag.Duration("queueTarget", shed.DefaultTarget, "The queue latency above which we shed requests rather than queue them")
+		rateBurst       = flag.Int("rateBurst", ratelimit.DefaultIPBurst, "The most requests a client IP may make at once")
+		rateLimit       = flag.Float64("rateLimit", 0, "Requests per second allowed from a client IP, 0 disables the limit")
+		refererBurst    = flag.Int("refererBurst", ratelimit.DefaultRefererBurst, "The most requests from pages on one Referer host at once")
+		refererLimit    = flag.Float64("refererLimit", 0, "Requests per second allowed from pages on one Referer host, 0 disables the limit")
+		refuseDowngrade = flag.Bool("refuseDowngrade", false, "Refuse upstream redirects from https to http")
+		requestTimeout  = flag.Duration("requestTimeout", proxy.DefaultRequestTimeout, "How long to wait for upstream response headers, retries included")
+		retries         = flag.Int("retries", 2, "How many times to retry an upstream fetch that fails with a connection error, 502, 503 or 504, 0 disables retries")
+		sanitize        = flag.Bool("sanitize", false, "Decode and re-encode every image so we only ever serve pixels, refusing anything we can't decode")
+		sanitizeFormat  = flag.String("sanitizeFormat", "", "The format, jpeg, png or gif, sanitized images are re-encoded to, empty keeps the source format where it can")
+		sanitizeHosts   = flag.String("sanitizeHosts", "", "Comma separated upstream hosts whose images are always sanitized")
+		secret          = flag.String("secret", "", "The 'shared secret' hmac key")
+		stallTimeout    = flag.Duration("stallTimeout", proxy.DefaultStallTimeout, "How long an upstream body may send nothing before we give up on it")
+		stripMetadata   = flag.Bool("stripMetadata", false, "Strip EXIF, XMP, IPTC and comments from JPEG, PNG and WebP images")
+		tlscert         = flag.String("cert", "cert.pem", "The TLS certificate to use")
+		tlskey          = flag.String("key", "key.pem", "The TLS key to use")
+		tlsTimeout      = flag.Duration("tlsTimeout", proxy.DefaultTLSTimeout, "How long to wait for an upstream TLS handshake")
+		trustedProxies  = flag.String("trustedProxies", "", "Comma separated CIDRs of proxies whose X-Forwarded-For we believe")
+		verbose         = flag.Bool("verbose", false, "If verbose logging should take place (No-op at this time as there's no debug log statements)")
+		version         = flag.Bool("version", false, "Display version and build info, then exit")
+		writeTimeout    = flag.Duration("writeTimeout", 5*time.Minute, "The longest we spend writing a response, it must allow for large images to slow clients")
 
 		// TODO(ro) 2017-10-10 Add flags for other proxy set-ables.
 
@@ -111,22 +158,113 @@ func main() {
 
 	// Set up options.
 	// TODO(ro) 2017-10-11 Add more options here and as flags as necessary.
-	options := []func(*proxy.Proxy){}
+	options := []func(*proxy.Proxy){
+		func(p *proxy.Proxy) { p.BlockedMessage = *blockedMessage },
+		func(p *proxy.Proxy) { p.ClientHints = *clientHints },
+		func(p *proxy.Proxy) { p.ConnectTimeout = *connectTimeout },
+		func(p *proxy.Proxy) { p.HeaderTimeout = *headerTimeout },
+		func(p *proxy.Proxy) { p.KeepOrientation = *keepOrientation },
+		func(p *proxy.Proxy) { p.MaxDimension = *maxDimension },
+		func(p *proxy.Proxy) { p.MaxPixels = *maxPixels },
+		func(p *proxy.Proxy) { p.MinRate = *minRate },
+		func(p *proxy.Proxy) { p.RequestTimeout = *requestTimeout },
+		func(p *proxy.Proxy) { p.Sanitize = *sanitize },
+		func(p *proxy.Proxy) { p.SanitizeFormat = *sanitizeFormat },
+		func(p *proxy.Proxy) { p.StallTimeout = *stallTimeout },
+		func(p *proxy.Proxy) { p.StripMetadata = *stripMetadata },
+		func(p *proxy.Proxy) { p.TLSTimeout = *tlsTimeout },
+	}
 	if *maxsize > 0 {
 		options = append(options, func(p *proxy.Proxy) { p.MaxSize = *maxsize * 1024 * 1024 })
 	}
+	if *maxSVGSize > 0 {
+		options = append(options, func(p *proxy.Proxy) { p.MaxSVGSize = *maxSVGSize * 1024 })
+	}
+	if *sanitizeHosts != "" {
+		options = append(options, func(p *proxy.Proxy) { p.SanitizeHosts = strings.Split(*sanitizeHosts, ",") })
+	}
+	if *etags {
+		options = append(options, func(p *proxy.Proxy) { p.GenerateETags = true })
+	}
+	if *retries > 0 {
+		options = append(options, func(p *proxy.Proxy) { p.Retry.Attempts = *retries + 1 })
+	}
+	if *refuseDowngrade {
+		options = append(options, func(p *proxy.Proxy) { p.RefuseDowngrade = true })
+	}
+	if *cacheSize > 0 {
+		options = append(options, func(p *proxy.Proxy) { p.Cache = cache.MustNewMemory(*cacheSize * 1024 * 1024) })
+	}
+	if *breakerRate > 0 {
+		breakers := breaker.MustNew(
+			func(s *breaker.Set) { s.ErrorRate = *breakerRate },
+			func(s *breaker.Set) { s.MinRequests = *breakerRequests },
+			func(s *breaker.Set) { s.OpenFor = *breakerOpenFor },
+		)
+		expvar.Publish("breakers", expvar.Func(func() interface{} { return breakers.States() }))
+		options = append(options, func(p *proxy.Proxy) { p.Breakers = breakers })
+	}
+	if *hostConcurrency > 0 {
+		limiter := inflight.MustNew(
+			func(l *inflight.Limiter) { l.PerHost = *hostConcurrency },
+			func(l *inflight.Limiter) { l.Queue = *hostQueue },
+			func(l *inflight.Limiter) { l.Global = *maxInflight },
+		)
+		options = append(options, func(p *proxy.Proxy) { p.Inflight = limiter })
+	}
+	if *placeholderDir != "" {
+		placeholders, err := proxy.LoadPlaceholders(*placeholderDir)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load placeholders")
+		}
+		options = append(options, func(p *proxy.Proxy) { p.Placeholders = placeholders })
+	}
+	if *blockedHashes != "" {
+		hashes, err := blocklist.LoadHashes(*blockedHashes)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load blocked hashes")
+		}
+		reloadOnHangup(logger, "blocked_hashes", hashes.Reload)
+		options = append(options, func(p *proxy.Proxy) { p.BlockedHashes = hashes })
+	}
+	if *blockedURLs != "" {
+		takedowns, err := blocklist.LoadURLs(*blockedURLs)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load blocked URLs")
+		}
+		reloadOnHangup(logger, "blocked_urls", takedowns.Reload)
+		options = append(options, func(p *proxy.Proxy) { p.BlockedURLs = takedowns })
+	}
 
 	// Create proxy handler.
 	hmac = helpers.GetHMAC(*secret)
 	p := proxy.MustNew([]byte(hmac), logger, options...)
+	// Rate limit clients before they get to the proxy.
+	rlOpts := []func(*ratelimit.Limiter){
+		func(l *ratelimit.Limiter) { l.IPRate, l.IPBurst = *rateLimit, *rateBurst },
+		func(l *ratelimit.Limiter) { l.RefererRate, l.RefererBurst = *refererLimit, *refererBurst },
+	}
+	if *trustedProxies != "" {
+		rlOpts = append(rlOpts, func(l *ratelimit.Limiter) { l.TrustedProxies = strings.Split(*trustedProxies, ",") })
+	}
+	var limited http.Handler = ratelimit.MustNew(p, logger, rlOpts...)
+	// Shed load when overloaded before doing any other work.
+	if *maxRequests > 0 {
+		limited = shed.MustNew(limited,
+			func(s *shed.Shedder) { s.MaxInflight = *maxRequests },
+			func(s *shed.Shedder) { s.MaxQueue = *maxQueued },
+			func(s *shed.Shedder) { s.MaxWait = *maxQueueWait },
+			func(s *shed.Shedder) { s.Target = *queueTarget },
+		)
+	}
 	// Wrap proxy handler with logger.
-	proxyHandler := logging.NewAccessLogger(p, logger)
+	proxyHandler := logging.NewAccessLogger(limited, logger)
 	handler := rxid.Handler(proxyHandler)
 	s := http.Server{
 		Addr:         *addr,
 		Handler:      handler,
 		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: *writeTimeout,
 		IdleTimeout:  120 * time.Second,
 	}
 
@@ -149,7 +287,12 @@ func main() {
 			logger.Fatal().Err(err).Msg("failed to start server")
 		}
 	}()
-	// Start a server on localhost:9000 for expvar.
+	// Mount the admin API next to expvar if we have a token for it.
+	if token := helpers.GetAdminToken(*adminToken); token != "" {
+		http.Handle("/admin/", rxid.Handler(admin.MustNew(p, token, logger.With().Str("component", "admin").Logger())))
+	}
+
+	// Start a server on localhost:9000 for expvar and the admin API.
 	go func() {
 		if err := http.ListenAndServe("127.0.0.1:9000", nil); err != nil {
 			logger.Fatal().Err(err).Msg("failed to start expvar server")
@@ -168,6 +311,23 @@ func main() {
 	}
 }
 
+// reloadOnHangup calls reload, which reloads the list called name, each time
+// we get SIGHUP.
+func reloadOnHangup(logger zerolog.Logger, name string, reload func() (int, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			n, err := reload()
+			if err != nil {
+				logger.Error().Err(err).Str("list", name).Msg("failed to reload")
+				continue
+			}
+			logger.Info().Str("list", name).Int("count", n).Msg("reloaded")
+		}
+	}()
+}
+
 func versionInfo() {
 	fmt.Printf(`
 build date: %s
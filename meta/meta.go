@@ -0,0 +1,233 @@
+// Package meta describes images: their type, size, dimensions, how many
+// frames they have, their dominant colour and a tiny placeholder to show while
+// they load.
+package meta
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+
+	"github.com/bepress/camo/imageutil"
+	"golang.org/x/image/draw"
+
+	// Register the formats we describe.
+	_ "image/gif"
+	_ "image/jpeg"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// MaxPixels is the most pixels an image may have for us to decode it
+	// for its colour and placeholder.
+	MaxPixels = 50 * 1000 * 1000
+
+	// lqipSize is the width or height, whichever is larger, of the
+	// placeholder.
+	lqipSize = 16
+)
+
+// ErrUnsupported is returned for images we can't decode.
+var ErrUnsupported = errors.New("unsupported image format")
+
+// Info describes an image.
+type Info struct {
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Frames      int    `json:"frames"`
+
+	// Color is the dominant colour as #rrggbb. LQIP is a data URL of a
+	// PNG no more than lqipSize pixels across. Both are left out if the
+	// image has more than MaxPixels or its header is fine but its pixels
+	// can't be decoded.
+	Color string `json:"dominant_color,omitempty"`
+	LQIP  string `json:"lqip,omitempty"`
+}
+
+// Of describes the image in b.
+func Of(b []byte) (Info, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return Info{}, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	info := Info{
+		ContentType: "image/" + format,
+		Size:        int64(len(b)),
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		Frames:      frames(format, b),
+	}
+
+	if cfg.Width == 0 || cfg.Height == 0 || int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return info, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return info, nil
+	}
+	small := thumbnail(img)
+	info.Color = dominant(small)
+	var buf bytes.Buffer
+	if png.Encode(&buf, small) == nil {
+		info.LQIP = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	return info, nil
+}
+
+// frames counts the frames of an animated image without decoding them.
+// Anything that isn't animated has one.
+func frames(format string, b []byte) int {
+	var n int
+	switch format {
+	case "gif":
+		n = gifFrames(b)
+	case "png":
+		n = apngFrames(b)
+	case "webp":
+		n = webpFrames(b)
+	}
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// gifFrames counts the image descriptors in a GIF.
+func gifFrames(b []byte) int {
+	if len(b) < 13 {
+		return 0
+	}
+	i := 13
+	if b[10]&0x80 != 0 {
+		i += 3 << (b[10]&0x07 + 1) // global colour table
+	}
+	n := 0
+	for i < len(b) {
+		switch b[i] {
+		case 0x21: // extension, its label then data sub-blocks
+			i = skipSubBlocks(b, i+2)
+		case 0x2c: // image descriptor
+			n++
+			if i+10 > len(b) {
+				return n
+			}
+			flags := b[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1) // local colour table
+			}
+			i = skipSubBlocks(b, i+1) // after the LZW code size
+		default: // the trailer, or something we don't follow
+			return n
+		}
+	}
+	return n
+}
+
+// skipSubBlocks returns the offset after the GIF data sub-blocks at i.
+func skipSubBlocks(b []byte, i int) int {
+	for i < len(b) {
+		n := int(b[i])
+		i++
+		if n == 0 {
+			break
+		}
+		i += n
+	}
+	return i
+}
+
+// apngFrames returns the frame count from an APNG's acTL chunk, which comes
+// before the image data, or 0 if there isn't one.
+func apngFrames(b []byte) int {
+	for i := 8; i+8 <= len(b); {
+		n := int(binary.BigEndian.Uint32(b[i:]))
+		typ := string(b[i+4 : i+8])
+		switch {
+		case typ == "acTL" && i+12 <= len(b):
+			return int(binary.BigEndian.Uint32(b[i+8:]))
+		case typ == "IDAT", n < 0:
+			return 0
+		}
+		i += 12 + n
+	}
+	return 0
+}
+
+// webpFrames counts the ANMF chunks of an animated WebP.
+func webpFrames(b []byte) int {
+	animated, n := false, 0
+	for i := 12; i+8 <= len(b); {
+		size := int(binary.LittleEndian.Uint32(b[i+4:]))
+		switch string(b[i : i+4]) {
+		case "VP8X":
+			animated = i+8 < len(b) && b[i+8]&imageutil.VP8XAnimation != 0
+		case "ANMF":
+			n++
+		}
+		if size < 0 {
+			break
+		}
+		i += 8 + size + size%2
+	}
+	if !animated {
+		return 0
+	}
+	return n
+}
+
+// thumbnail scales img to fit in lqipSize pixels square.
+func thumbnail(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	w, h := lqipSize, lqipSize
+	if b.Dx() > b.Dy() {
+		h = imageutil.AtLeastOne(lqipSize * b.Dy() / b.Dx())
+	} else {
+		w = imageutil.AtLeastOne(lqipSize * b.Dx() / b.Dy())
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// dominant returns the most common colour in img, ignoring transparent
+// pixels. Colours are bucketed so near enough counts as the same, and the
+// average of the winning bucket is what we return.
+func dominant(img *image.RGBA) string {
+	type sum struct{ r, g, b, n int }
+	var (
+		buckets = map[int]*sum{}
+		best    *sum
+	)
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b, a := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2]), int(img.Pix[i+3])
+		if a < 128 {
+			continue
+		}
+		// Pix is alpha premultiplied.
+		r, g, b = r*255/a, g*255/a, b*255/a
+		key := r>>4<<8 | g>>4<<4 | b>>4
+		s := buckets[key]
+		if s == nil {
+			s = &sum{}
+			buckets[key] = s
+		}
+		s.r, s.g, s.b, s.n = s.r+r, s.g+g, s.b+b, s.n+1
+		if best == nil || s.n > best.n {
+			best = s
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.n, best.g/best.n, best.b/best.n)
+}
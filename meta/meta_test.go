@@ -0,0 +1,92 @@
+package meta_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/meta"
+)
+
+func TestOf(t *testing.T) {
+	// Mostly red with a blue stripe.
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		c := color.RGBA{R: 255, A: 255}
+		if x >= 30 {
+			c = color.RGBA{B: 255, A: 255}
+		}
+		for y := 0; y < 20; y++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	var pngBuf, jpegBuf, gifBuf bytes.Buffer
+	checkers.OK(t, png.Encode(&pngBuf, img))
+	checkers.OK(t, jpeg.Encode(&jpegBuf, img, nil))
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 20), palette.Plan9)
+		frame.Set(0, 0, color.White)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	checkers.OK(t, gif.EncodeAll(&gifBuf, anim))
+
+	table := []struct {
+		desc       string
+		body       []byte
+		wantType   string
+		wantFrames int
+		wantColor  string
+	}{
+		{"png", pngBuf.Bytes(), "image/png", 1, "#ff0000"},
+		{"jpeg", jpegBuf.Bytes(), "image/jpeg", 1, ""},
+		{"animated gif", gifBuf.Bytes(), "image/gif", 3, "#000000"},
+	}
+
+	for _, test := range table {
+		info, err := meta.Of(test.body)
+		checkers.OK(t, err)
+		checkers.Equals(t, info.ContentType, test.wantType)
+		checkers.Equals(t, info.Size, int64(len(test.body)))
+		checkers.Assert(t, info.Width == 40 && info.Height == 20, "%s: got %dx%d", test.desc, info.Width, info.Height)
+		checkers.Equals(t, info.Frames, test.wantFrames)
+		if test.wantColor != "" {
+			checkers.Equals(t, info.Color, test.wantColor)
+		}
+		checkers.Assert(t, info.Color != "", "%s: no colour", test.desc)
+		checkers.Assert(t, strings.HasPrefix(info.LQIP, "data:image/png;base64,"), "%s: got LQIP %q", test.desc, info.LQIP)
+
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(info.LQIP, "data:image/png;base64,"))
+		checkers.OK(t, err)
+		lqip, err := png.DecodeConfig(bytes.NewReader(data))
+		checkers.OK(t, err)
+		checkers.Assert(t, lqip.Width == 16 && lqip.Height == 8, "%s: got LQIP %dx%d", test.desc, lqip.Width, lqip.Height)
+	}
+}
+
+func TestOfUnsupported(t *testing.T) {
+	_, err := meta.Of([]byte("<html></html>"))
+	checkers.Assert(t, errors.Is(err, meta.ErrUnsupported), "got %v", err)
+}
+
+func TestOfTooManyPixels(t *testing.T) {
+	// Just the header of a GIF with a 10000 by 10000 logical screen.
+	b := []byte("GIF89a\x10\x27\x10\x27\x00\x00\x00")
+
+	info, err := meta.Of(b)
+	checkers.OK(t, err)
+	checkers.Assert(t, info.Width == 10000 && info.Height == 10000, "got %dx%d", info.Width, info.Height)
+	checkers.Equals(t, info.Color, "")
+	checkers.Equals(t, info.LQIP, "")
+}
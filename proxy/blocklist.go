@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/cache"
+)
+
+// DefaultBlockedMessage is the body of our answer for blocked content.
+const DefaultBlockedMessage = "Unavailable for legal reasons"
+
+var (
+	// ErrBlocked is returned for upstream bodies on BlockedHashes.
+	ErrBlocked = errors.New("content is blocked")
+
+	// ErrTakenDown is returned for upstream URLs, redirects included, on
+	// BlockedURLs.
+	ErrTakenDown = errors.New("URL is taken down")
+)
+
+// takenDown tells us if u is on BlockedURLs.
+func (p *Proxy) takenDown(u *url.URL) bool {
+	return p.BlockedURLs != nil && p.BlockedURLs.Match(u.String())
+}
+
+// blockedKey is the cache key noting that the body at u is blocked.
+func blockedKey(u *url.URL) string {
+	return "blocked|" + u.String()
+}
+
+// blocked tells us, without fetching anything, if what we'd serve for u is on
+// BlockedHashes: either e, the entry we have for it, was made from a blocked
+// body or we've lately seen one at u.
+func (p *Proxy) blocked(u *url.URL, e *cache.Entry) bool {
+	if p.BlockedHashes == nil {
+		return false
+	}
+	if e != nil && p.BlockedHashes.Contains(e.Sum) {
+		return true
+	}
+	if p.Cache == nil {
+		return false
+	}
+	b, ok := p.Cache.Get(blockedKey(u))
+	return ok && b.Fresh(time.Now()) && p.BlockedHashes.Contains(b.Sum)
+}
+
+// checkBody finishes hashing the upstream body at u and returns the sum to
+// keep with what we make of it. If the body is on BlockedHashes it answers the
+// client and returns false. A nil sums means we aren't checking.
+func (p *Proxy) checkBody(w http.ResponseWriter, r *http.Request, u *url.URL, sums *bodySums, resp *http.Response) (blocklist.Sum, bool) {
+	if sums == nil {
+		return blocklist.Sum{}, true
+	}
+	sum, blocked, err := p.blockedBody(u, sums)
+	switch {
+	case err != nil:
+		p.fail(w, r, Classify(err), err, "Error Fetching Resource: "+err.Error(), resp)
+		return blocklist.Sum{}, false
+	case blocked:
+		p.fail(w, r, ClassBlocked, ErrBlocked, p.BlockedMessage, resp)
+		return blocklist.Sum{}, false
+	}
+	return sum, true
+}
+
+// blockedBody finishes hashing the upstream body at u and tells us if it's on
+// BlockedHashes, noting it if so. It returns the sum to keep with what we make
+// of the body.
+func (p *Proxy) blockedBody(u *url.URL, sums *bodySums) (blocklist.Sum, bool, error) {
+	all, err := sums.finish(p.MaxSize)
+	if err != nil {
+		return blocklist.Sum{}, false, err
+	}
+	for _, sum := range all {
+		if p.BlockedHashes.Contains(sum) {
+			p.markBlocked(u, sum)
+			return sum, true, nil
+		}
+	}
+	return all[0], false, nil
+}
+
+// markBlocked notes in the cache that the body at u is blocked, so for
+// CacheTTL we can refuse it without fetching it again. The note is kept with
+// the URL's entries so purging the URL removes it too.
+func (p *Proxy) markBlocked(u *url.URL, sum blocklist.Sum) {
+	if p.Cache == nil {
+		return
+	}
+	now := time.Now()
+	p.Cache.Set(blockedKey(u), &cache.Entry{
+		URL:        u.String(),
+		StatusCode: http.StatusUnavailableForLegalReasons,
+		Stored:     now,
+		Expires:    now.Add(p.CacheTTL),
+		Sum:        sum,
+	})
+}
+
+// bodySums hashes an upstream body as it's read, ahead of anything we do to
+// it, so BlockedHashes is checked against what upstream has and not what we
+// make of it. A body with a Content-Encoding is hashed both as it came and
+// decoded, as a sum may be of either.
+type bodySums struct {
+	wire    *hashingBody
+	decoded *hashingBody
+}
+
+// hashBody starts hashing resp's body for BlockedHashes. It returns nil if
+// there is no list to check.
+func (p *Proxy) hashBody(resp *http.Response) *bodySums {
+	if p.BlockedHashes == nil {
+		return nil
+	}
+	s := &bodySums{wire: &hashingBody{ReadCloser: resp.Body, h: sha256.New()}}
+	resp.Body = s.wire
+	return s
+}
+
+// decompressed hashes resp's body again if decompress decoded it.
+func (s *bodySums) decompressed(resp *http.Response) {
+	if s == nil || resp.Body == io.ReadCloser(s.wire) {
+		return
+	}
+	s.decoded = &hashingBody{ReadCloser: resp.Body, h: sha256.New()}
+	resp.Body = s.decoded
+}
+
+// finish reads what's left of the body, no more than max bytes, and returns
+// its sums, decoded first.
+func (s *bodySums) finish(max int64) ([]blocklist.Sum, error) {
+	var all []blocklist.Sum
+	for _, hb := range []*hashingBody{s.decoded, s.wire} {
+		if hb == nil {
+			continue
+		}
+		if _, err := io.Copy(ioutil.Discard, io.LimitReader(hb, max)); err != nil {
+			return nil, err
+		}
+		var sum blocklist.Sum
+		hb.h.Sum(sum[:0])
+		all = append(all, sum)
+	}
+	return all, nil
+}
+
+// hashingBody hashes what is read through it.
+type hashingBody struct {
+	io.ReadCloser
+	h hash.Hash
+}
+
+// Read implements io.Reader.
+func (hb *hashingBody) Read(b []byte) (int, error) {
+	n, err := hb.ReadCloser.Read(b)
+	hb.h.Write(b[:n])
+	return n, err
+}
+
+// checkedBody holds back the last byte of a streamed body until check has
+// passed the whole of it, so a body on BlockedHashes never reaches the client
+// whole. A blocked body ends in ErrBlocked, which aborts the response.
+type checkedBody struct {
+	io.ReadCloser
+	check func() error
+
+	last byte
+	held bool
+	err  error
+}
+
+// Read implements io.Reader.
+func (cb *checkedBody) Read(b []byte) (int, error) {
+	if cb.err != nil {
+		if cb.held && len(b) > 0 {
+			cb.held = false
+			b[0] = cb.last
+			return 1, nil
+		}
+		return 0, cb.err
+	}
+
+	var off int
+	if cb.held && len(b) > 0 {
+		b[0] = cb.last
+		off = 1
+	}
+	n, err := cb.ReadCloser.Read(b[off:])
+	n += off
+	if cb.held = n > 0; cb.held {
+		n--
+		cb.last = b[n]
+	}
+
+	switch {
+	case err == io.EOF:
+		if cb.err = cb.check(); cb.err != nil {
+			cb.held = false
+			return n, cb.err
+		}
+		// The held byte goes out on the next read.
+		cb.err = io.EOF
+		return n, nil
+	case err != nil:
+		// The body is no good anyway.
+		cb.err = err
+		if cb.held {
+			cb.held = false
+			n++
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,272 @@
+package proxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+func TestBlockedHashes(t *testing.T) {
+	// Big enough that streamed responses are well under way when they end.
+	var (
+		bad  = strings.Repeat("known bad image ", 10000)
+		good = strings.Repeat("perfectly good image ", 10000)
+	)
+	const msg = "Removed at the request of the rights holder"
+	var fetches int32
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		body := bad
+		switch r.URL.Path {
+		case "/etag.png":
+			w.Header().Set("ETag", `"upstream"`)
+		case "/good.png":
+			w.Header().Set("ETag", `"upstream"`)
+			body = good
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(body))
+	}))
+	defer tsBE.Close()
+
+	dir, err := ioutil.TempDir("", "blocklist")
+	checkers.OK(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hashes")
+	sum := sha256.Sum256([]byte(bad))
+	checkers.OK(t, ioutil.WriteFile(path, []byte(fmt.Sprintf("%x\n", sum[:])), 0644))
+	list, err := blocklist.LoadHashes(path)
+	checkers.OK(t, err)
+
+	goodSum := sha256.Sum256([]byte(good))
+	table := []struct {
+		desc      string
+		payload   string
+		block     string // a sum to add first
+		wantCode  int
+		wantFetch bool
+	}{
+		{"streamed", tsBE.URL + "/etag.png", "", 0, true},
+		{"streamed again", tsBE.URL + "/etag.png", "", http.StatusUnavailableForLegalReasons, false},
+		{"buffered", tsBE.URL + "/plain.png", "", http.StatusUnavailableForLegalReasons, true},
+		{"transformed", "w=10|" + tsBE.URL + "/other.png", "", http.StatusUnavailableForLegalReasons, true},
+		{"static", "static=1|" + tsBE.URL + "/static.png", "", http.StatusUnavailableForLegalReasons, true},
+		{"good", tsBE.URL + "/good.png", "", http.StatusOK, true},
+		{"good cached", tsBE.URL + "/good.png", "", http.StatusOK, false},
+		{"cached then blocked", tsBE.URL + "/good.png", fmt.Sprintf("%x", goodSum[:]), http.StatusUnavailableForLegalReasons, false},
+	}
+
+	c := cache.MustNewMemory(1024 * 1024)
+	for _, test := range table {
+		if test.block != "" {
+			_, err := list.Add([]string{test.block})
+			checkers.OK(t, err)
+		}
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.BlockedHashes = list },
+			func(p *proxy.Proxy) { p.BlockedMessage = msg },
+			func(p *proxy.Proxy) { p.Cache = c },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: test.payload} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.GenerateETags = true },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		before := atomic.LoadInt32(&fetches)
+		resp, err := ts.Client().Get(ts.URL + "/sig/url")
+		if test.wantCode == 0 {
+			// The response was under way before we knew, so it is cut
+			// short wherever it got to.
+			var body []byte
+			if err == nil {
+				body, err = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			checkers.Assert(t, err != nil, "%s: body read in full: %q", test.desc, body)
+			checkers.Assert(t, string(body) != bad, "%s: got the whole body", test.desc)
+			ts.Close()
+			continue
+		}
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		checkers.Equals(t, atomic.LoadInt32(&fetches) != before, test.wantFetch)
+
+		switch test.wantCode {
+		case http.StatusUnavailableForLegalReasons:
+			checkers.OK(t, err)
+			checkers.Assert(t, resp.StatusCode == test.wantCode, "%s: got %d want %d", test.desc, resp.StatusCode, test.wantCode)
+			checkers.Equals(t, string(body), msg+"\n")
+		default:
+			checkers.OK(t, err)
+			checkers.Assert(t, resp.StatusCode == test.wantCode, "%s: got %d want %d", test.desc, resp.StatusCode, test.wantCode)
+			checkers.Assert(t, string(body) == good, "%s: got %d bytes want %d", test.desc, len(body), len(good))
+		}
+
+		ts.Close()
+	}
+}
+
+func TestBlockedUpstreamBytes(t *testing.T) {
+	// What upstream has is checked, not what we make of it.
+	photo := commentedJPEG(t, "removed by StripMetadata")
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(photo)
+	zw.Close()
+
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		if r.URL.Path == "/gzipped.jpg" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped.Bytes())
+			return
+		}
+		w.Write(photo)
+	}))
+	defer tsBE.Close()
+
+	dir, err := ioutil.TempDir("", "blocklist")
+	checkers.OK(t, err)
+	defer os.RemoveAll(dir)
+
+	table := []struct {
+		desc    string
+		path    string
+		payload string
+		block   []byte
+		etags   bool
+	}{
+		{"stripped", "/photo.jpg", "", photo, false},
+		{"stripped buffered", "/photo.jpg", "", photo, true},
+		{"stripped and transformed", "/photo.jpg", "w=5|", photo, false},
+		{"gzipped", "/gzipped.jpg", "", gzipped.Bytes(), true},
+		{"gzipped, decoded sum", "/gzipped.jpg", "", photo, true},
+	}
+
+	for i, test := range table {
+		path := filepath.Join(dir, strconv.Itoa(i))
+		sum := sha256.Sum256(test.block)
+		checkers.OK(t, ioutil.WriteFile(path, []byte(fmt.Sprintf("%x\n", sum[:])), 0644))
+		list, err := blocklist.LoadHashes(path)
+		checkers.OK(t, err)
+
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.BlockedHashes = list },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: test.payload + tsBE.URL + test.path} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.GenerateETags = test.etags },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.StripMetadata = true },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		code, body, err := getAll(ts)
+		ts.Close()
+		if !test.etags && test.payload == "" {
+			// Streamed, so cut short once we know.
+			checkers.Assert(t, err != nil, "%s: response was not aborted", test.desc)
+			checkers.Assert(t, !bytes.Equal(body, photo), "%s: got the whole body", test.desc)
+			continue
+		}
+		checkers.OK(t, err)
+		checkers.Assert(t, code == http.StatusUnavailableForLegalReasons, "%s: got %d", test.desc, code)
+	}
+}
+
+func TestBlockedURLs(t *testing.T) {
+	var fetches int32
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/taken.png", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("image"))
+	}))
+	defer tsBE.Close()
+
+	dir, err := ioutil.TempDir("", "blocklist")
+	checkers.OK(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "takedowns.json")
+	checkers.OK(t, ioutil.WriteFile(path, nil, 0644))
+	list, err := blocklist.LoadURLs(path)
+	checkers.OK(t, err)
+	_, err = list.Add(blocklist.Takedowns{
+		URLs:     []string{tsBE.URL + "/taken.png"},
+		Prefixes: []string{tsBE.URL + "/private/"},
+		Regexps:  []string{`\.gif$`},
+	})
+	checkers.OK(t, err)
+
+	table := []struct {
+		desc      string
+		path      string
+		payload   string
+		wantCode  int
+		wantFetch bool
+	}{
+		{"exact", "/sig/url", tsBE.URL + "/taken.png", http.StatusUnavailableForLegalReasons, false},
+		{"exact transformed", "/sig/url", "w=10|" + tsBE.URL + "/taken.png", http.StatusUnavailableForLegalReasons, false},
+		{"exact meta", "/meta/sig/url", tsBE.URL + "/taken.png", http.StatusUnavailableForLegalReasons, false},
+		{"prefix", "/sig/url", tsBE.URL + "/private/a.png", http.StatusUnavailableForLegalReasons, false},
+		{"regexp", "/sig/url", tsBE.URL + "/a.gif", http.StatusUnavailableForLegalReasons, false},
+		{"redirect", "/sig/url", tsBE.URL + "/redirect", http.StatusUnavailableForLegalReasons, true},
+		{"fine", "/sig/url", tsBE.URL + "/taken.png?v=2", http.StatusOK, true},
+	}
+
+	for _, test := range table {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.BlockedURLs = list },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: test.payload} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		before := atomic.LoadInt32(&fetches)
+		resp, err := ts.Client().Get(ts.URL + test.path)
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+
+		checkers.Assert(t, resp.StatusCode == test.wantCode, "%s: got %d want %d", test.desc, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, atomic.LoadInt32(&fetches) != before, test.wantFetch)
+		if test.wantCode == http.StatusUnavailableForLegalReasons {
+			checkers.Equals(t, string(body), proxy.DefaultBlockedMessage+"\n")
+			checkers.Equals(t, resp.Header.Get("X-Camo-Error"), proxy.ReasonBlocked)
+		}
+
+		ts.Close()
+	}
+}
@@ -0,0 +1,16 @@
+package proxy
+
+import "net/http"
+
+// tripsBreaker reports whether the outcome of a fetch counts against the
+// upstream host. Failures that are ours or the client's don't.
+func tripsBreaker(resp *http.Response, err error) bool {
+	if err != nil {
+		switch Classify(err) {
+		case ClassDNS, ClassConnRefused, ClassConnection, ClassTLS, ClassTimeout, ClassUnknown:
+			return true
+		}
+		return false
+	}
+	return resp.StatusCode >= 500
+}
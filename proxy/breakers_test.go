@@ -0,0 +1,143 @@
+package proxy_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/breaker"
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/inflight"
+	"github.com/bepress/camo/proxy"
+	"github.com/rs/zerolog"
+)
+
+func TestBreakerFailsFast(t *testing.T) {
+	var (
+		hits int32
+		down int32 = 1
+	)
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("image"))
+	}))
+	defer tsBE.Close()
+
+	set := breaker.MustNew(
+		func(s *breaker.Set) { s.MinRequests = 2 },
+		func(s *breaker.Set) { s.OpenFor = 50 * time.Millisecond },
+	)
+	ts := newTestServer(tsBE.URL+"/image.png", zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.Breakers = set },
+	)
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		resp := get(t, ts, nil)
+		resp.Body.Close()
+		checkers.Equals(t, resp.StatusCode, http.StatusBadGateway)
+	}
+
+	before := upstreamErrorCount(proxy.ClassCircuitOpen)
+	resp := get(t, ts, nil)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusServiceUnavailable)
+	checkers.Equals(t, atomic.LoadInt32(&hits), int32(2))
+	checkers.Equals(t, upstreamErrorCount(proxy.ClassCircuitOpen), before+1)
+
+	// Once it has been open long enough a probe gets through and closes it.
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	resp = get(t, ts, nil)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusOK)
+	checkers.Equals(t, atomic.LoadInt32(&hits), int32(3))
+
+	var host string
+	for h := range set.States() {
+		host = h
+	}
+	checkers.Equals(t, set.States()[host].State, breaker.Closed)
+}
+
+func TestBreakerBeforeInflight(t *testing.T) {
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer tsBE.Close()
+
+	set := breaker.MustNew(func(s *breaker.Set) { s.MinRequests = 1 })
+	limiter := inflight.MustNew(
+		func(l *inflight.Limiter) { l.PerHost = 1 },
+		func(l *inflight.Limiter) { l.MaxWait = time.Second },
+	)
+	ts := newTestServer(tsBE.URL+"/image.png", zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.Breakers = set },
+		func(p *proxy.Proxy) { p.Inflight = limiter },
+	)
+	defer ts.Close()
+
+	resp := get(t, ts, nil)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusBadGateway)
+
+	// With the host's slot taken, an open breaker still answers at once.
+	release, err := limiter.Acquire(context.Background(), tsBE.Listener.Addr().String())
+	checkers.OK(t, err)
+	defer release()
+	before := upstreamErrorCount(proxy.ClassCircuitOpen)
+	start := time.Now()
+	resp = get(t, ts, nil)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusServiceUnavailable)
+	checkers.Equals(t, upstreamErrorCount(proxy.ClassCircuitOpen), before+1)
+	checkers.Assert(t, time.Since(start) < 500*time.Millisecond, "took %s, queued for a slot", time.Since(start))
+}
+
+func TestBreakerServesStale(t *testing.T) {
+	var down int32
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("image"))
+	}))
+	defer tsBE.Close()
+
+	set := breaker.MustNew(func(s *breaker.Set) { s.MinRequests = 1 })
+	ts := newTestServer(tsBE.URL+"/image.png", zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.Breakers = set },
+		func(p *proxy.Proxy) { p.Cache = cache.MustNewMemory(1024 * 1024) },
+	)
+	defer ts.Close()
+
+	resp := get(t, ts, nil)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusOK)
+
+	// The failed revalidation opens the breaker.
+	atomic.StoreInt32(&down, 1)
+	resp = get(t, ts, nil)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusBadGateway)
+
+	resp = get(t, ts, nil)
+	body, err := ioutil.ReadAll(resp.Body)
+	checkers.OK(t, err)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusOK)
+	checkers.Equals(t, resp.Header.Get("X-Cache"), "STALE")
+	checkers.Equals(t, string(body), "image")
+}
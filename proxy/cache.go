@@ -0,0 +1,440 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/svg"
+	"github.com/bepress/camo/transform"
+)
+
+// DefaultCacheTTL is how long we keep responses that don't say otherwise.
+const DefaultCacheTTL = 24 * time.Hour
+
+// ErrNoCache is returned by cache operations when the proxy has no cache.
+var ErrNoCache = errors.New("caching is not enabled")
+
+// cacheKey returns the key the response for u, transformed by opts, is stored
+// under.
+func (p *Proxy) cacheKey(u *url.URL, opts transform.Options) string {
+	if opts.IsZero() {
+		return u.String()
+	}
+	return opts.String() + "|" + u.String()
+}
+
+// lookup returns the cache entry for u transformed by opts, as a request with
+// headers h gets it, if there is one, and whether it is fresh.
+func (p *Proxy) lookup(u *url.URL, opts transform.Options, h http.Header) (*cache.Entry, bool) {
+	if p.Cache == nil {
+		return nil, false
+	}
+	key := p.cacheKey(u, opts)
+	e, ok := p.Cache.Get(key)
+	if ok && e.Vary != nil {
+		e, ok = p.Cache.Get(variantKey(key, e.Vary, h))
+	}
+	if !ok {
+		return nil, false
+	}
+	return e, e.Fresh(time.Now())
+}
+
+// entryKey returns the key a request with headers h finds the response for
+// key under: key itself, or its variant's if the entry there is a marker, see
+// cache.Entry.Vary.
+func (p *Proxy) entryKey(key string, h http.Header) string {
+	if m, ok := p.Cache.Get(key); ok && m.Vary != nil {
+		return variantKey(key, m.Vary, h)
+	}
+	return key
+}
+
+// variantKey returns the key a response stored under key that varies on the
+// request headers names is kept under for a request with headers h.
+func variantKey(key string, names []string, h http.Header) string {
+	v := make(url.Values, len(names))
+	for _, name := range names {
+		v[name] = h[name]
+	}
+	return key + "#" + v.Encode()
+}
+
+// varies returns the request headers a response with headers h varies on and
+// false if it may vary on anything. Accept-Encoding is left out, as bodies
+// are decoded before they're stored, see decompress.
+func varies(h http.Header) ([]string, bool) {
+	var names []string
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			switch name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name {
+			case "", "Accept-Encoding":
+			case "*":
+				return nil, false
+			default:
+				names = append(names, name)
+			}
+		}
+	}
+	return names, true
+}
+
+// serveEntry writes a stored or buffered response to the client.
+// http.ServeContent takes care of HEAD, Range, If-Range and conditional
+// requests against the entry's validators. SVGs are served with svgCSP.
+func (p *Proxy) serveEntry(w http.ResponseWriter, r *http.Request, e *cache.Entry) {
+	copyHeader(w.Header(), e.Header)
+	w.Header().Del("Content-Length")
+	if isSVG(e.Header) {
+		w.Header().Set("Content-Security-Policy", svgCSP)
+	}
+
+	modtime, _ := http.ParseTime(e.Header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(e.Body))
+}
+
+// newEntry builds a cache entry from an upstream response and its body. If
+// generateETag is set the entry is given a strong ETag computed from the
+// body. Callers set the entry's Sum, see checkBody.
+func (p *Proxy) newEntry(u *url.URL, resp *http.Response, body []byte, generateETag bool) *cache.Entry {
+	h := cloneHeader(resp.Header)
+	removeHopHeaders(h)
+	if generateETag {
+		h.Set("ETag", strongETag(body))
+	}
+	return &cache.Entry{
+		URL:           u.String(),
+		StatusCode:    resp.StatusCode,
+		Header:        h,
+		Body:          body,
+		GeneratedETag: generateETag,
+	}
+}
+
+// store saves an entry for a request with headers h in the cache under key if
+// it may be cached, and reports whether it did. Entries that are already stale
+// are only kept if upstream gave us validators to revalidate them with. An
+// entry that varies on request headers is kept as a variant, with a marker
+// under key saying which headers, see cache.Entry.Vary.
+func (p *Proxy) store(key string, h http.Header, e *cache.Entry) bool {
+	if p.Cache == nil || e.StatusCode != http.StatusOK {
+		return false
+	}
+	now := time.Now()
+	expires, ok := p.expires(e.Header, now)
+	if !ok {
+		return false
+	}
+	if !expires.After(now) && !hasValidators(e) {
+		return false
+	}
+	names, ok := varies(e.Header)
+	if !ok {
+		return false
+	}
+
+	e.Stored = now
+	e.Expires = expires
+	if len(names) > 0 {
+		p.Cache.Set(key, &cache.Entry{URL: e.URL, Stored: now, Expires: expires, Vary: names})
+		key = variantKey(key, names, h)
+	}
+	p.Cache.Set(key, e)
+	return true
+}
+
+// expires works out when a response stops being fresh from its Cache-Control
+// and Expires headers. It returns false if the response must not be cached.
+func (p *Proxy) expires(h http.Header, now time.Time) (time.Time, bool) {
+	if h.Get("Set-Cookie") != "" {
+		return time.Time{}, false
+	}
+
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return time.Time{}, false
+	}
+	if _, ok := cc["private"]; ok {
+		return time.Time{}, false
+	}
+	// May be stored, but must be revalidated before every use.
+	if _, ok := cc["no-cache"]; ok {
+		return now, true
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil {
+				return time.Time{}, false
+			}
+			return now.Add(time.Duration(secs) * time.Second), true
+		}
+	}
+	if v := h.Get("Expires"); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil || !t.After(now) {
+			return now, true
+		}
+		return t, true
+	}
+	if p.CacheTTL <= 0 {
+		return time.Time{}, false
+	}
+	return now.Add(p.CacheTTL), true
+}
+
+// parseCacheControl splits a Cache-Control header into its directives.
+func parseCacheControl(v string) map[string]string {
+	cc := map[string]string{}
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		var val string
+		if eq := strings.Index(d, "="); eq != -1 {
+			d, val = d[:eq], strings.Trim(d[eq+1:], `"`)
+		}
+		cc[strings.ToLower(d)] = val
+	}
+	return cc
+}
+
+// DecodeSigned verifies and decodes a signed camo URL, given either as a full
+// URL or just its path, returning the upstream URL and the transform options
+// it carries.
+func (p *Proxy) DecodeSigned(signed string) (string, transform.Options, error) {
+	su, err := url.Parse(signed)
+	if err != nil {
+		return "", transform.Options{}, err
+	}
+	sig, encodedURL, err := p.splitComponents(su.Path)
+	if err != nil {
+		return "", transform.Options{}, err
+	}
+	payload, err := p.Decoder.Decode(sig, encodedURL)
+	if err != nil {
+		return "", transform.Options{}, err
+	}
+	opts, rawurl, err := transform.Split(payload)
+	return rawurl, opts, err
+}
+
+// Purge removes every cached response for the decoded URL and returns the
+// number of entries removed. The URL is parsed first, so it is matched as
+// entries are stored, however it was escaped.
+func (p *Proxy) Purge(rawurl string) (int, error) {
+	if p.Cache == nil {
+		return 0, ErrNoCache
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return 0, err
+	}
+	want := u.String()
+	return p.purge(func(e *cache.Entry) bool {
+		return e.URL == want
+	}), nil
+}
+
+// PurgePrefix removes every cached response whose decoded URL, without its
+// scheme, starts with prefix. So "example.com/images/" purges everything under
+// that path on either http or https.
+func (p *Proxy) PurgePrefix(prefix string) (int, error) {
+	if p.Cache == nil {
+		return 0, ErrNoCache
+	}
+	if prefix == "" {
+		return 0, errors.New("empty purge prefix")
+	}
+	return p.purge(func(e *cache.Entry) bool {
+		hostPath := e.URL
+		if i := strings.Index(hostPath, "://"); i != -1 {
+			hostPath = hostPath[i+3:]
+		}
+		return strings.HasPrefix(hostPath, prefix)
+	}), nil
+}
+
+// purge removes the entries match picks and returns how many, leaving markers
+// out of the count as they aren't responses, see cache.Entry.Vary.
+func (p *Proxy) purge(match func(e *cache.Entry) bool) int {
+	var markers int
+	n := p.Cache.Purge(func(_ string, e *cache.Entry) bool {
+		if !match(e) {
+			return false
+		}
+		if e.Vary != nil {
+			markers++
+		}
+		return true
+	})
+	return n - markers
+}
+
+// Prefetch fetches the decoded URL and stores the response in the cache. It
+// returns the upstream status code and the size of the stored body. The body
+// goes through what it would for a client: it is decoded, checked against
+// the pixel limits and BlockedHashes, stripped of metadata and sanitized as
+// StripMetadata, Sanitize and SanitizeHosts say, then transformed as opts say
+// and stored where a request carrying opts looks. The context must carry a
+// request id, see rxid.
+func (p *Proxy) Prefetch(ctx context.Context, rawurl string, opts transform.Options) (int, int64, error) {
+	if p.Cache == nil {
+		return 0, 0, ErrNoCache
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return 0, 0, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return 0, 0, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if p.takenDown(u) {
+		return 0, 0, ErrTakenDown
+	}
+	if err := p.validateTarget(u); err != nil {
+		return 0, 0, err
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", p.ServerName)
+
+	resp, _, err := p.fetch(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, 0, fmt.Errorf("unexpected upstream response: %s", resp.Status)
+	}
+	if resp.ContentLength > p.MaxSize {
+		return resp.StatusCode, 0, ErrTooLarge
+	}
+	sums := p.hashBody(resp)
+	if err := p.decompress(resp); err != nil {
+		return resp.StatusCode, 0, err
+	}
+	sums.decompressed(resp)
+	if err := p.checkImage(resp); err != nil {
+		return resp.StatusCode, 0, err
+	}
+	if p.StripMetadata {
+		p.stripMetadata(resp)
+	}
+
+	max := p.MaxSize
+	if isSVG(resp.Header) {
+		max = p.MaxSVGSize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return resp.StatusCode, 0, err
+	}
+	if int64(len(body)) > max {
+		return resp.StatusCode, 0, ErrTooLarge
+	}
+	var sum blocklist.Sum
+	if sums != nil {
+		var blocked bool
+		if sum, blocked, err = p.blockedBody(u, sums); err != nil {
+			return resp.StatusCode, 0, err
+		}
+		if blocked {
+			return resp.StatusCode, 0, ErrBlocked
+		}
+	}
+
+	if p.sanitize(u) {
+		opts.Sanitize = true
+		if opts.Format == "" {
+			opts.Format = p.SanitizeFormat
+		}
+	}
+	var e *cache.Entry
+	switch {
+	case !opts.IsZero():
+		out, contentType, err := transform.Apply(bytes.NewReader(body), opts)
+		if err != nil {
+			return resp.StatusCode, 0, err
+		}
+		e = p.newEntry(u, resp, out, true)
+		e.Header.Set("Content-Type", contentType)
+	case isSVG(resp.Header):
+		out, err := svg.Sanitize(bytes.NewReader(body))
+		if err != nil {
+			return resp.StatusCode, 0, err
+		}
+		e = p.newEntry(u, resp, out, true)
+		e.Header.Set("Content-Type", "image/svg+xml")
+		e.Header.Del("Content-Security-Policy")
+	default:
+		e = p.newEntry(u, resp, body, p.GenerateETags && resp.Header.Get("ETag") == "")
+	}
+	e.Sum = sum
+	if !p.store(p.cacheKey(u, opts), req.Header, e) {
+		return resp.StatusCode, 0, errors.New("response is not cacheable")
+	}
+	return resp.StatusCode, int64(len(e.Body)), nil
+}
+
+// recordingReader keeps a copy of what is read through it, up to max bytes,
+// so a streamed body can be stored once the client has it.
+type recordingReader struct {
+	r   io.Reader
+	buf bytes.Buffer
+	max int64
+
+	overflow bool
+	eof      bool
+	err      error
+}
+
+// Read implements io.Reader.
+func (rr *recordingReader) Read(b []byte) (int, error) {
+	n, err := rr.r.Read(b)
+	if n > 0 && !rr.overflow {
+		if int64(rr.buf.Len()+n) > rr.max {
+			rr.overflow = true
+			rr.buf = bytes.Buffer{}
+		} else {
+			rr.buf.Write(b[:n])
+		}
+	}
+	switch {
+	case err == io.EOF:
+		rr.eof = true
+	case err != nil:
+		rr.err = err
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (rr *recordingReader) Close() error {
+	if c, ok := rr.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// complete tells us if the whole body was read without error.
+func (rr *recordingReader) complete() bool {
+	return rr.eof && rr.err == nil && !rr.overflow
+}
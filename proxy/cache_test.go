@@ -0,0 +1,267 @@
+package proxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/bepress/camo/transform"
+	"github.com/rs/zerolog"
+)
+
+func TestCacheHit(t *testing.T) {
+	table := []struct {
+		desc         string
+		cacheControl string
+		vary         string
+		wantHits     int32
+		wantCache    string
+	}{
+		{"default ttl", "", "", 1, "HIT"},
+		{"max-age", "public, max-age=60", "", 1, "HIT"},
+		{"no-store", "no-store", "", 2, "MISS"},
+		{"private", "private, max-age=60", "", 2, "MISS"},
+		{"zero max-age", "max-age=0", "", 2, "MISS"},
+		{"vary", "max-age=60", "Accept", 1, "HIT"},
+		{"vary accept-encoding", "max-age=60", "Accept-Encoding", 1, "HIT"},
+		{"vary star", "max-age=60", "*", 2, "MISS"},
+	}
+
+	resolver := DummyResolver{ips: []net.IP{
+		net.ParseIP("127.0.0.1"),
+	}}
+
+	for _, test := range table {
+		var hits int32
+		tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			if test.cacheControl != "" {
+				w.Header().Set("Cache-Control", test.cacheControl)
+			}
+			if test.vary != "" {
+				w.Header().Set("Vary", test.vary)
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		}))
+
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Cache = cache.MustNewMemory(1024 * 1024) },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + "/image.png"} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = resolver.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		var resp *http.Response
+		for i := 0; i < 2; i++ {
+			var err error
+			resp, err = ts.Client().Get(ts.URL + "/sig/url")
+			checkers.OK(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			checkers.OK(t, err)
+			resp.Body.Close()
+			checkers.Equals(t, resp.StatusCode, http.StatusOK)
+			checkers.Equals(t, string(body), "png")
+			checkers.Equals(t, resp.Header.Get("Content-Type"), "image/png")
+		}
+		checkers.Equals(t, resp.Header.Get("X-Cache"), test.wantCache)
+		checkers.Equals(t, atomic.LoadInt32(&hits), test.wantHits)
+
+		ts.Close()
+		tsBE.Close()
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	var hits int32
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding, Accept")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(r.Header.Get("Accept")))
+	}))
+	defer tsBE.Close()
+
+	tut := proxy.MustNew([]byte("test"),
+		zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.Cache = cache.MustNewMemory(1024 * 1024) },
+		func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + "/image.png"} },
+		func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+		func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+		func(p *proxy.Proxy) { p.CheckUnicast = false },
+	)
+	ts := httptest.NewTLSServer(rxid.Handler(tut))
+	defer ts.Close()
+
+	table := []struct {
+		accept    string
+		wantCache string
+		wantHits  int32
+	}{
+		{"image/webp", "MISS", 1},
+		{"image/webp", "HIT", 1},
+		{"image/png", "MISS", 2},
+		{"image/png", "HIT", 2},
+		{"image/webp", "HIT", 2},
+	}
+	for _, test := range table {
+		resp := get(t, ts, http.Header{"Accept": {test.accept}})
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+		checkers.Equals(t, string(body), test.accept)
+		checkers.Equals(t, resp.Header.Get("X-Cache"), test.wantCache)
+		checkers.Equals(t, atomic.LoadInt32(&hits), test.wantHits)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	c := cache.MustNewMemory(1024)
+	tut := proxy.MustNew([]byte("test"),
+		zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.Cache = c },
+	)
+
+	c.Set("1", &cache.Entry{URL: "http://example.com/images/a.png"})
+	c.Set("2", &cache.Entry{URL: "https://example.com/images/b.png"})
+	c.Set("3", &cache.Entry{URL: "https://example.com/other/c.png"})
+	c.Set("4", &cache.Entry{URL: "https://example.com/other/caf%C3%A9%20d.png"})
+	c.Set("5", &cache.Entry{URL: "https://example.com/other/caf%C3%A9%20d.png", Vary: []string{"Accept"}})
+
+	n, err := tut.Purge("http://example.com/images/a.png")
+	checkers.OK(t, err)
+	checkers.Equals(t, n, 1)
+
+	// Stored as url.URL.String has it.
+	n, err = tut.Purge("https://example.com/other/café d.png")
+	checkers.OK(t, err)
+	checkers.Equals(t, n, 1)
+
+	n, err = tut.PurgePrefix("example.com/images/")
+	checkers.OK(t, err)
+	checkers.Equals(t, n, 1)
+	checkers.Equals(t, c.Len(), 1)
+
+	_, err = tut.PurgePrefix("")
+	checkers.Assert(t, err != nil, "expected an error purging an empty prefix")
+}
+
+func TestCacheOperationsWithoutCache(t *testing.T) {
+	tut := proxy.MustNew([]byte("test"), zerolog.New(ioutil.Discard))
+
+	_, err := tut.Purge("http://example.com/a.png")
+	checkers.Equals(t, err, proxy.ErrNoCache)
+	_, err = tut.PurgePrefix("example.com")
+	checkers.Equals(t, err, proxy.ErrNoCache)
+	_, _, err = tut.Prefetch(context.Background(), "http://example.com/a.png", transform.Options{})
+	checkers.Equals(t, err, proxy.ErrNoCache)
+}
+
+func TestPrefetch(t *testing.T) {
+	var small bytes.Buffer
+	checkers.OK(t, png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 10, 10))))
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(small.Bytes())
+	zw.Close()
+	const comment = "secret comment"
+	commented := commentedJPEG(t, comment)
+
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gzipped.png":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped.Bytes())
+		case "/huge.png":
+			w.Write(pngHeader(50000, 50000))
+		case "/photo.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(commented)
+		case "/image.svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`))
+		}
+	}))
+	defer tsBE.Close()
+
+	table := []struct {
+		desc    string
+		path    string
+		opts    string
+		wantErr error
+		notWant string // what mustn't be in the stored body
+	}{
+		{"gzipped", "/gzipped.png", "", nil, ""},
+		{"too many pixels", "/huge.png", "", proxy.ErrTooManyPixels, ""},
+		{"metadata stripped", "/photo.jpg", "", nil, comment},
+		{"svg sanitized", "/image.svg", "", nil, "alert"},
+		{"transformed", "/photo.jpg", "w=5", nil, comment},
+	}
+
+	c := cache.MustNewMemory(1024 * 1024)
+	for _, test := range table {
+		payload := tsBE.URL + test.path
+		if test.opts != "" {
+			payload = test.opts + "|" + payload
+		}
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Cache = c },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: payload} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.StripMetadata = true },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+
+		rawurl, opts, err := tut.DecodeSigned("/sig/url")
+		checkers.OK(t, err)
+		_, _, err = tut.Prefetch(context.Background(), rawurl, opts)
+		if test.wantErr != nil {
+			checkers.Assert(t, errors.Is(err, test.wantErr), "%s: got %v", test.desc, err)
+			continue
+		}
+		checkers.OK(t, err)
+
+		// What was stored is what a client would have got.
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+		resp, err := ts.Client().Get(ts.URL + "/sig/url")
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+		ts.Close()
+
+		checkers.Equals(t, resp.Header.Get("X-Cache"), "HIT")
+		checkers.Equals(t, resp.Header.Get("Content-Encoding"), "")
+		if test.notWant != "" {
+			checkers.Assert(t, !bytes.Contains(body, []byte(test.notWant)), "%s: got %q", test.desc, body)
+		}
+		if test.opts != "" {
+			img, _, err := image.Decode(bytes.NewReader(body))
+			checkers.OK(t, err)
+			checkers.Equals(t, img.Bounds().Dx(), 5)
+		}
+		if test.path == "/gzipped.png" {
+			checkers.Assert(t, bytes.Equal(body, small.Bytes()), "%s: got %q", test.desc, body)
+		}
+	}
+}
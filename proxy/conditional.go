@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/transform"
+)
+
+// strongETag returns a strong entity tag for body.
+func strongETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// hasValidators tells us if upstream gave the entry something we can send
+// back to revalidate it.
+func hasValidators(e *cache.Entry) bool {
+	return (e.Header.Get("ETag") != "" && !e.GeneratedETag) || e.Header.Get("Last-Modified") != ""
+}
+
+// revalidate turns the upstream request into a conditional request using the
+// stale entry's validators. The client's own conditional and range headers are
+// dropped: they are answered from the entry if upstream says it is unchanged,
+// and otherwise we want the whole new response.
+func revalidate(out *http.Request, e *cache.Entry) {
+	stripConditionals(out.Header)
+	if etag := e.Header.Get("ETag"); etag != "" && !e.GeneratedETag {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if lm := e.Header.Get("Last-Modified"); lm != "" {
+		out.Header.Set("If-Modified-Since", lm)
+	}
+}
+
+// stripConditionals removes conditional and range headers from h.
+func stripConditionals(h http.Header) {
+	for _, k := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range"} {
+		h.Del(k)
+	}
+}
+
+// refresh updates a stale entry with the headers from upstream's 304 to a
+// request with headers rh and stores it again. The returned entry is the one
+// to serve.
+func (p *Proxy) refresh(u *url.URL, opts transform.Options, rh http.Header, e *cache.Entry, resp *http.Response) *cache.Entry {
+	h := cloneHeader(resp.Header)
+	removeHopHeaders(h)
+	h.Del("Content-Length")
+	if e.GeneratedETag {
+		h.Del("ETag")
+	}
+	if !opts.IsZero() || isSVG(e.Header) || isSVG(h) {
+		// The entry's type is that of the transformed image, and only
+		// sanitized entries may be SVG.
+		h.Del("Content-Type")
+	}
+
+	updated := *e
+	updated.Header = cloneHeader(e.Header)
+	for k, vv := range h {
+		updated.Header[k] = vv
+	}
+
+	key := p.cacheKey(u, opts)
+	if !p.store(key, rh, &updated) {
+		p.Cache.Delete(p.entryKey(key, rh))
+		updated.Expires = time.Now()
+	}
+	return &updated
+}
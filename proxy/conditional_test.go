@@ -0,0 +1,215 @@
+package proxy_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/proxy"
+	"github.com/rs/zerolog"
+)
+
+func TestConditionalFromCache(t *testing.T) {
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	var hits int
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte("image"))
+	}))
+	defer tsBE.Close()
+
+	ts := newTestServer(tsBE.URL+"/image.png", zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.Cache = cache.MustNewMemory(1024 * 1024) },
+		func(p *proxy.Proxy) { p.MaxSize = 16 },
+	)
+	defer ts.Close()
+
+	// Warm the cache.
+	resp := get(t, ts, nil)
+	checkers.Equals(t, resp.StatusCode, http.StatusOK)
+
+	table := []struct {
+		header   string
+		value    string
+		wantCode int
+	}{
+		{"If-None-Match", `"v1"`, http.StatusNotModified},
+		{"If-None-Match", `W/"v1"`, http.StatusNotModified},
+		{"If-None-Match", `"v0", "v1"`, http.StatusNotModified},
+		{"If-None-Match", `"v0"`, http.StatusOK},
+		{"If-Modified-Since", lastModified, http.StatusNotModified},
+		{"If-Modified-Since", time.Now().Add(-2 * time.Hour).UTC().Format(http.TimeFormat), http.StatusOK},
+	}
+	for _, test := range table {
+		resp := get(t, ts, http.Header{test.header: {test.value}})
+		checkers.Equals(t, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, resp.Header.Get("X-Cache"), "HIT")
+		checkers.Equals(t, resp.Header.Get("ETag"), `"v1"`)
+	}
+	checkers.Equals(t, hits, 1)
+}
+
+func TestRevalidation(t *testing.T) {
+	table := []struct {
+		desc      string
+		etag      string
+		modified  string
+		wantINM   string
+		wantIMS   string
+		unchanged bool
+		wantCache string
+		wantBody  string
+	}{
+		{"etag unchanged", `"v1"`, "", `"v1"`, "", true, "REVALIDATED", "v1"},
+		{"last modified unchanged", "", "Mon, 02 Jan 2006 15:04:05 GMT", "", "Mon, 02 Jan 2006 15:04:05 GMT", true, "REVALIDATED", "v1"},
+		{"both unchanged", `"v1"`, "Mon, 02 Jan 2006 15:04:05 GMT", `"v1"`, "Mon, 02 Jan 2006 15:04:05 GMT", true, "REVALIDATED", "v1"},
+		{"changed", `"v1"`, "", `"v1"`, "", false, "MISS", "v2"},
+	}
+
+	for _, test := range table {
+		var (
+			hits         int
+			gotINM       string
+			gotIMS       string
+			gotClientINM string
+		)
+		tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			gotINM, gotIMS = r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since")
+			w.Header().Set("Cache-Control", "no-cache")
+			if test.etag != "" {
+				w.Header().Set("ETag", test.etag)
+			}
+			if test.modified != "" {
+				w.Header().Set("Last-Modified", test.modified)
+			}
+			if hits > 1 && test.unchanged {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if hits > 1 {
+				w.Write([]byte("v2"))
+				return
+			}
+			w.Write([]byte("v1"))
+		}))
+
+		ts := newTestServer(tsBE.URL+"/image.png", zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Cache = cache.MustNewMemory(1024 * 1024) },
+			func(p *proxy.Proxy) { p.MaxSize = 16 },
+		)
+
+		resp := get(t, ts, nil)
+		checkers.Equals(t, resp.StatusCode, http.StatusOK)
+		checkers.Equals(t, gotINM, "")
+
+		// The client's own validator is not sent upstream when revalidating.
+		resp = get(t, ts, http.Header{"If-None-Match": {`"client"`}})
+		gotClientINM = gotINM
+		checkers.Equals(t, resp.StatusCode, http.StatusOK)
+		checkers.Equals(t, resp.Header.Get("X-Cache"), test.wantCache)
+		checkers.Equals(t, gotClientINM, test.wantINM)
+		checkers.Equals(t, gotIMS, test.wantIMS)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		checkers.Equals(t, string(body), test.wantBody)
+		checkers.Equals(t, hits, 2)
+
+		ts.Close()
+		tsBE.Close()
+	}
+}
+
+func TestGeneratedETag(t *testing.T) {
+	const content = "some image bytes"
+	sum := sha256.Sum256([]byte(content))
+	want := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	table := []struct {
+		desc     string
+		cache    cache.Cache
+		header   http.Header
+		wantCode int
+	}{
+		{"no cache", nil, nil, http.StatusOK},
+		{"no cache conditional", nil, http.Header{"If-None-Match": {want}}, http.StatusNotModified},
+		{"cache", cache.MustNewMemory(1024 * 1024), nil, http.StatusOK},
+		{"cache conditional", cache.MustNewMemory(1024 * 1024), http.Header{"If-None-Match": {want}}, http.StatusNotModified},
+	}
+
+	for _, test := range table {
+		var (
+			hits   int
+			gotINM string
+		)
+		tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits++
+			gotINM = r.Header.Get("If-None-Match")
+			w.Write([]byte(content))
+		}))
+		ts := newTestServer(tsBE.URL+"/image.png", zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Cache = test.cache },
+			func(p *proxy.Proxy) { p.GenerateETags = true },
+			func(p *proxy.Proxy) { p.MaxSize = 16 },
+		)
+
+		resp := get(t, ts, nil)
+		checkers.Equals(t, resp.StatusCode, http.StatusOK)
+		checkers.Equals(t, resp.Header.Get("ETag"), want)
+
+		resp = get(t, ts, test.header)
+		checkers.Equals(t, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, resp.Header.Get("ETag"), want)
+		if test.cache != nil {
+			checkers.Equals(t, hits, 1)
+		} else {
+			checkers.Equals(t, hits, 2)
+			// The generated tag means nothing upstream, but is passed along.
+			checkers.Equals(t, gotINM, test.header.Get("If-None-Match"))
+		}
+
+		ts.Close()
+		tsBE.Close()
+	}
+}
+
+func TestGeneratedETagTooLarge(t *testing.T) {
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flush so there is no Content-Length to check up front.
+		w.Write([]byte("0123456789"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("0123456789"))
+	}))
+	defer tsBE.Close()
+
+	ts := newTestServer(tsBE.URL+"/image.png", zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.GenerateETags = true },
+		func(p *proxy.Proxy) { p.MaxSize = 16 },
+	)
+	defer ts.Close()
+
+	resp := get(t, ts, nil)
+	checkers.Equals(t, resp.StatusCode, http.StatusRequestEntityTooLarge)
+}
+
+// get requests the proxied image with extra headers. The body is left
+// unread for the caller; it is closed when the test server closes.
+func get(t *testing.T, ts *httptest.Server, h http.Header) *http.Response {
+	req, err := http.NewRequest("GET", ts.URL+"/sig/url", nil)
+	checkers.OK(t, err)
+	for k, vv := range h {
+		req.Header[k] = vv
+	}
+	resp, err := ts.Client().Do(req)
+	checkers.OK(t, err)
+	return resp
+}
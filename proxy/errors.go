@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/bepress/camo/breaker"
+	"github.com/bepress/camo/inflight"
+	"github.com/bepress/camo/logging"
+	"github.com/bepress/camo/rxid"
+)
+
+// StatusClientClosedRequest is the non-standard status we log when the client
+// goes away before we can answer. Nobody sees it but our logs.
+const StatusClientClosedRequest = 499
+
+// ErrTooLarge is returned when the upstream body is larger than MaxSize.
+var ErrTooLarge = errors.New("payload too large")
+
+var (
+	// ErrRequestTimeout is returned when RequestTimeout runs out before we
+	// have upstream response headers.
+	ErrRequestTimeout = errors.New("upstream request timed out")
+
+	// ErrBodyStalled is returned when an upstream body sends nothing for
+	// StallTimeout.
+	ErrBodyStalled = errors.New("upstream body stalled")
+
+	// ErrBodyTooSlow is returned when an upstream body arrives slower than
+	// MinRate.
+	ErrBodyTooSlow = errors.New("upstream body below minimum transfer rate")
+
+	// ErrShortBody is returned when an upstream body ends before its
+	// Content-Length.
+	ErrShortBody = errors.New("upstream body shorter than Content-Length")
+)
+
+var (
+	// upstreamErrors counts upstream failures by ErrorClass.
+	upstreamErrors = expvar.NewMap("upstreamErrors")
+
+	// truncatedBodies counts responses aborted part way through the body by
+	// ErrorClass.
+	truncatedBodies = expvar.NewMap("truncatedBodies")
+)
+
+// ErrorClass classifies an upstream failure. It is used as the error_class log
+// field and the upstreamErrors expvar key.
+type ErrorClass string
+
+// Upstream failure classes.
+const (
+	ClassDNS               ErrorClass = "dns"
+	ClassConnRefused       ErrorClass = "connection_refused"
+	ClassConnection        ErrorClass = "connection"
+	ClassTLS               ErrorClass = "tls"
+	ClassTimeout           ErrorClass = "timeout"
+	ClassFiltered          ErrorClass = "filtered_address"
+	ClassRedirectLimit     ErrorClass = "redirect_limit"
+	ClassRedirectDowngrade ErrorClass = "redirect_downgrade"
+	ClassTooLarge          ErrorClass = "body_too_large"
+	ClassTooManyPixels     ErrorClass = "too_many_pixels"
+	ClassCanceled          ErrorClass = "client_canceled"
+	ClassCircuitOpen       ErrorClass = "circuit_open"
+	ClassConcurrencyLimit  ErrorClass = "concurrency_limit"
+	ClassTransform         ErrorClass = "transform_failed"
+	ClassInvalidSVG        ErrorClass = "invalid_svg"
+	ClassBlocked           ErrorClass = "blocked_content"
+	ClassTakenDown         ErrorClass = "taken_down"
+	ClassUnknown           ErrorClass = "unknown"
+)
+
+// Status is the response code we answer with for the class.
+func (c ErrorClass) Status() int {
+	switch c {
+	case ClassFiltered:
+		return http.StatusBadRequest
+	case ClassTooLarge, ClassTooManyPixels:
+		return http.StatusRequestEntityTooLarge
+	case ClassTimeout:
+		return http.StatusGatewayTimeout
+	case ClassCanceled:
+		return StatusClientClosedRequest
+	case ClassBlocked, ClassTakenDown:
+		return http.StatusUnavailableForLegalReasons
+	case ClassCircuitOpen, ClassConcurrencyLimit:
+		return http.StatusServiceUnavailable
+	case ClassDNS, ClassConnRefused, ClassConnection, ClassTLS, ClassRedirectLimit, ClassRedirectDowngrade, ClassTransform, ClassInvalidSVG:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Classify works out the ErrorClass of an error from an upstream request.
+func Classify(err error) ErrorClass {
+	var (
+		rle     *RedirectLimitError
+		dnsErr  *net.DNSError
+		netErr  net.Error
+		opErr   *net.OpError
+		hdrErr  tls.RecordHeaderError
+		alert   tls.AlertError
+		verify  *tls.CertificateVerificationError
+		unknown x509.UnknownAuthorityError
+		host    x509.HostnameError
+		invalid x509.CertificateInvalidError
+	)
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrFilteredAddress):
+		return ClassFiltered
+	case errors.As(err, &rle):
+		return ClassRedirectLimit
+	case errors.Is(err, ErrRedirectDowngrade):
+		return ClassRedirectDowngrade
+	case errors.Is(err, ErrTooLarge):
+		return ClassTooLarge
+	case errors.Is(err, ErrTooManyPixels):
+		return ClassTooManyPixels
+	case errors.Is(err, ErrBlocked):
+		return ClassBlocked
+	case errors.Is(err, ErrTakenDown):
+		return ClassTakenDown
+	case errors.Is(err, ErrRequestTimeout), errors.Is(err, ErrBodyStalled), errors.Is(err, ErrBodyTooSlow):
+		return ClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ClassCanceled
+	case errors.Is(err, breaker.ErrOpen):
+		return ClassCircuitOpen
+	case errors.Is(err, inflight.ErrHostLimit), errors.Is(err, inflight.ErrGlobalLimit):
+		return ClassConcurrencyLimit
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return ClassTimeout
+		}
+		return ClassDNS
+	case errors.Is(err, context.DeadlineExceeded):
+		return ClassTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ClassTimeout
+	case errors.As(err, &hdrErr), errors.As(err, &alert), errors.As(err, &verify),
+		errors.As(err, &unknown), errors.As(err, &host), errors.As(err, &invalid):
+		return ClassTLS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ClassConnRefused
+	case errors.As(err, &opErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, ErrShortBody):
+		return ClassConnection
+	default:
+		return ClassUnknown
+	}
+}
+
+// fail logs and counts an upstream failure and answers the client with the
+// status for its class. msg is the response body unless a placeholder is
+// served instead, or the class is for blocked content when it's always
+// BlockedMessage. resp is the upstream response, if there is one, so we can
+// log how we got there.
+func (p *Proxy) fail(w http.ResponseWriter, r *http.Request, class ErrorClass, err error, msg string, resp *http.Response) {
+	upstreamErrors.Add(string(class), 1)
+	p.logger.Error().Err(err).
+		Str("request_id", rxid.FromContext(r.Context())).
+		Str("error_class", string(class)).
+		Strs("redirect_chain", redirectChain(resp)).Msg(logging.CallerDetails(2))
+	switch class {
+	case ClassConcurrencyLimit:
+		// Slots free up quickly so it is worth trying again soon.
+		w.Header().Set("Retry-After", "1")
+	case ClassBlocked, ClassTakenDown:
+		msg = p.BlockedMessage
+	}
+	p.writeError(w, r, class.reason(), class.Status(), msg)
+}
+
+// abort logs and counts an upstream body that failed after the response
+// headers went out and aborts the client connection, closing it for HTTP/1 and
+// resetting the stream for HTTP/2, so neither the client nor any cache in
+// between takes what it got for the whole thing. It does not return.
+func (p *Proxy) abort(r *http.Request, err error) {
+	class := Classify(err)
+	truncatedBodies.Add(string(class), 1)
+	p.logger.Error().Err(err).
+		Str("request_id", rxid.FromContext(r.Context())).
+		Str("error_class", string(class)).
+		Str("reason", "truncated_body").Msg(logging.CallerDetails(2))
+	panic(http.ErrAbortHandler)
+}
+
+// filteredError is returned by validateTarget for addresses we won't proxy to.
+type filteredError struct {
+	msg string
+}
+
+// Error implements error.
+func (e *filteredError) Error() string { return e.msg }
+
+// Is lets errors.Is match filteredError against ErrFilteredAddress.
+func (e *filteredError) Is(target error) bool { return target == ErrFilteredAddress }
@@ -0,0 +1,149 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/breaker"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/inflight"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	wrap := func(err error) error { return &url.Error{Op: "Get", URL: "http://example.com", Err: err} }
+
+	table := []struct {
+		err  error
+		want proxy.ErrorClass
+		code int
+	}{
+		{wrap(proxy.ErrFilteredAddress), proxy.ClassFiltered, http.StatusBadRequest},
+		{wrap(&proxy.RedirectLimitError{Limit: 3}), proxy.ClassRedirectLimit, http.StatusBadGateway},
+		{wrap(proxy.ErrRedirectDowngrade), proxy.ClassRedirectDowngrade, http.StatusBadGateway},
+		{proxy.ErrTooLarge, proxy.ClassTooLarge, http.StatusRequestEntityTooLarge},
+		{wrap(context.Canceled), proxy.ClassCanceled, proxy.StatusClientClosedRequest},
+		{breaker.ErrOpen, proxy.ClassCircuitOpen, http.StatusServiceUnavailable},
+		{inflight.ErrHostLimit, proxy.ClassConcurrencyLimit, http.StatusServiceUnavailable},
+		{inflight.ErrGlobalLimit, proxy.ClassConcurrencyLimit, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: %v", proxy.ErrRequestTimeout, context.Canceled), proxy.ClassTimeout, http.StatusGatewayTimeout},
+		{proxy.ErrBodyStalled, proxy.ClassTimeout, http.StatusGatewayTimeout},
+		{proxy.ErrBodyTooSlow, proxy.ClassTimeout, http.StatusGatewayTimeout},
+		{wrap(context.DeadlineExceeded), proxy.ClassTimeout, http.StatusGatewayTimeout},
+		{wrap(&net.OpError{Op: "read", Err: timeoutError{}}), proxy.ClassTimeout, http.StatusGatewayTimeout},
+		{&net.DNSError{Err: "no such host", Name: "nope.example.com"}, proxy.ClassDNS, http.StatusBadGateway},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, proxy.ClassTimeout, http.StatusGatewayTimeout},
+		{wrap(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), proxy.ClassConnRefused, http.StatusBadGateway},
+		{wrap(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), proxy.ClassConnection, http.StatusBadGateway},
+		{wrap(io.EOF), proxy.ClassConnection, http.StatusBadGateway},
+		{wrap(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), proxy.ClassTLS, http.StatusBadGateway},
+		{wrap(x509.UnknownAuthorityError{}), proxy.ClassTLS, http.StatusBadGateway},
+		{wrap(errors.New("something else")), proxy.ClassUnknown, http.StatusInternalServerError},
+	}
+
+	for _, test := range table {
+		got := proxy.Classify(test.err)
+		checkers.Equals(t, got, test.want)
+		checkers.Equals(t, got.Status(), test.code)
+	}
+}
+
+func TestUpstreamErrorResponses(t *testing.T) {
+	// A listener we close straight away so nothing is listening.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	checkers.OK(t, err)
+	refused := "http://" + ln.Addr().String() + "/image.png"
+	ln.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	// Its certificate isn't trusted by the proxy.
+	untrusted := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer untrusted.Close()
+
+	table := []struct {
+		url      string
+		timeout  time.Duration
+		want     proxy.ErrorClass
+		wantCode int
+	}{
+		{refused, time.Second, proxy.ClassConnRefused, http.StatusBadGateway},
+		{slow.URL + "/image.png", 50 * time.Millisecond, proxy.ClassTimeout, http.StatusGatewayTimeout},
+		{untrusted.URL + "/image.png", time.Second, proxy.ClassTLS, http.StatusBadGateway},
+	}
+
+	for _, test := range table {
+		before := upstreamErrorCount(test.want)
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.RequestTimeout = test.timeout },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: test.url} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		resp, err := ts.Client().Get(ts.URL + "/sig/url")
+		checkers.OK(t, err)
+		resp.Body.Close()
+		checkers.Equals(t, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, upstreamErrorCount(test.want), before+1)
+
+		ts.Close()
+	}
+}
+
+func TestLookupFailure(t *testing.T) {
+	tut := proxy.MustNew([]byte("test"),
+		zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: "http://nope.example.com/image.png"} },
+		func(p *proxy.Proxy) {
+			p.LookupIP = DummyResolver{err: &net.DNSError{Err: "no such host", Name: "nope.example.com"}}.LookupIP
+		},
+	)
+	ts := httptest.NewTLSServer(rxid.Handler(tut))
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/sig/url")
+	checkers.OK(t, err)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusBadGateway)
+}
+
+func upstreamErrorCount(class proxy.ErrorClass) int64 {
+	m := expvar.Get("upstreamErrors").(*expvar.Map)
+	v := m.Get(string(class))
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.String(), 10, 64)
+	return n
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fetch does req subject to our upstream limits: a slot from Inflight, the
+// circuit breaker for the host and retries. RequestTimeout covers getting
+// the response headers, retries and all. The body is watched for stalls
+// instead, see watch, and the Inflight slot is held until it is closed.
+func (p *Proxy) fetch(req *http.Request) (*http.Response, int, error) {
+	deadline := time.Now().Add(p.RequestTimeout)
+	ctx, cancel := context.WithCancel(req.Context())
+	var expired int32
+	budget := time.AfterFunc(p.RequestTimeout, func() {
+		atomic.StoreInt32(&expired, 1)
+		cancel()
+	})
+	req = req.WithContext(ctx)
+
+	// Running out of budget cancels the request, which would otherwise look
+	// like the client went away.
+	timedOut := func(err error) error {
+		if atomic.LoadInt32(&expired) == 1 {
+			return fmt.Errorf("%w: %v", ErrRequestTimeout, err)
+		}
+		return err
+	}
+
+	release, done, err := p.admit(req)
+	if err != nil {
+		budget.Stop()
+		cancel()
+		return nil, 0, timedOut(err)
+	}
+
+	resp, attempts, err := p.retry(req, deadline)
+	if !budget.Stop() && err == nil {
+		resp.Body.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		err = timedOut(err)
+	}
+	done(tripsBreaker(resp, err))
+	if err != nil {
+		release()
+		cancel()
+		return resp, attempts, err
+	}
+
+	resp.Body = p.watch(resp.Body, cancel, func() {
+		release()
+		cancel()
+	})
+	return resp, attempts, nil
+}
+
+// admit gets the breaker's permission and a slot from Inflight for req. The
+// breaker comes first so requests to a host it has given up on don't queue
+// for a slot. The caller must call release when done with the response and
+// report the outcome to done.
+func (p *Proxy) admit(req *http.Request) (release func(), done func(bool), err error) {
+	release, done = func() {}, func(bool) {}
+	if p.Breakers != nil {
+		if done, err = p.Breakers.Allow(req.URL.Host); err != nil {
+			return nil, nil, err
+		}
+	}
+	if p.Inflight != nil {
+		if release, err = p.Inflight.Acquire(req.Context(), req.URL.Host); err != nil {
+			done(tripsBreaker(nil, err))
+			return nil, nil, err
+		}
+	}
+	return release, done, nil
+}
+
+// watch aborts body if it stalls for StallTimeout or, once it has had
+// StallTimeout to get going, arrives slower than MinRate. Only time spent
+// waiting on upstream in Read counts, not what the caller does between reads,
+// so a slow client doesn't look like a slow upstream. abort cancels the
+// upstream request and done is called once when the body is closed.
+func (p *Proxy) watch(body io.ReadCloser, abort, done func()) io.ReadCloser {
+	now := time.Now()
+	wb := &watchedBody{
+		ReadCloser: body,
+		stall:      p.StallTimeout,
+		minRate:    p.MinRate,
+		start:      now,
+		last:       now,
+		abort:      abort,
+		done:       done,
+	}
+	if wb.stall > 0 {
+		wb.timer = time.AfterFunc(wb.stall, func() {
+			atomic.StoreInt32(&wb.stalled, 1)
+			abort()
+		})
+		// It runs only while we're in Read.
+		wb.timer.Stop()
+	}
+	return wb
+}
+
+type watchedBody struct {
+	io.ReadCloser
+	stall   time.Duration
+	minRate int64
+	start   time.Time
+	abort   func()
+	done    func()
+
+	read    int64
+	last    time.Time     // when the last Read returned
+	idle    time.Duration // spent outside Read
+	timer   *time.Timer
+	stalled int32
+	once    sync.Once
+}
+
+// Read implements io.Reader.
+func (wb *watchedBody) Read(b []byte) (int, error) {
+	wb.idle += time.Since(wb.last)
+	if wb.timer != nil {
+		wb.timer.Reset(wb.stall)
+	}
+	n, err := wb.ReadCloser.Read(b)
+	if wb.timer != nil {
+		wb.timer.Stop()
+	}
+	wb.last = time.Now()
+	if atomic.LoadInt32(&wb.stalled) == 1 {
+		return n, ErrBodyStalled
+	}
+	wb.read += int64(n)
+	if wb.minRate > 0 && err == nil {
+		elapsed := wb.last.Sub(wb.start) - wb.idle
+		if elapsed >= wb.stall && float64(wb.read) < float64(wb.minRate)*elapsed.Seconds() {
+			wb.abort()
+			return n, ErrBodyTooSlow
+		}
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (wb *watchedBody) Close() error {
+	err := wb.ReadCloser.Close()
+	if wb.timer != nil {
+		wb.timer.Stop()
+	}
+	wb.once.Do(wb.done)
+	return err
+}
@@ -0,0 +1,280 @@
+package proxy_test
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/inflight"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+func TestInflightLimit(t *testing.T) {
+	var (
+		started = make(chan struct{}, 1)
+		unblock = make(chan struct{})
+	)
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.png" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			started <- struct{}{}
+			<-unblock
+		}
+		w.Write([]byte("image"))
+	}))
+	defer tsBE.Close()
+
+	limiter := inflight.MustNew(
+		func(l *inflight.Limiter) { l.PerHost = 1 },
+		func(l *inflight.Limiter) { l.Queue = 0 },
+	)
+	newProxy := func(path string) *httptest.Server {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Inflight = limiter },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + path} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		return httptest.NewTLSServer(rxid.Handler(tut))
+	}
+	slow := newProxy("/slow.png")
+	defer slow.Close()
+	fast := newProxy("/fast.png")
+	defer fast.Close()
+
+	// The slot is held while the body streams.
+	done := make(chan int)
+	go func() {
+		resp, err := slow.Client().Get(slow.URL + "/sig/url")
+		checkers.OK(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-started
+
+	before := upstreamErrorCount(proxy.ClassConcurrencyLimit)
+	resp := get(t, fast, nil)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusServiceUnavailable)
+	checkers.Equals(t, resp.Header.Get("Retry-After"), "1")
+	checkers.Equals(t, upstreamErrorCount(proxy.ClassConcurrencyLimit), before+1)
+
+	close(unblock)
+	checkers.Equals(t, <-done, http.StatusOK)
+
+	// Closing the body gave the slot back.
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp = get(t, fast, nil)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	checkers.Equals(t, resp.StatusCode, http.StatusOK)
+}
+
+func TestBodyTimeouts(t *testing.T) {
+	table := []struct {
+		desc     string
+		chunks   int
+		every    time.Duration
+		minRate  int64
+		etags    bool
+		wantCode int // 0 if the response is aborted
+		wantLen  int
+	}{
+		{"slow but steady", 10, 20 * time.Millisecond, 0, false, http.StatusOK, 10 * 64},
+		{"slow but steady buffered", 10, 20 * time.Millisecond, 0, true, http.StatusOK, 10 * 64},
+		{"stalled", 3, 300 * time.Millisecond, 0, false, 0, -1},
+		{"stalled buffered", 3, 300 * time.Millisecond, 0, true, http.StatusGatewayTimeout, -1},
+		{"too slow", 10, 20 * time.Millisecond, 64 * 1024, false, 0, -1},
+		{"too slow buffered", 10, 20 * time.Millisecond, 64 * 1024, true, http.StatusGatewayTimeout, -1},
+	}
+
+	for _, test := range table {
+		tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < test.chunks; i++ {
+				if i > 0 {
+					time.Sleep(test.every)
+				}
+				w.Write([]byte(strings.Repeat("x", 64)))
+				w.(http.Flusher).Flush()
+			}
+		}))
+
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.RequestTimeout = 100 * time.Millisecond },
+			func(p *proxy.Proxy) { p.StallTimeout = 100 * time.Millisecond },
+			func(p *proxy.Proxy) { p.MinRate = test.minRate },
+			func(p *proxy.Proxy) { p.GenerateETags = test.etags },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + "/image.png"} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		before := truncatedCount(proxy.ClassTimeout)
+		code, body, err := getAll(ts)
+		if test.wantCode == 0 {
+			checkers.Assert(t, err != nil, "%s: response was not aborted", test.desc)
+			checkers.Equals(t, truncatedCount(proxy.ClassTimeout), before+1)
+		} else {
+			checkers.OK(t, err)
+			checkers.Assert(t, code == test.wantCode, "%s: got %d want %d", test.desc, code, test.wantCode)
+		}
+		switch test.wantLen {
+		case -1:
+			checkers.Assert(t, len(body) < test.chunks*64, "%s: got the whole body", test.desc)
+		default:
+			checkers.Assert(t, len(body) == test.wantLen, "%s: got %d bytes want %d", test.desc, len(body), test.wantLen)
+		}
+
+		ts.Close()
+		tsBE.Close()
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	table := []struct {
+		desc    string
+		minRate int64
+	}{
+		{"stall timeout", 0},
+		{"min rate", 1024 * 1024},
+	}
+
+	body := strings.Repeat("x", 128*1024)
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer tsBE.Close()
+
+	for _, test := range table {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.StallTimeout = 100 * time.Millisecond },
+			func(p *proxy.Proxy) { p.MinRate = test.minRate },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + "/image.png"} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+
+		// Each write takes longer than StallTimeout, so the whole body
+		// arrives far slower than MinRate.
+		w := &slowWriter{ResponseRecorder: httptest.NewRecorder(), delay: 150 * time.Millisecond}
+		before := truncatedCount(proxy.ClassTimeout)
+		func() {
+			defer func() {
+				checkers.Assert(t, recover() == nil, "%s: response was aborted", test.desc)
+			}()
+			rxid.Handler(tut).ServeHTTP(w, httptest.NewRequest("GET", "/sig/url", nil))
+		}()
+		checkers.Equals(t, w.Code, http.StatusOK)
+		checkers.Assert(t, w.Body.Len() == len(body), "%s: got %d bytes want %d", test.desc, w.Body.Len(), len(body))
+		checkers.Equals(t, truncatedCount(proxy.ClassTimeout), before)
+	}
+}
+
+// slowWriter takes delay over every write.
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestTruncatedBody(t *testing.T) {
+	table := []struct {
+		desc  string
+		http2 bool
+		cache bool
+	}{
+		{"HTTP/1.1", false, false},
+		{"HTTP/2", true, false},
+		{"cached", false, true},
+	}
+
+	// The backend promises more than it sends.
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.Write([]byte(strings.Repeat("x", 64)))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		checkers.OK(t, err)
+		conn.Close()
+	}))
+	defer tsBE.Close()
+
+	for _, test := range table {
+		c := cache.MustNewMemory(1024 * 1024)
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) {
+				if test.cache {
+					p.Cache = c
+				}
+			},
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + "/image.png"} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+			func(p *proxy.Proxy) { p.FlushInterval = time.Millisecond },
+		)
+		ts := httptest.NewUnstartedServer(rxid.Handler(tut))
+		ts.EnableHTTP2 = test.http2
+		ts.StartTLS()
+
+		before := truncatedCount(proxy.ClassConnection)
+		_, body, err := getAll(ts)
+		checkers.Assert(t, err != nil, "%s: response was not aborted", test.desc)
+		checkers.Assert(t, len(body) < 1024, "%s: got %d bytes", test.desc, len(body))
+		checkers.Equals(t, truncatedCount(proxy.ClassConnection), before+1)
+		checkers.Equals(t, c.Len(), 0)
+
+		ts.Close()
+	}
+}
+
+// getAll gets the whole response from ts. An aborted response may fail
+// before or after we have the headers.
+func getAll(ts *httptest.Server) (int, []byte, error) {
+	resp, err := ts.Client().Get(ts.URL + "/sig/url")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+func truncatedCount(class proxy.ErrorClass) int64 {
+	v := expvar.Get("truncatedBodies").(*expvar.Map).Get(string(class))
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.String(), 10, 64)
+	return n
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/bepress/camo/transform"
+)
+
+// headAsGet tells us if a HEAD must be answered as the GET it stands for, as
+// what we'd send for the GET depends on the body: its pixels, its sum, what we
+// make of it or an ETag made from it. Otherwise HEAD is sent upstream.
+func (p *Proxy) headAsGet(opts transform.Options) bool {
+	return !opts.IsZero() || p.MaxPixels > 0 || p.MaxDimension > 0 ||
+		p.BlockedHashes != nil || p.GenerateETags || p.StripMetadata
+}
+
+// fetchHead does a HEAD request upstream. Some servers won't answer HEAD, so
+// if upstream turns it down we ask again with a GET and close the body
+// unread, which still gets us the headers.
+func (p *Proxy) fetchHead(req *http.Request) (*http.Response, int, error) {
+	resp, attempts, err := p.fetch(req)
+	if err != nil || !headRefused(resp.StatusCode) {
+		return resp, attempts, err
+	}
+	resp.Body.Close()
+
+	get := req.Clone(req.Context())
+	get.Method = "GET"
+	resp, more, err := p.fetch(get)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, attempts + more, err
+}
+
+// headRefused tells us if status means upstream doesn't do HEAD.
+func headRefused(status int) bool {
+	return status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented
+}
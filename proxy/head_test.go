@@ -0,0 +1,168 @@
+package proxy_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+func TestHead(t *testing.T) {
+	body := strings.Repeat("x", 4096)
+	table := []struct {
+		desc        string
+		path        string
+		cache       bool
+		limits      bool
+		wantMethods []string
+		wantXCache  string
+	}{
+		{"upstream HEAD", "/image.png", false, false, []string{"GET", "HEAD"}, ""},
+		{"upstream refuses HEAD", "/nohead.png", false, false, []string{"GET", "HEAD", "GET"}, ""},
+		{"pixel limits", "/image.png", false, true, []string{"GET", "GET"}, ""},
+		{"cached", "/image.png", true, true, []string{"GET"}, "HIT"},
+	}
+
+	for _, test := range table {
+		var (
+			mu      sync.Mutex
+			methods []string
+		)
+		tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			methods = append(methods, r.Method)
+			mu.Unlock()
+			if r.URL.Path == "/nohead.png" && r.Method == "HEAD" {
+				http.Error(w, "no HEAD here", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Cache-Control", "max-age=60")
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+		}))
+
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) {
+				if test.cache {
+					p.Cache = cache.MustNewMemory(1024 * 1024)
+				}
+			},
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + test.path} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) {
+				if !test.limits {
+					p.MaxDimension, p.MaxPixels = 0, 0
+				}
+			},
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		// A GET first so there is something to cache.
+		resp := get(t, ts, nil)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		resp, err := ts.Client().Head(ts.URL + "/sig/url")
+		checkers.OK(t, err)
+		got, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		checkers.Assert(t, resp.StatusCode == http.StatusOK, "%s: got %d", test.desc, resp.StatusCode)
+		checkers.Equals(t, resp.ContentLength, int64(len(body)))
+		checkers.Equals(t, resp.Header.Get("Content-Type"), "image/png")
+		checkers.Equals(t, resp.Header.Get("X-Cache"), test.wantXCache)
+		checkers.Equals(t, len(got), 0)
+		mu.Lock()
+		checkers.Assert(t, strings.Join(methods, ",") == strings.Join(test.wantMethods, ","), "%s: upstream got %v", test.desc, methods)
+		mu.Unlock()
+
+		ts.Close()
+		tsBE.Close()
+	}
+}
+
+func TestHeadLikeGet(t *testing.T) {
+	var (
+		bad  = strings.Repeat("known bad image ", 100)
+		good = strings.Repeat("perfectly good image ", 100)
+	)
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := good
+		if r.URL.Path == "/bad.png" {
+			body = bad
+		}
+		w.Header().Set("Content-Type", "image/png")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer tsBE.Close()
+
+	dir, err := ioutil.TempDir("", "blocklist")
+	checkers.OK(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hashes")
+	sum := sha256.Sum256([]byte(bad))
+	checkers.OK(t, ioutil.WriteFile(path, []byte(fmt.Sprintf("%x\n", sum[:])), 0644))
+	list, err := blocklist.LoadHashes(path)
+	checkers.OK(t, err)
+
+	table := []struct {
+		desc     string
+		path     string
+		wantCode int
+	}{
+		{"generated etag", "/image.png", http.StatusOK},
+		{"blocked", "/bad.png", http.StatusUnavailableForLegalReasons},
+	}
+
+	for _, test := range table {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.BlockedHashes = list },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + test.path} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.GenerateETags = true },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.MaxDimension, p.MaxPixels = 0, 0 },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		head, err := ts.Client().Head(ts.URL + "/sig/url")
+		checkers.OK(t, err)
+		got, _ := ioutil.ReadAll(head.Body)
+		head.Body.Close()
+		checkers.Equals(t, len(got), 0)
+
+		resp := get(t, ts, nil)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		checkers.Assert(t, head.StatusCode == test.wantCode, "%s: got %d want %d", test.desc, head.StatusCode, test.wantCode)
+		checkers.Equals(t, head.StatusCode, resp.StatusCode)
+		checkers.Equals(t, head.Header.Get("ETag"), resp.Header.Get("ETag"))
+		checkers.Equals(t, head.ContentLength, resp.ContentLength)
+		if test.wantCode == http.StatusOK {
+			checkers.Assert(t, head.Header.Get("ETag") != "", "%s: no ETag", test.desc)
+		}
+
+		ts.Close()
+	}
+}
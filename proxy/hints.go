@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bepress/camo/transform"
+)
+
+const (
+	// acceptCH asks browsers for the client hints we use.
+	acceptCH = "Sec-CH-Width, Sec-CH-DPR, Width, DPR"
+
+	// varyCH are the request headers a hinted response depends on.
+	varyCH = "Sec-CH-Width, Width, Sec-CH-DPR, DPR, Save-Data"
+
+	// hintStep rounds hinted widths up so a handful of variants serve
+	// everyone.
+	hintStep = 100
+
+	// saveDataQuality is the most JPEG quality we give clients asking to
+	// save data.
+	saveDataQuality = 50
+)
+
+// hinted narrows opts to what the client hints in h ask for. Only images with
+// a signed width are resized, and never beyond the signed bounds. With
+// Save-Data the client gets a 1x image and lower quality.
+func hinted(opts transform.Options, h http.Header) transform.Options {
+	if opts.Width == 0 {
+		return opts
+	}
+	width := hintInt(h, "Sec-CH-Width", "Width")
+	dpr := hintFloat(h, "Sec-CH-DPR", "DPR")
+	saveData := strings.EqualFold(strings.TrimSpace(h.Get("Save-Data")), "on")
+
+	if saveData && width > 0 && dpr > 1 {
+		width = int(math.Ceil(float64(width) / dpr))
+	}
+	if width > 0 {
+		width = (width + hintStep - 1) / hintStep * hintStep
+	}
+	if width > 0 && width < opts.Width {
+		if opts.Height > 0 {
+			opts.Height = (opts.Height*width + opts.Width - 1) / opts.Width
+		}
+		opts.Width = width
+	}
+	if saveData && (opts.Quality == 0 || opts.Quality > saveDataQuality) {
+		opts.Quality = saveDataQuality
+	}
+	return opts
+}
+
+// hintInt returns the first of the named headers in h holding a positive
+// integer, or 0 if none does.
+func hintInt(h http.Header, names ...string) int {
+	for _, name := range names {
+		if n, err := strconv.Atoi(strings.TrimSpace(h.Get(name))); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// hintFloat returns the first of the named headers in h holding a positive
+// number, or 0 if none does.
+func hintFloat(h http.Header, names ...string) float64 {
+	for _, name := range names {
+		if f, err := strconv.ParseFloat(strings.TrimSpace(h.Get(name)), 64); err == nil && f > 0 && !math.IsInf(f, 0) {
+			return f
+		}
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package proxy_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+func TestClientHints(t *testing.T) {
+	var buf bytes.Buffer
+	checkers.OK(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1000, 500))))
+	src := buf.Bytes()
+
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(src)
+	}))
+	defer tsBE.Close()
+
+	table := []struct {
+		desc      string
+		hints     bool
+		payload   string
+		header    map[string]string
+		wantW     int
+		wantVary  bool
+		wantCache string
+	}{
+		{"no hints", true, "w=800|" + tsBE.URL + "/a.png", nil, 800, true, "MISS"},
+		{"width", true, "w=800|" + tsBE.URL + "/a.png", map[string]string{"Width": "310"}, 400, true, "MISS"},
+		{"same step", true, "w=800|" + tsBE.URL + "/a.png", map[string]string{"Sec-CH-Width": "350"}, 400, true, "HIT"},
+		{"beyond signed width", true, "w=800|" + tsBE.URL + "/a.png", map[string]string{"Sec-CH-Width": "2000"}, 800, true, "HIT"},
+		{"save data", true, "w=800|" + tsBE.URL + "/a.png", map[string]string{"Sec-CH-Width": "600", "Sec-CH-DPR": "2", "Save-Data": "on"}, 300, true, "MISS"},
+		{"not resized", true, tsBE.URL + "/a.png", map[string]string{"Width": "100"}, 1000, false, "MISS"},
+		{"hints off", false, "w=800|" + tsBE.URL + "/b.png", map[string]string{"Width": "100"}, 800, false, "MISS"},
+	}
+
+	c := cache.MustNewMemory(10 * 1024 * 1024)
+	for _, test := range table {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Cache = c },
+			func(p *proxy.Proxy) { p.ClientHints = test.hints },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: test.payload} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		req, err := http.NewRequest("GET", ts.URL+"/sig/url", nil)
+		checkers.OK(t, err)
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+		resp, err := ts.Client().Do(req)
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+
+		checkers.Assert(t, resp.StatusCode == http.StatusOK, "%s: got %d", test.desc, resp.StatusCode)
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+		checkers.OK(t, err)
+		checkers.Assert(t, cfg.Width == test.wantW, "%s: got width %d want %d", test.desc, cfg.Width, test.wantW)
+		checkers.Equals(t, resp.Header.Get("X-Cache"), test.wantCache)
+		checkers.Equals(t, resp.Header.Get("Accept-CH") != "", test.hints)
+		checkers.Equals(t, resp.Header.Get("Vary") != "", test.wantVary)
+
+		ts.Close()
+	}
+}
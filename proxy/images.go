@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bepress/camo/imageutil"
+	"github.com/bepress/camo/strip"
+
+	// Register the formats image.DecodeConfig knows, beyond those the
+	// transform package already brings in.
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// DefaultMaxPixels is the most pixels an image we proxy may have.
+	DefaultMaxPixels = 50 * 1000 * 1000
+
+	// DefaultMaxDimension is the widest or tallest image we proxy.
+	DefaultMaxDimension = 16384
+
+	// sniffLimit is how much of a body we read looking for the image
+	// header. JPEGs can put a lot of metadata ahead of theirs.
+	sniffLimit = 256 * 1024
+)
+
+// ErrTooManyPixels is returned for images bigger than MaxPixels or
+// MaxDimension, however few bytes they take.
+var ErrTooManyPixels = errors.New("image dimensions too large")
+
+// imageMagic are the first bytes of the formats we check, ? matching any
+// byte.
+var imageMagic = []string{
+	"\x89PNG\r\n\x1a\n",
+	"\xff\xd8",
+	"GIF8",
+	"BM",
+	"II*\x00",
+	"MM\x00*",
+	"RIFF????WEBP",
+}
+
+// maxMagic is the longest of imageMagic.
+const maxMagic = 12
+
+// checkImage reads the image header from the start of resp's body and
+// returns ErrTooManyPixels if the image is too big, or if it's an image we
+// know but its header isn't in the first sniffLimit bytes, as then we can't
+// tell. Bodies that aren't an image we know are let through. The body reads
+// from the start afterwards.
+func (p *Proxy) checkImage(resp *http.Response) error {
+	if p.MaxPixels <= 0 && p.MaxDimension <= 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	tee := io.TeeReader(io.LimitReader(resp.Body, sniffLimit), &buf)
+	defer func(body io.ReadCloser) {
+		resp.Body = &replayBody{Reader: io.MultiReader(&buf, body), Closer: body}
+	}(resp.Body)
+
+	// Only wait for as much as it takes to tell it isn't an image, so
+	// anything else streams as it did.
+	magic := make([]byte, maxMagic)
+	for buf.Len() < maxMagic && matchMagic(buf.Bytes(), true) {
+		if _, err := tee.Read(magic[:maxMagic-buf.Len()]); err != nil {
+			break
+		}
+	}
+	if !matchMagic(buf.Bytes(), false) {
+		return nil
+	}
+
+	cfg, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(buf.Bytes()), tee))
+	if err != nil && buf.Len() >= sniffLimit {
+		return fmt.Errorf("%w: no image header in the first %d bytes", ErrTooManyPixels, sniffLimit)
+	}
+	if err != nil {
+		// Too short or broken to be decoded, so no danger.
+		return nil
+	}
+	if p.MaxDimension > 0 && (cfg.Width > p.MaxDimension || cfg.Height > p.MaxDimension) {
+		return fmt.Errorf("%w: %dx%d", ErrTooManyPixels, cfg.Width, cfg.Height)
+	}
+	if p.MaxPixels > 0 && int64(cfg.Width)*int64(cfg.Height) > p.MaxPixels {
+		return fmt.Errorf("%w: %dx%d", ErrTooManyPixels, cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+// matchMagic tells us if b starts with one of imageMagic or, if partial is
+// set, could once there is more of it.
+func matchMagic(b []byte, partial bool) bool {
+	for _, m := range imageMagic {
+		if len(b) < len(m) && !partial {
+			continue
+		}
+		if imageutil.PrefixMatches(b, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// replayBody is a body with the bytes we sniffed put back in front.
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// decompress decodes a gzip or deflate Content-Encoding so we can look at the
+// image and so what a small body expands to is held to MaxSize. The response
+// goes out without the encoding.
+func (p *Proxy) decompress(resp *http.Response) error {
+	var (
+		zr  io.Reader
+		err error
+	)
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		zr, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		zr = flate.NewReader(resp.Body)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	resp.Body = &replayBody{Reader: &maxReader{r: zr, n: p.MaxSize}, Closer: resp.Body}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	weakenETag(resp.Header)
+	return nil
+}
+
+// stripMetadata removes EXIF, XMP, IPTC and comments from the image in resp's
+// body as it streams, see package strip.
+func (p *Proxy) stripMetadata(resp *http.Response) {
+	resp.Body = &replayBody{
+		Reader: strip.NewReader(&maxReader{r: resp.Body, n: p.MaxSize}, p.KeepOrientation),
+		Closer: resp.Body,
+	}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	weakenETag(resp.Header)
+}
+
+// weakenETag makes a strong ETag in h weak, for when the body we send isn't
+// byte for byte upstream's.
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+// maxReader reads from r, returning ErrTooLarge once more than n bytes have
+// come through. err is the first error reading, other than io.EOF.
+type maxReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+// Read implements io.Reader.
+func (m *maxReader) Read(b []byte) (int, error) {
+	n, err := m.r.Read(b)
+	m.n -= int64(n)
+	if m.n < 0 {
+		err = ErrTooLarge
+	}
+	if err != nil && err != io.EOF && m.err == nil {
+		m.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,216 @@
+package proxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+func TestImageLimits(t *testing.T) {
+	var small bytes.Buffer
+	checkers.OK(t, png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 10, 10))))
+
+	table := []struct {
+		desc     string
+		body     []byte
+		gzipped  bool
+		wantCode int // 0 if the response is aborted
+		wantBody []byte
+	}{
+		{"small image", small.Bytes(), false, http.StatusOK, small.Bytes()},
+		{"not an image", []byte("just some text"), false, http.StatusOK, []byte("just some text")},
+		{"too many pixels", pngHeader(50000, 50000), false, http.StatusRequestEntityTooLarge, nil},
+		{"too wide", pngHeader(20000, 1), false, http.StatusRequestEntityTooLarge, nil},
+		{"header past the sniff limit", jpegHeader(60000, 60000, 300*1024), false, http.StatusRequestEntityTooLarge, nil},
+		{"gzipped image", small.Bytes(), true, http.StatusOK, small.Bytes()},
+		{"gzipped too many pixels", pngHeader(50000, 50000), true, http.StatusRequestEntityTooLarge, nil},
+		{"gzip bomb", make([]byte, 64*1024), true, 0, nil},
+	}
+
+	for _, test := range table {
+		body := test.body
+		if test.gzipped {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(body)
+			zw.Close()
+			body = buf.Bytes()
+		}
+		tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.gzipped {
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+			w.Write(body)
+		}))
+
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.MaxSize = 16 * 1024 },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + "/image.png"} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		before := upstreamErrorCount(proxy.ClassTooManyPixels)
+		code, got, err := getAll(ts)
+		switch test.wantCode {
+		case 0:
+			checkers.Assert(t, err != nil, "%s: response was not aborted", test.desc)
+		case http.StatusOK:
+			checkers.OK(t, err)
+			checkers.Assert(t, code == test.wantCode, "%s: got %d want %d", test.desc, code, test.wantCode)
+			checkers.Assert(t, bytes.Equal(got, test.wantBody), "%s: got %q", test.desc, got)
+		default:
+			checkers.OK(t, err)
+			checkers.Assert(t, code == test.wantCode, "%s: got %d want %d", test.desc, code, test.wantCode)
+			checkers.Equals(t, upstreamErrorCount(proxy.ClassTooManyPixels), before+1)
+		}
+		if test.wantCode != 0 {
+			// HEAD agrees.
+			resp, err := ts.Client().Head(ts.URL + "/sig/url")
+			checkers.OK(t, err)
+			resp.Body.Close()
+			checkers.Assert(t, resp.StatusCode == test.wantCode, "%s: HEAD got %d want %d", test.desc, resp.StatusCode, test.wantCode)
+		}
+
+		ts.Close()
+		tsBE.Close()
+	}
+}
+
+func TestGzipDecoded(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("hello"))
+	zw.Close()
+
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"gzipped"`)
+		w.Write(buf.Bytes())
+	}))
+	defer tsBE.Close()
+
+	tut := proxy.MustNew([]byte("test"),
+		zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + "/image.png"} },
+		func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+		func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+		func(p *proxy.Proxy) { p.CheckUnicast = false },
+	)
+	ts := httptest.NewTLSServer(rxid.Handler(tut))
+	defer ts.Close()
+
+	resp := get(t, ts, http.Header{"Accept-Encoding": {"gzip"}})
+	body, err := ioutil.ReadAll(resp.Body)
+	checkers.OK(t, err)
+	resp.Body.Close()
+	checkers.Equals(t, resp.Header.Get("Content-Encoding"), "")
+	checkers.Equals(t, resp.Header.Get("ETag"), `W/"gzipped"`)
+	checkers.Equals(t, string(body), "hello")
+}
+
+func TestStripMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	checkers.OK(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))))
+	src := buf.Bytes()
+
+	// A comment after IHDR, which is 8+25 bytes in.
+	text := []byte("tEXtComment\x00GPS 51.5N 0.1W")
+	var img bytes.Buffer
+	img.Write(src[:33])
+	binary.Write(&img, binary.BigEndian, uint32(len(text)-4))
+	img.Write(text)
+	binary.Write(&img, binary.BigEndian, crc32.ChecksumIEEE(text))
+	img.Write(src[33:])
+
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"original"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(img.Bytes()))
+	}))
+	defer tsBE.Close()
+
+	tut := proxy.MustNew([]byte("test"),
+		zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.StripMetadata = true },
+		func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + "/image.png"} },
+		func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+		func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+		func(p *proxy.Proxy) { p.CheckUnicast = false },
+	)
+	ts := httptest.NewTLSServer(rxid.Handler(tut))
+	defer ts.Close()
+
+	// Ranges of the original make no sense once it's stripped.
+	resp := get(t, ts, http.Header{"Range": {"bytes=0-9"}})
+	body, err := ioutil.ReadAll(resp.Body)
+	checkers.OK(t, err)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusOK)
+	checkers.Equals(t, resp.Header.Get("ETag"), `W/"original"`)
+	checkers.Equals(t, len(body), len(src))
+	checkers.Assert(t, !bytes.Contains(body, []byte("GPS")), "metadata left in")
+	_, err = png.Decode(bytes.NewReader(body))
+	checkers.OK(t, err)
+}
+
+// jpegHeader returns the start of a JPEG claiming to be w by h with at least
+// pad bytes of comments ahead of the frame header.
+func jpegHeader(w, h uint16, pad int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\xff\xd8")
+	for n := 0; n < pad; n += 0xffff {
+		buf.WriteString("\xff\xfe\xff\xff")
+		buf.Write(make([]byte, 0xffff-2))
+	}
+	buf.WriteString("\xff\xc0\x00\x0b\x08")
+	binary.Write(&buf, binary.BigEndian, h)
+	binary.Write(&buf, binary.BigEndian, w)
+	buf.WriteString("\x01\x01\x11\x00")
+	return buf.Bytes()
+}
+
+// commentedJPEG returns a small JPEG with comment in a COM segment after the
+// SOI.
+func commentedJPEG(t *testing.T, comment string) []byte {
+	var buf bytes.Buffer
+	checkers.OK(t, jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 10, 10)), nil))
+	com := []byte{0xff, 0xd8, 0xff, 0xfe, 0, 0}
+	binary.BigEndian.PutUint16(com[4:], uint16(len(comment)+2))
+	return append(append(com, comment...), buf.Bytes()[2:]...)
+}
+
+// pngHeader returns the start of a PNG claiming to be w by h.
+func pngHeader(w, h uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], w)
+	binary.BigEndian.PutUint32(ihdr[8:], h)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 6 // RGBA
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(13))
+	buf.Write(ihdr)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return buf.Bytes()
+}
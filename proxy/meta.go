@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/logging"
+	"github.com/bepress/camo/meta"
+	"github.com/bepress/camo/rxid"
+)
+
+// metaPrefix is the path prefix of the image metadata endpoint,
+// /meta/<sig>/<url>.
+const metaPrefix = "/meta/"
+
+// metaKey is the cache key for the metadata of u.
+func metaKey(u *url.URL) string {
+	return "meta|" + u.String()
+}
+
+// serveMeta answers /meta/<sig>/<url> with JSON describing the image, see
+// meta.Info. Transform options in the signed URL are ignored as it's the
+// upstream image we describe. Bodies that aren't an image are refused once
+// we've read enough to tell. The answer is cached as the image would be.
+func (p *Proxy) serveMeta(w http.ResponseWriter, r *http.Request) {
+	xid := rxid.FromContext(r.Context())
+
+	sig, encodedURL, err := p.splitComponents(strings.TrimPrefix(r.URL.Path, "/meta"))
+	if err != nil {
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, u, ok := p.target(w, r, sig, encodedURL)
+	if !ok {
+		return
+	}
+
+	var cached *cache.Entry
+	if p.Cache != nil {
+		cached, _ = p.Cache.Get(p.entryKey(metaKey(u), r.Header))
+		w.Header().Set("X-Cache", "MISS")
+	}
+	if p.blocked(u, cached) {
+		p.fail(w, r, ClassBlocked, ErrBlocked, p.BlockedMessage, nil)
+		return
+	}
+	if cached != nil && cached.Fresh(time.Now()) {
+		w.Header().Set("X-Cache", "HIT")
+		p.serveEntry(w, r, cached)
+		return
+	}
+
+	outreq, err := p.buildRequest(u, w, r)
+	if err != nil {
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	outreq.Method = "GET"
+	stripConditionals(outreq.Header)
+	// Leave it to the transport to ask for and decode what we can read.
+	outreq.Header.Del("Accept-Encoding")
+
+	resp, attempts, err := p.fetch(outreq)
+	if err != nil {
+		p.fail(w, r, Classify(err), err, fmt.Sprintf("error processing request: %q", err), resp)
+		return
+	}
+	defer resp.Body.Close()
+
+	p.logger.Info().
+		Str("type", "info").
+		Str("request_id", xid).
+		Str("endpoint", "meta").
+		Str("upstream_domain", outreq.Host).
+		Int("upstream_response", resp.StatusCode).
+		Int("attempts", attempts).
+		Str("upstream_path", outreq.URL.Path).
+		Strs("redirect_chain", redirectChain(resp)).
+		Str("content_type", resp.Header.Get("Content-Type")).
+		Int64("content_length", resp.ContentLength).Msg("")
+
+	switch {
+	case resp.StatusCode >= 500:
+		p.writeError(w, r, ReasonError, http.StatusBadGateway, "Error Fetching Resource: "+resp.Status)
+		return
+	case resp.StatusCode != http.StatusOK:
+		p.writeError(w, r, ReasonNotFound, http.StatusNotFound, "Unable to find suitable content")
+		return
+	case resp.ContentLength > p.MaxSize:
+		p.fail(w, r, ClassTooLarge, ErrTooLarge, "Payload too large", resp)
+		return
+	}
+	sums := p.hashBody(resp)
+	if err := p.decompress(resp); err != nil {
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+		p.writeError(w, r, ReasonError, http.StatusBadGateway, "Invalid Content-Encoding from upstream: "+err.Error())
+		return
+	}
+	sums.decompressed(resp)
+	if err := p.checkImage(resp); err != nil {
+		p.fail(w, r, ClassTooManyPixels, err, "Image too large", resp)
+		return
+	}
+
+	// The header tells us if it's an image without reading the rest.
+	var head bytes.Buffer
+	if _, _, err := image.DecodeConfig(io.TeeReader(io.LimitReader(resp.Body, sniffLimit), &head)); err != nil {
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+		http.Error(w, "Not an image we can describe", http.StatusUnsupportedMediaType)
+		return
+	}
+	resp.Body = &replayBody{Reader: io.MultiReader(&head, resp.Body), Closer: resp.Body}
+	body, sum, ok := p.readBody(w, r, u, resp, sums, p.MaxSize)
+	if !ok {
+		return
+	}
+	info, err := meta.Of(body)
+	if err != nil {
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+		http.Error(w, "Not an image we can describe", http.StatusUnsupportedMediaType)
+		return
+	}
+	js, err := json.Marshal(info)
+	if err != nil {
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e := p.newEntry(u, resp, js, true)
+	e.Header.Set("Content-Type", "application/json")
+	e.Header.Set("Access-Control-Allow-Origin", "*")
+	e.Sum = sum
+	p.store(metaKey(u), r.Header, e)
+	p.serveEntry(w, r, e)
+}
@@ -0,0 +1,87 @@
+package proxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/meta"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+func TestMeta(t *testing.T) {
+	var buf bytes.Buffer
+	checkers.OK(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200))))
+	src := buf.Bytes()
+
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/text.png":
+			w.Write([]byte("<html>not an image</html>"))
+		case "/missing.png":
+			http.NotFound(w, r)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write(src)
+		}
+	}))
+	defer tsBE.Close()
+
+	table := []struct {
+		desc      string
+		payload   string
+		wantCode  int
+		wantCache string
+	}{
+		{"image", tsBE.URL + "/image.png", http.StatusOK, "MISS"},
+		{"cached", tsBE.URL + "/image.png", http.StatusOK, "HIT"},
+		{"transform options ignored", "w=10|" + tsBE.URL + "/image.png", http.StatusOK, "HIT"},
+		{"not an image", tsBE.URL + "/text.png", http.StatusUnsupportedMediaType, "MISS"},
+		{"missing", tsBE.URL + "/missing.png", http.StatusNotFound, "MISS"},
+	}
+
+	c := cache.MustNewMemory(1024 * 1024)
+	for _, test := range table {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Cache = c },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: test.payload} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		resp, err := ts.Client().Get(ts.URL + "/meta/sig/url")
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+
+		checkers.Assert(t, resp.StatusCode == test.wantCode, "%s: got %d want %d", test.desc, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, resp.Header.Get("X-Cache"), test.wantCache)
+		if test.wantCode == http.StatusOK {
+			checkers.Equals(t, resp.Header.Get("Content-Type"), "application/json")
+			var info meta.Info
+			checkers.OK(t, json.Unmarshal(body, &info))
+			checkers.Equals(t, info.ContentType, "image/png")
+			checkers.Equals(t, info.Size, int64(len(src)))
+			checkers.Assert(t, info.Width == 300 && info.Height == 200, "%s: got %dx%d", test.desc, info.Width, info.Height)
+			checkers.Equals(t, info.Frames, 1)
+		}
+
+		ts.Close()
+	}
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Placeholder reasons. They key Proxy.Placeholders and are sent in the
+// X-Camo-Error header.
+const (
+	ReasonNotFound = "not_found"
+	ReasonBlocked  = "blocked"
+	ReasonTooLarge = "too_large"
+	ReasonError    = "error"
+
+	// ReasonDefault is the placeholder used for a reason without its own.
+	ReasonDefault = "default"
+)
+
+// Placeholder is an image served in place of one we couldn't fetch.
+type Placeholder struct {
+	ContentType string
+	Body        []byte
+}
+
+// LoadPlaceholders reads the placeholder images in dir. Each file is keyed by
+// its name without the extension, e.g. not_found.png or default.svg.
+func LoadPlaceholders(dir string) (map[string]*Placeholder, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	placeholders := make(map[string]*Placeholder, len(files))
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		body, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ext := filepath.Ext(fi.Name())
+		ct := mime.TypeByExtension(ext)
+		if ct == "" {
+			ct = http.DetectContentType(body)
+		}
+		if !strings.HasPrefix(ct, "image/") {
+			return nil, fmt.Errorf("placeholder %s is not an image: %s", fi.Name(), ct)
+		}
+		placeholders[strings.TrimSuffix(fi.Name(), ext)] = &Placeholder{ContentType: ct, Body: body}
+	}
+	return placeholders, nil
+}
+
+// reason is the placeholder reason for the class.
+func (c ErrorClass) reason() string {
+	switch c {
+	case ClassFiltered, ClassBlocked, ClassTakenDown:
+		return ReasonBlocked
+	case ClassTooLarge, ClassTooManyPixels:
+		return ReasonTooLarge
+	default:
+		return ReasonError
+	}
+}
+
+// writeError answers with msg and code, or with the placeholder for reason if
+// the client would rather have an image. Either way the X-Camo-Error header
+// says why.
+func (p *Proxy) writeError(w http.ResponseWriter, r *http.Request, reason string, code int, msg string) {
+	w.Header().Set("X-Camo-Error", reason)
+
+	ph := p.Placeholders[reason]
+	if ph == nil {
+		ph = p.Placeholders[ReasonDefault]
+	}
+	if ph == nil || !prefersImage(r.Header.Get("Accept")) {
+		http.Error(w, msg, code)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", ph.ContentType)
+	h.Set("Content-Length", strconv.Itoa(len(ph.Body)))
+	h.Set("X-Content-Type-Options", "nosniff")
+	// The failure may be temporary so don't let anyone keep the stand in.
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if r.Method != "HEAD" {
+		w.Write(ph.Body)
+	}
+}
+
+// prefersImage reports whether an Accept header ranks some image type above
+// everything else. Wildcards other than image/* don't count either way.
+func prefersImage(accept string) bool {
+	var imageQ, otherQ float64
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		media := strings.ToLower(strings.TrimSpace(params[0]))
+		if media == "" || media == "*/*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if strings.HasPrefix(media, "image/") {
+			if q > imageQ {
+				imageQ = q
+			}
+		} else if q > otherQ {
+			otherQ = q
+		}
+	}
+	return imageQ > otherQ
+}
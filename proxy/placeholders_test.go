@@ -0,0 +1,118 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	imgAccept  = "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"
+	pageAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8"
+)
+
+func TestPlaceholders(t *testing.T) {
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.png":
+			http.NotFound(w, r)
+		case "/broken.png":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/large.png":
+			w.Write([]byte(strings.Repeat("x", 32)))
+		}
+	}))
+	defer tsBE.Close()
+
+	placeholders := map[string]*proxy.Placeholder{
+		proxy.ReasonNotFound: {ContentType: "image/png", Body: []byte("not found png")},
+		proxy.ReasonTooLarge: {ContentType: "image/png", Body: []byte("too large png")},
+		proxy.ReasonBlocked:  {ContentType: "image/svg+xml", Body: []byte("<svg/>")},
+		proxy.ReasonDefault:  {ContentType: "image/gif", Body: []byte("default gif")},
+	}
+
+	table := []struct {
+		desc       string
+		url        string
+		ip         string
+		method     string
+		accept     string
+		wantCode   int
+		wantReason string
+		wantType   string
+		wantBody   string
+	}{
+		{"not found", tsBE.URL + "/missing.png", "127.0.0.1", "GET", imgAccept, http.StatusNotFound, proxy.ReasonNotFound, "image/png", "not found png"},
+		{"not found head", tsBE.URL + "/missing.png", "127.0.0.1", "HEAD", imgAccept, http.StatusNotFound, proxy.ReasonNotFound, "image/png", ""},
+		{"not found page", tsBE.URL + "/missing.png", "127.0.0.1", "GET", pageAccept, http.StatusNotFound, proxy.ReasonNotFound, "text/plain; charset=utf-8", "Unable to find suitable content\n"},
+		{"not found no accept", tsBE.URL + "/missing.png", "127.0.0.1", "GET", "", http.StatusNotFound, proxy.ReasonNotFound, "text/plain; charset=utf-8", "Unable to find suitable content\n"},
+		{"image with low q", tsBE.URL + "/missing.png", "127.0.0.1", "GET", "image/png;q=0.5,text/plain", http.StatusNotFound, proxy.ReasonNotFound, "text/plain; charset=utf-8", "Unable to find suitable content\n"},
+		{"upstream error uses default", tsBE.URL + "/broken.png", "127.0.0.1", "GET", imgAccept, http.StatusBadGateway, proxy.ReasonError, "image/gif", "default gif"},
+		{"too large", tsBE.URL + "/large.png", "127.0.0.1", "GET", imgAccept, http.StatusRequestEntityTooLarge, proxy.ReasonTooLarge, "image/png", "too large png"},
+		{"blocked", "http://internal.example.com/image.png", "10.0.0.1", "GET", imgAccept, http.StatusBadRequest, proxy.ReasonBlocked, "image/svg+xml", "<svg/>"},
+	}
+
+	for _, test := range table {
+		resolver := DummyResolver{ips: []net.IP{net.ParseIP(test.ip)}}
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Placeholders = placeholders },
+			func(p *proxy.Proxy) { p.MaxSize = 24 },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: test.url} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{"10.0.0.0/8"}) },
+			func(p *proxy.Proxy) { p.LookupIP = resolver.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		req, err := http.NewRequest(test.method, ts.URL+"/sig/url", nil)
+		checkers.OK(t, err)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		resp, err := ts.Client().Do(req)
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+
+		checkers.Equals(t, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, resp.Header.Get("X-Camo-Error"), test.wantReason)
+		checkers.Equals(t, resp.Header.Get("Content-Type"), test.wantType)
+		checkers.Equals(t, string(body), test.wantBody)
+
+		ts.Close()
+	}
+}
+
+func TestLoadPlaceholders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "placeholders")
+	checkers.OK(t, err)
+	defer os.RemoveAll(dir)
+
+	gif := []byte("GIF89a\x01\x00\x01\x00")
+	checkers.OK(t, ioutil.WriteFile(filepath.Join(dir, "not_found.png"), []byte("png"), 0644))
+	checkers.OK(t, ioutil.WriteFile(filepath.Join(dir, "default"), gif, 0644))
+
+	got, err := proxy.LoadPlaceholders(dir)
+	checkers.OK(t, err)
+	checkers.Equals(t, len(got), 2)
+	checkers.Equals(t, got[proxy.ReasonNotFound].ContentType, "image/png")
+	checkers.Equals(t, got[proxy.ReasonDefault].ContentType, "image/gif")
+	checkers.Equals(t, got[proxy.ReasonDefault].Body, gif)
+
+	checkers.OK(t, ioutil.WriteFile(filepath.Join(dir, "blocked.txt"), []byte("nope"), 0644))
+	_, err = proxy.LoadPlaceholders(dir)
+	checkers.Assert(t, err != nil, "expected an error for a placeholder that isn't an image")
+}
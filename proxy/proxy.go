@@ -9,14 +9,19 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/breaker"
+	"github.com/bepress/camo/cache"
 	"github.com/bepress/camo/decoder"
 	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/inflight"
+	"github.com/bepress/camo/logging"
 	"github.com/bepress/camo/rxid"
+	"github.com/bepress/camo/transform"
 	"github.com/reedobrien/rbp"
 	"github.com/rs/zerolog"
 )
@@ -28,9 +33,24 @@ const (
 	// DefaultMaxRedirects is the maximum # of redirects we'll follow.
 	DefaultMaxRedirects = 10
 
-	// DefaultRequestTimeout is the request timeout for the client.
+	// DefaultRequestTimeout is how long we wait for upstream response
+	// headers, retries included.
 	DefaultRequestTimeout = 4 * time.Second
 
+	// DefaultConnectTimeout is how long we wait to connect upstream.
+	DefaultConnectTimeout = 3 * time.Second
+
+	// DefaultTLSTimeout is how long we wait for the upstream TLS handshake.
+	DefaultTLSTimeout = 3 * time.Second
+
+	// DefaultHeaderTimeout is how long we wait for the first byte of an
+	// upstream response once the request is sent.
+	DefaultHeaderTimeout = 3 * time.Second
+
+	// DefaultStallTimeout is how long an upstream body may go without
+	// sending anything.
+	DefaultStallTimeout = 5 * time.Second
+
 	// DefaultServerName is a name to set our client and Via header to.
 	DefaultServerName = "bepress/camo"
 
@@ -52,17 +72,27 @@ func MustNew(hmacKey []byte, logger zerolog.Logger, options ...func(*Proxy)) *Pr
 	}
 
 	p := &Proxy{
+		BlockedMessage:      DefaultBlockedMessage,
 		BufferPool:          rbp.NewBufferPool(),
+		CacheTTL:            DefaultCacheTTL,
 		CheckUnicast:        true,
 		Decoder:             decoder.MustNew(hmacKey),
+		ConnectTimeout:      DefaultConnectTimeout,
 		DisableKeepAlivesBE: DefaultKABE,
 		DisableKeepAlivesFE: DefaultKAFE,
 		Filter:              filter.MustNewCIDR(FilteredIPNetworks),
+		HeaderTimeout:       DefaultHeaderTimeout,
 		LookupIP:            net.LookupIP,
+		MaxDimension:        DefaultMaxDimension,
+		MaxPixels:           DefaultMaxPixels,
 		MaxRedirects:        DefaultMaxRedirects,
+		MaxSVGSize:          DefaultMaxSVGSize,
 		MaxSize:             DefaultMaxSize,
 		RequestTimeout:      DefaultRequestTimeout,
+		Retry:               DefaultRetryPolicy,
 		ServerName:          DefaultServerName,
+		StallTimeout:        DefaultStallTimeout,
+		TLSTimeout:          DefaultTLSTimeout,
 
 		logger: logger,
 	}
@@ -71,17 +101,23 @@ func MustNew(hmacKey []byte, logger zerolog.Logger, options ...func(*Proxy)) *Pr
 		opt(p)
 	}
 
+	switch p.SanitizeFormat {
+	case "", transform.FormatJPEG, transform.FormatPNG, transform.FormatGIF:
+	default:
+		panic("unknown SanitizeFormat: " + p.SanitizeFormat)
+	}
+
 	if p.Transport == nil {
 
 		p.Transport = &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 			DialContext: (&net.Dialer{
-				Timeout:   3 * time.Second,
+				Timeout:   p.ConnectTimeout,
 				KeepAlive: 30 * time.Second}).DialContext,
 			// Timeouts
 			ExpectContinueTimeout: 1 * time.Second,
-			ResponseHeaderTimeout: 10 * time.Second,
-			TLSHandshakeTimeout:   3 * time.Second,
+			ResponseHeaderTimeout: p.HeaderTimeout,
+			TLSHandshakeTimeout:   p.TLSTimeout,
 			IdleConnTimeout:       30 * time.Second,
 
 			MaxIdleConns:        300,
@@ -90,9 +126,10 @@ func MustNew(hmacKey []byte, logger zerolog.Logger, options ...func(*Proxy)) *Pr
 		}
 	}
 
+	// There's no overall timeout so large bodies can take as long as they
+	// need. See fetch.
 	p.client = &http.Client{
 		Transport: p.Transport,
-		Timeout:   p.RequestTimeout,
 	}
 	if p.RedirFunc == nil {
 		p.RedirFunc = p.checkRedirect
@@ -102,39 +139,57 @@ func MustNew(hmacKey []byte, logger zerolog.Logger, options ...func(*Proxy)) *Pr
 	return p
 }
 
-// CheckRedirect implments the redirect manager for http.Client
-func (p *Proxy) checkRedirect(r *http.Request, via []*http.Request) error {
-	if err := p.validateTarget(r.URL); err != nil {
-		p.logger.Error().Err(err).Str("request_id", rxid.FromContext(r.Context())).Msg(errDetails())
-		return ErrFilteredAddress
-	}
-
-	if len(via) >= p.MaxRedirects {
-		return fmt.Errorf("stopped after %d redirects", p.MaxRedirects)
-	}
-	return nil
-
-}
-
 // ResolverFunc is the net.LookupIP signature so we can fake it in tests.
 type ResolverFunc func(string) ([]net.IP, error)
 
 // Proxy implements the handler for proxying assets.
+//
+// Upstream bodies are checked against BlockedHashes as they stream. The first
+// time a streamed body turns out to be blocked the client has had the headers
+// and all but its last byte when the response is aborted; from then on, for
+// CacheTTL, the URL is refused with a 451 up front. Bodies we buffer anyway,
+// to transform, sanitize or give an ETag, are refused with a 451 the first
+// time too.
 type Proxy struct {
-	BufferPool     httputil.BufferPool
-	CheckUnicast   bool
-	Decoder        decoder.Decoder
-	Filter         *filter.CIDRFilter
-	FlushInterval  time.Duration
-	LookupIP       ResolverFunc
-	MaxRedirects   int
-	MaxSize        int64
-	RedirFunc      func(*http.Request, []*http.Request) error
-	RequestTimeout time.Duration
-	ServerName     string
-	Transport      http.RoundTripper
-	client         *http.Client
-	logger         zerolog.Logger
+	BlockedHashes   *blocklist.Hashes
+	BlockedMessage  string
+	BlockedURLs     *blocklist.URLs
+	Breakers        *breaker.Set
+	BufferPool      httputil.BufferPool
+	Cache           cache.Cache
+	CacheTTL        time.Duration
+	CheckUnicast    bool
+	ClientHints     bool
+	ConnectTimeout  time.Duration
+	Decoder         decoder.Decoder
+	Filter          *filter.CIDRFilter
+	FlushInterval   time.Duration
+	GenerateETags   bool
+	HeaderTimeout   time.Duration
+	Inflight        *inflight.Limiter
+	KeepOrientation bool
+	LookupIP        ResolverFunc
+	MaxDimension    int
+	MaxPixels       int64
+	MaxRedirects    int
+	MaxSVGSize      int64
+	MaxSize         int64
+	MinRate         int64
+	Placeholders    map[string]*Placeholder
+	RedirFunc       func(*http.Request, []*http.Request) error
+	RefuseDowngrade bool
+	RequestTimeout  time.Duration
+	Retry           RetryPolicy
+	Sanitize        bool
+	SanitizeFormat  string
+	SanitizeHosts   []string
+	ServerName      string
+	StallTimeout    time.Duration
+	StripMetadata   bool
+	TLSTimeout      time.Duration
+	Transport       http.RoundTripper
+	client          *http.Client
+	logger          zerolog.Logger
 
 	// TODO(ro) 2017-10-02 Do we really care?
 	DisableKeepAlivesBE bool
@@ -158,6 +213,11 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if strings.HasPrefix(r.URL.Path, metaPrefix) {
+		p.serveMeta(w, r)
+		return
+	}
+
 	// Split path and get components.
 	sig, encodedURL, err := p.splitComponents(r.URL.Path)
 	if err != nil {
@@ -172,61 +232,105 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Write(bepressFavicon)
 			return
 		}
-		p.logger.Error().Err(err).Str("request_id", xid).Msg(errDetails())
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// Decode the URL.
-	uStr, err := p.Decoder.Decode(sig, encodedURL)
-	if err != nil {
-		p.logger.Error().Err(err).Str("request_id", xid).Msg(errDetails())
-		http.Error(w, err.Error(), http.StatusForbidden)
+	opts, u, ok := p.target(w, r, sig, encodedURL)
+	if !ok {
 		return
 	}
+	if p.sanitize(u) {
+		opts.Sanitize = true
+		if opts.Format == "" {
+			opts.Format = p.SanitizeFormat
+		}
+	}
+	if p.ClientHints {
+		w.Header().Set("Accept-CH", acceptCH)
+		if opts.Width > 0 {
+			w.Header().Add("Vary", varyCH)
+			opts = hinted(opts, r.Header)
+		}
+	}
 
-	u, err := url.Parse(uStr)
-	if err != nil {
-		p.logger.Error().Err(err).Str("request_id", xid).Msg(errDetails())
-		http.Error(w, "Invalid downstream URL: "+err.Error(), http.StatusForbidden)
+	// Serve fresh responses from the cache. Stale ones are kept so we can
+	// revalidate them.
+	cached, fresh := p.lookup(u, opts, r.Header)
+	if p.blocked(u, cached) {
+		p.fail(w, r, ClassBlocked, ErrBlocked, p.BlockedMessage, nil)
 		return
 	}
-
-	// Validate the target host
-	if err = p.validateTarget(u); err != nil {
-		p.logger.Error().Err(err).Str("request_id", xid).Msg(errDetails())
-		http.Error(w, "invalid host: "+err.Error(), http.StatusBadRequest)
+	if fresh {
+		p.logger.Info().
+			Str("type", "info").
+			Str("request_id", xid).
+			Str("cache", "hit").
+			Str("upstream_domain", u.Host).
+			Str("upstream_path", u.Path).Msg("")
+		w.Header().Set("X-Cache", "HIT")
+		p.serveEntry(w, r, cached)
 		return
 	}
 
+	if r.Method == "HEAD" && p.headAsGet(opts) {
+		// What we'd send for a GET depends on its body, so we answer
+		// the GET; net/http drops the body of a HEAD but still sizes it.
+		r = r.Clone(r.Context())
+		r.Method = "GET"
+	}
+
 	// Build the request for downstream.
 	outreq, err := p.buildRequest(u, w, r)
 	if err != nil {
-		p.logger.Error().Err(err).Str("request_id", xid).Msg(errDetails())
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !opts.IsZero() {
+		// We transform the whole image. Ranges and conditionals are answered
+		// from the result.
+		outreq.Method = "GET"
+		stripConditionals(outreq.Header)
+	}
+	if outreq.Method == "HEAD" {
+		// A GET is decoded, see decompress, so this is what it would
+		// look like.
+		outreq.Header.Set("Accept-Encoding", "identity")
+	}
+	if p.StripMetadata || p.BlockedHashes != nil {
+		// Ranges of the original don't line up with the stripped image,
+		// and we need the whole body to check it against BlockedHashes.
+		outreq.Header.Del("Range")
+		outreq.Header.Del("If-Range")
+	}
+	if cached != nil {
+		revalidate(outreq, cached)
+	}
 
-	// Perform the request.
-	resp, err := p.client.Do(outreq)
+	// Perform the request. We have to classify filtered addresses here too
+	// as we check in our client's CheckRedirect function which we can't know
+	// before following the redirects.
+	fetch := p.fetch
+	if outreq.Method == "HEAD" {
+		fetch = p.fetchHead
+	}
+	resp, attempts, err := fetch(outreq)
 	if err != nil {
-		var code = http.StatusInternalServerError
-		// We have to check for ErrFilteredAddress here as we check in our
-		// client's CheckRedirect function which we can't know before
-		// following the redirects. This is called when we do the upstream
-		// request.
-		if nerr, ok := err.(*url.Error); ok {
-			if nerr.Err == ErrFilteredAddress {
-				code = http.StatusBadRequest
-			}
-			if strings.HasSuffix(nerr.Err.Error(), "i/o timeout") {
-				// The actual error here is poll.TimeoutErr. Poll is an
-				// internal library so we cannot import it. Therefore we do
-				// this gross string checking here.
-				code = http.StatusGatewayTimeout
-			}
+		if cached != nil && (errors.Is(err, breaker.ErrOpen) || errors.Is(err, inflight.ErrHostLimit)) {
+			// Stale is better than nothing while upstream is down or busy.
+			p.logger.Info().
+				Str("type", "info").
+				Str("request_id", xid).
+				Str("cache", "stale").
+				Str("upstream_domain", u.Host).
+				Str("upstream_path", u.Path).Msg("")
+			w.Header().Set("X-Cache", "STALE")
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+			p.serveEntry(w, r, cached)
+			return
 		}
-		p.logger.Error().Err(err).Str("request_id", xid).Msg(errDetails())
-		http.Error(w, fmt.Sprintf("error processing request: %q", err), code)
+		p.fail(w, r, Classify(err), err, fmt.Sprintf("error processing request: %q", err), resp)
 		return
 	}
 
@@ -236,49 +340,161 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Str("request_id", xid).
 		Str("upstream_domain", outreq.Host).
 		Int("upstream_response", resp.StatusCode).
+		Int("attempts", attempts).
+		Str("transform", opts.String()).
 		Str("upstream_path", outreq.URL.Path).
+		Strs("redirect_chain", redirectChain(resp)).
 		Str("content_type", resp.Header.Get("Content-Type")).
 		Int64("content_length", resp.ContentLength).Msg("")
 
 	defer resp.Body.Close()
 
-	if resp.ContentLength > p.MaxSize {
-		http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		w.Header().Set("X-Cache", "REVALIDATED")
+		p.serveEntry(w, r, p.refresh(u, opts, r.Header, cached, resp))
 		return
 	}
 
+	// For partial content the size limit applies to the whole resource, not
+	// just the range we got. Animations we only want the start of are let
+	// through, see writeTransformed.
+	size := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		cr, err := validatePartial(outreq, resp)
+		if err != nil {
+			p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+			p.writeError(w, r, ReasonError, http.StatusBadGateway, "Invalid partial content from upstream: "+err.Error())
+			return
+		}
+		size = cr.total
+		if size == -1 {
+			size = cr.end + 1
+		}
+	}
+	if size > p.MaxSize && !opts.Partial() {
+		p.fail(w, r, ClassTooLarge, ErrTooLarge, "Payload too large", resp)
+		return
+	}
+
+	// Look at what the image will take to display, not just its size on the
+	// wire.
+	var sums *bodySums
+	if resp.StatusCode == http.StatusOK && outreq.Method == "GET" {
+		sums = p.hashBody(resp)
+		if err := p.decompress(resp); err != nil {
+			p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+			p.writeError(w, r, ReasonError, http.StatusBadGateway, "Invalid Content-Encoding from upstream: "+err.Error())
+			return
+		}
+		sums.decompressed(resp)
+		if err := p.checkImage(resp); err != nil {
+			p.fail(w, r, ClassTooManyPixels, err, "Image too large", resp)
+			return
+		}
+	}
+	if resp.StatusCode == http.StatusOK && p.StripMetadata {
+		p.stripMetadata(resp)
+	}
+
 	switch resp.StatusCode {
-	case 200, 206, 304, 410:
-		p.buildResponse(w, resp)
+	case 200, 206, 304, 410, 416:
+		p.writeUpstream(w, r, u, opts, resp, sums)
 		return
-	case 301, 302, 303, 307:
-		http.Error(w, "Too many redirects", http.StatusNotFound)
+	case 300, 301, 302, 303, 305, 307, 308:
+		// The client only hands us a redirect if it couldn't or was told not
+		// to follow it.
+		p.writeError(w, r, ReasonError, http.StatusBadGateway, "Unfollowed redirect from upstream: "+resp.Status)
 		return
 	case 500, 502, 503, 504:
-		http.Error(w, "Error Fetching Resource: "+resp.Status, http.StatusBadGateway)
+		p.writeError(w, r, ReasonError, http.StatusBadGateway, "Error Fetching Resource: "+resp.Status)
 		return
 	default:
-		http.Error(w, "Unable to find suitable content", http.StatusNotFound)
+		p.writeError(w, r, ReasonNotFound, http.StatusNotFound, "Unable to find suitable content")
 		return
 	}
 }
 
-// buildResponse massages the headers on the response to the upstream request.
-func (p *Proxy) buildResponse(outbound http.ResponseWriter, inbound *http.Response) {
-	// Remove hop-by-hop headers listed in the
-	// "Connection" header of the response.
-	if c := inbound.Header.Get("Connection"); c != "" {
-		for _, f := range strings.Split(c, ",") {
-			if f = strings.TrimSpace(f); f != "" {
-				inbound.Header.Del(f)
-			}
+// writeUpstream sends a usable upstream response to the client. Complete
+// responses are stored in the cache. If GenerateETags is set and upstream gave
+// no ETag the body is buffered so we can give it one. Images to transform and
+// SVGs to sanitize are buffered too. sums hashes the body for BlockedHashes,
+// see hashBody. Buffered bodies are checked before anything is sent, streamed
+// ones when they end, see checkedBody.
+func (p *Proxy) writeUpstream(w http.ResponseWriter, r *http.Request, u *url.URL, opts transform.Options, resp *http.Response, sums *bodySums) {
+	if p.Cache != nil {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	if !opts.IsZero() && resp.StatusCode == http.StatusOK {
+		p.writeTransformed(w, r, u, opts, resp, sums)
+		return
+	}
+	if isSVG(resp.Header) {
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+			p.fail(w, r, ClassInvalidSVG, ErrPartialSVG, "Unable to sanitize partial SVG", resp)
+			return
+		case resp.StatusCode == http.StatusOK && r.Method == "GET":
+			p.writeSVG(w, r, u, opts, resp, sums)
+			return
+		case resp.StatusCode == http.StatusOK:
+			// We can't know what the sanitized body will be without it.
+			resp.Header.Del("Content-Length")
+			resp.Header.Del("ETag")
+			resp.Header.Del("Content-Security-Policy")
+			w.Header().Set("Content-Security-Policy", svgCSP)
 		}
 	}
+	if r.Method != "GET" || resp.StatusCode != http.StatusOK {
+		p.buildResponse(w, r, resp)
+		return
+	}
 
-	for _, h := range hopHeaders {
-		inbound.Header.Del(h)
+	if p.GenerateETags && resp.Header.Get("ETag") == "" {
+		body, sum, ok := p.readBody(w, r, u, resp, sums, p.MaxSize)
+		if !ok {
+			return
+		}
+		e := p.newEntry(u, resp, body, true)
+		e.Sum = sum
+		p.store(p.cacheKey(u, opts), r.Header, e)
+		p.serveEntry(w, r, e)
+		return
 	}
 
+	var sum blocklist.Sum
+	if sums != nil {
+		resp.Body = &checkedBody{ReadCloser: resp.Body, check: func() error {
+			var (
+				blocked bool
+				err     error
+			)
+			sum, blocked, err = p.blockedBody(u, sums)
+			if blocked {
+				return ErrBlocked
+			}
+			return err
+		}}
+	}
+	if p.Cache == nil {
+		p.buildResponse(w, r, resp)
+		return
+	}
+	// Keep a copy of the body as it streams so we can store it once the
+	// client has it all.
+	rr := &recordingReader{r: resp.Body, max: p.MaxSize}
+	resp.Body = rr
+	p.buildResponse(w, r, resp)
+	if rr.complete() {
+		e := p.newEntry(u, resp, rr.buf.Bytes(), false)
+		e.Sum = sum
+		p.store(p.cacheKey(u, opts), r.Header, e)
+	}
+}
+
+// buildResponse massages the headers on the response to the upstream request.
+// If the body is cut short the client connection is aborted, see abort.
+func (p *Proxy) buildResponse(outbound http.ResponseWriter, r *http.Request, inbound *http.Response) {
+	removeHopHeaders(inbound.Header)
 	copyHeader(outbound.Header(), inbound.Header)
 
 	// The "Trailer" header isn't included in the Transport's response,
@@ -293,6 +509,12 @@ func (p *Proxy) buildResponse(outbound http.ResponseWriter, inbound *http.Respon
 	}
 
 	outbound.WriteHeader(inbound.StatusCode)
+	if r.Method == "HEAD" {
+		// There's no body to copy. If we fell back to a GET upstream we
+		// don't want it either.
+		inbound.Body.Close()
+		return
+	}
 
 	if len(inbound.Trailer) > 0 {
 		// Force chunking if we saw a response trailer.
@@ -302,8 +524,18 @@ func (p *Proxy) buildResponse(outbound http.ResponseWriter, inbound *http.Respon
 			fl.Flush()
 		}
 	}
-	p.copyResponse(outbound, inbound.Body)
+	written, rerr, werr := p.copyResponse(outbound, inbound.Body)
 	inbound.Body.Close()
+	if rerr == io.EOF {
+		rerr = nil
+	}
+	if rerr == nil && werr == nil && inbound.StatusCode != http.StatusNotModified &&
+		inbound.ContentLength >= 0 && written != inbound.ContentLength {
+		rerr = fmt.Errorf("%w: got %d of %d bytes", ErrShortBody, written, inbound.ContentLength)
+	}
+	if rerr != nil && Classify(rerr) != ClassCanceled {
+		p.abort(r, rerr)
+	}
 
 	for k, vv := range inbound.Trailer {
 		k = http.TrailerPrefix + k
@@ -351,22 +583,12 @@ func (p *Proxy) buildRequest(target *url.URL, w http.ResponseWriter, r *http.Req
 	out.Host = out.URL.Host
 	out.Header = cloneHeader(r.Header) // r.WithContext does shallow copies.
 
-	// Remove hop-by-hop headers listed in the "Connection" header.
-	// See RFC 2616, section 14.10.
-	if c := out.Header.Get("Connection"); c != "" {
-		for _, f := range strings.Split(c, ",") {
-			if f = strings.TrimSpace(f); f != "" {
-				out.Header.Del(f)
-			}
-		}
-	}
+	// Remove hop-by-hop headers to the backend. See RFC 2616, section
+	// 14.10.
+	removeHopHeaders(out.Header)
 
-	// Remove hop-by-hop headers to the backend.
-	for _, h := range hopHeaders {
-		if out.Header.Get(h) != "" {
-			out.Header.Del(h)
-		}
-	}
+	// Only single byte ranges are passed upstream.
+	filterRange(out.Header)
 
 	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
 		// If we aren't the first proxy retain prior
@@ -406,15 +628,15 @@ func (p *Proxy) validateTarget(u *url.URL) error {
 	for _, ip := range ips {
 		allowed, err := p.Filter.Allowed(ip.String())
 		if err != nil {
-			return fmt.Errorf("error resolving host target(%q): %q", ip, err)
+			return &filteredError{fmt.Sprintf("error resolving host target(%q): %q", ip, err)}
 		}
 		if !allowed {
-			return fmt.Errorf("filtered host address: %q", ip)
+			return &filteredError{fmt.Sprintf("filtered host address: %q", ip)}
 		}
 		if p.CheckUnicast {
 			// TODO(ro) 2017-10-04 Do we want to use this too?
 			if !ip.IsGlobalUnicast() {
-				return fmt.Errorf("resolved to reserved address: %q", ip)
+				return &filteredError{fmt.Sprintf("resolved to reserved address: %q", ip)}
 			}
 		}
 	}
@@ -439,6 +661,45 @@ func (p *Proxy) setResponseHeaders(w http.ResponseWriter) {
 
 }
 
+// target decodes the signed URL from its components and checks we may fetch
+// it, that it isn't taken down and its host is one we may fetch from. If we
+// may not it answers the client and returns false.
+func (p *Proxy) target(w http.ResponseWriter, r *http.Request, sig, encodedURL string) (transform.Options, *url.URL, bool) {
+	xid := rxid.FromContext(r.Context())
+
+	// Decode the URL.
+	payload, err := p.Decoder.Decode(sig, encodedURL)
+	if err != nil {
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return transform.Options{}, nil, false
+	}
+	opts, uStr, err := transform.Split(payload)
+	if err != nil {
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return transform.Options{}, nil, false
+	}
+
+	u, err := url.Parse(uStr)
+	if err != nil {
+		p.logger.Error().Err(err).Str("request_id", xid).Msg(logging.ErrDetails())
+		http.Error(w, "Invalid downstream URL: "+err.Error(), http.StatusForbidden)
+		return transform.Options{}, nil, false
+	}
+	if p.takenDown(u) {
+		p.fail(w, r, ClassTakenDown, ErrTakenDown, p.BlockedMessage, nil)
+		return transform.Options{}, nil, false
+	}
+
+	// Validate the target host
+	if err = p.validateTarget(u); err != nil {
+		p.fail(w, r, Classify(err), err, "invalid host: "+err.Error(), nil)
+		return transform.Options{}, nil, false
+	}
+	return opts, u, true
+}
+
 // splitComponents splits the incoming path and verifies the shape and size.
 func (p *Proxy) splitComponents(path string) (string, string, error) {
 	parts := strings.Split(path, "/")
@@ -448,7 +709,9 @@ func (p *Proxy) splitComponents(path string) (string, string, error) {
 	return parts[1], parts[2], nil
 }
 
-func (p *Proxy) copyResponse(dst io.Writer, src io.Reader) {
+// copyResponse copies src to dst, flushing every FlushInterval if set. It
+// returns the bytes written and any error reading src or writing dst.
+func (p *Proxy) copyResponse(dst io.Writer, src io.Reader) (written int64, rerr, werr error) {
 	if p.FlushInterval != 0 {
 		if wf, ok := dst.(writeFlusher); ok {
 			mlw := &maxLatencyWriter{
@@ -464,37 +727,33 @@ func (p *Proxy) copyResponse(dst io.Writer, src io.Reader) {
 	}
 
 	buf := p.BufferPool.Get()
-	p.copyBuffer(dst, src, buf)
+	written, rerr, werr = p.copyBuffer(dst, src, buf)
 	p.BufferPool.Put(buf)
+	return written, rerr, werr
 }
 
-func (p *Proxy) copyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+func (p *Proxy) copyBuffer(dst io.Writer, src io.Reader, buf []byte) (written int64, rerr, werr error) {
 
 	if len(buf) == 0 {
 		buf = make([]byte, 32*1024)
 	}
 
-	var written int64
 	for {
 		nr, rerr := src.Read(buf)
-		if rerr != nil && rerr != io.EOF && rerr != context.Canceled {
-			p.logger.Error().Err(rerr).Msgf(
-				"Proxy read error during body copy: %v", rerr)
-		}
 		if nr > 0 {
 			nw, werr := dst.Write(buf[:nr])
 			if nw > 0 {
 				written += int64(nw)
 			}
 			if werr != nil {
-				return written, werr
+				return written, nil, werr
 			}
 			if nr != nw {
-				return written, io.ErrShortWrite
+				return written, nil, io.ErrShortWrite
 			}
 		}
 		if rerr != nil {
-			return written, rerr
+			return written, rerr, nil
 		}
 	}
 }
@@ -544,8 +803,3 @@ func (m *maxLatencyWriter) flushLoop() {
 }
 
 func (m *maxLatencyWriter) stop() { m.done <- true }
-
-func errDetails() string {
-	pc, fn, line, _ := runtime.Caller(1)
-	return fmt.Sprintf("[error] in %s[%s:%d]", runtime.FuncForPC(pc).Name(), fn, line)
-}
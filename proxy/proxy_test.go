@@ -2,6 +2,7 @@ package proxy_test
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/bepress/camo/checkers"
 	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/logging"
 	"github.com/bepress/camo/proxy"
 	"github.com/bepress/camo/rxid"
 	"github.com/rs/zerolog"
@@ -422,6 +424,19 @@ func (dr DummyResolver) LookupIP(s string) ([]net.IP, error) {
 	return dr.ips, nil
 }
 
+// newTestServer serves a proxy for the upstream URL url, logging to logger, on
+// a TLS test server. Every host resolves to the loopback address, which isn't
+// filtered out; options are applied after that.
+func newTestServer(url string, logger zerolog.Logger, options ...func(*proxy.Proxy)) *httptest.Server {
+	options = append([]func(*proxy.Proxy){
+		func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: url} },
+		func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+		func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+		func(p *proxy.Proxy) { p.CheckUnicast = false },
+	}, options...)
+	return httptest.NewTLSServer(rxid.Handler(proxy.MustNew([]byte("test"), logger, options...)))
+}
+
 func TestReverseProxyFlushInterval(t *testing.T) {
 	const expected = "hi"
 	// The backend server we proxy for.
@@ -467,6 +482,59 @@ func TestReverseProxyFlushInterval(t *testing.T) {
 	}
 }
 
+func TestStreamingThroughAccessLogger(t *testing.T) {
+	table := []struct {
+		desc  string
+		http2 bool
+	}{
+		{"HTTP/1.1", false},
+		{"HTTP/2", true},
+	}
+
+	for _, test := range table {
+		unblock := make(chan struct{})
+		tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+			<-unblock
+			w.Write([]byte("second"))
+			w.Header().Set("X-Checksum", "abc123")
+		}))
+
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + "/image.png"} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+			func(p *proxy.Proxy) { p.FlushInterval = time.Millisecond },
+		)
+		frontend := httptest.NewUnstartedServer(rxid.Handler(logging.NewAccessLogger(tut, zerolog.New(ioutil.Discard))))
+		frontend.EnableHTTP2 = test.http2
+		frontend.StartTLS()
+
+		res, err := frontend.Client().Get(frontend.URL + "/sig/url")
+		checkers.OK(t, err)
+
+		// The first chunk arrives while the backend is still going.
+		first := make([]byte, len("first"))
+		_, err = io.ReadFull(res.Body, first)
+		checkers.OK(t, err)
+		checkers.Equals(t, string(first), "first")
+
+		close(unblock)
+		rest, err := ioutil.ReadAll(res.Body)
+		checkers.OK(t, err)
+		res.Body.Close()
+		checkers.Equals(t, string(rest), "second")
+		checkers.Assert(t, res.Trailer.Get("X-Checksum") == "abc123", "%s: got trailers %v", test.desc, res.Trailer)
+
+		frontend.Close()
+		tsBE.Close()
+	}
+}
+
 func TestResponseFound(t *testing.T) {
 	resolver := DummyResolver{ips: []net.IP{
 		net.ParseIP("127.0.0.1"),
@@ -495,7 +563,7 @@ func TestResponseFound(t *testing.T) {
 	ts := httptest.NewTLSServer(rxid.Handler(tut))
 	resp, err := ts.Client().Get(ts.URL + "/sldkjf/lsdkfj")
 	checkers.OK(t, err)
-	checkers.Equals(t, resp.StatusCode, http.StatusNotFound)
+	checkers.Equals(t, resp.StatusCode, http.StatusBadGateway)
 
 }
 
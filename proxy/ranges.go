@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// contentRange is a parsed Content-Range response header. Total is -1 if the
+// complete length is unknown.
+type contentRange struct {
+	start, end, total int64
+}
+
+// parseContentRange parses a "bytes first-last/complete" Content-Range value.
+func parseContentRange(s string) (contentRange, error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(s, prefix) {
+		return contentRange{}, fmt.Errorf("invalid content range: %q", s)
+	}
+	s = s[len(prefix):]
+
+	slash := strings.Index(s, "/")
+	dash := strings.Index(s, "-")
+	if slash == -1 || dash == -1 || dash > slash {
+		return contentRange{}, fmt.Errorf("invalid content range: %q", s)
+	}
+
+	cr := contentRange{total: -1}
+	var err error
+	if cr.start, err = strconv.ParseInt(s[:dash], 10, 64); err != nil {
+		return contentRange{}, fmt.Errorf("invalid content range start: %q", s)
+	}
+	if cr.end, err = strconv.ParseInt(s[dash+1:slash], 10, 64); err != nil {
+		return contentRange{}, fmt.Errorf("invalid content range end: %q", s)
+	}
+	if total := s[slash+1:]; total != "*" {
+		if cr.total, err = strconv.ParseInt(total, 10, 64); err != nil {
+			return contentRange{}, fmt.Errorf("invalid content range length: %q", s)
+		}
+	}
+
+	if cr.start < 0 || cr.end < cr.start || (cr.total != -1 && cr.end >= cr.total) {
+		return contentRange{}, fmt.Errorf("unsatisfiable content range: %q", s)
+	}
+	return cr, nil
+}
+
+// singleRange parses a Range request header holding a single byte range. It
+// returns the first byte position requested, or -1 for a suffix range, and
+// false if the header isn't a single valid byte range.
+func singleRange(s string) (int64, bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) || strings.Contains(s, ",") {
+		return 0, false
+	}
+	s = strings.TrimSpace(s[len(prefix):])
+	dash := strings.Index(s, "-")
+	if dash == -1 {
+		return 0, false
+	}
+	first, last := strings.TrimSpace(s[:dash]), strings.TrimSpace(s[dash+1:])
+
+	if first == "" {
+		if n, err := strconv.ParseInt(last, 10, 64); err != nil || n <= 0 {
+			return 0, false
+		}
+		return -1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, false
+	}
+	if last != "" {
+		if end, err := strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, false
+		}
+	}
+	return start, true
+}
+
+// filterRange removes Range and If-Range from the upstream request unless it
+// asks for a single byte range. Anything else is fetched whole and the client
+// gets a 200, which is always allowed.
+func filterRange(h http.Header) {
+	rng := h.Get("Range")
+	if rng == "" {
+		h.Del("If-Range")
+		return
+	}
+	if _, ok := singleRange(rng); !ok {
+		h.Del("Range")
+		h.Del("If-Range")
+	}
+}
+
+// validatePartial checks a 206 response against the range we asked for and
+// returns its Content-Range.
+func validatePartial(req *http.Request, resp *http.Response) (contentRange, error) {
+	start, ok := singleRange(req.Header.Get("Range"))
+	if !ok {
+		return contentRange{}, errors.New("partial content for a request without a range")
+	}
+
+	cr, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return contentRange{}, err
+	}
+	if start != -1 && cr.start != start {
+		return contentRange{}, fmt.Errorf("content range starts at %d, requested %d", cr.start, start)
+	}
+	if resp.ContentLength != -1 && resp.ContentLength != cr.end-cr.start+1 {
+		return contentRange{}, fmt.Errorf("content length %d does not match content range %d-%d",
+			resp.ContentLength, cr.start, cr.end)
+	}
+	return cr, nil
+}
@@ -0,0 +1,168 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/proxy"
+	"github.com/rs/zerolog"
+)
+
+const rangeBody = "0123456789abcdefghij"
+
+func TestUpstreamRanges(t *testing.T) {
+	table := []struct {
+		desc         string
+		rangeHdr     string
+		contentRange string
+		body         string
+		maxSize      int64
+		wantRange    string
+		wantCode     int
+		wantBody     string
+	}{
+		{"valid range", "bytes=2-5", "bytes 2-5/20", "2345", 100, "bytes=2-5", 206, "2345"},
+		{"open range", "bytes=18-", "bytes 18-19/20", "ij", 100, "bytes=18-", 206, "ij"},
+		{"suffix range", "bytes=-2", "bytes 18-19/20", "ij", 100, "bytes=-2", 206, "ij"},
+		{"unknown length", "bytes=2-5", "bytes 2-5/*", "2345", 100, "bytes=2-5", 206, "2345"},
+		{"total too large", "bytes=2-5", "bytes 2-5/20", "2345", 10, "bytes=2-5", 413, "Payload too large\n"},
+		{"wrong start", "bytes=2-5", "bytes 3-6/20", "3456", 100, "bytes=2-5", 502, ""},
+		{"length mismatch", "bytes=2-5", "bytes 2-4/20", "2345", 100, "bytes=2-5", 502, ""},
+		{"missing content range", "bytes=2-5", "", "2345", 100, "bytes=2-5", 502, ""},
+		{"malformed content range", "bytes=2-5", "bytes 2-5", "2345", 100, "bytes=2-5", 502, ""},
+		{"multiple ranges not forwarded", "bytes=0-1,4-5", "", rangeBody, 100, "", 200, rangeBody},
+		{"no range", "", "", rangeBody, 100, "", 200, rangeBody},
+	}
+
+	for _, test := range table {
+		var gotRange string
+		tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotRange = r.Header.Get("Range")
+			if r.Header.Get("Range") == "" {
+				w.Write([]byte(rangeBody))
+				return
+			}
+			if test.contentRange != "" {
+				w.Header().Set("Content-Range", test.contentRange)
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(test.body))
+		}))
+
+		ts := newTestServer(tsBE.URL+"/file.pdf", zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.MaxSize = test.maxSize },
+		)
+		// Keep the client from asking for gzip so ranges are over plain bytes.
+		ts.Client().Transport.(*http.Transport).DisableCompression = true
+
+		req, err := http.NewRequest("GET", ts.URL+"/sig/url", nil)
+		checkers.OK(t, err)
+		if test.rangeHdr != "" {
+			req.Header.Set("Range", test.rangeHdr)
+		}
+		resp, err := ts.Client().Do(req)
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+
+		checkers.Equals(t, gotRange, test.wantRange)
+		checkers.Equals(t, resp.StatusCode, test.wantCode)
+		if test.wantBody != "" {
+			checkers.Equals(t, string(body), test.wantBody)
+		}
+		if test.wantCode == 206 {
+			checkers.Equals(t, resp.Header.Get("Content-Range"), test.contentRange)
+		}
+
+		ts.Close()
+		tsBE.Close()
+	}
+}
+
+func TestCachedRanges(t *testing.T) {
+	var hits int
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(rangeBody))
+	}))
+	defer tsBE.Close()
+
+	ts := newTestServer(tsBE.URL+"/file.pdf", zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.Cache = cache.MustNewMemory(1024 * 1024) },
+		func(p *proxy.Proxy) { p.MaxSize = 100 },
+	)
+	ts.Client().Transport.(*http.Transport).DisableCompression = true
+	defer ts.Close()
+
+	// Warm the cache.
+	resp, err := ts.Client().Get(ts.URL + "/sig/url")
+	checkers.OK(t, err)
+	resp.Body.Close()
+
+	table := []struct {
+		rangeHdr  string
+		ifRange   string
+		wantCode  int
+		wantBody  string
+		wantRange string
+	}{
+		{"bytes=2-5", "", 206, "2345", "bytes 2-5/20"},
+		{"bytes=-3", "", 206, "hij", "bytes 17-19/20"},
+		{"bytes=2-5", `"v1"`, 206, "2345", "bytes 2-5/20"},
+		{"bytes=2-5", `"v0"`, 200, rangeBody, ""},
+		{"bytes=30-", "", 416, "", "bytes */20"},
+	}
+	for _, test := range table {
+		req, err := http.NewRequest("GET", ts.URL+"/sig/url", nil)
+		checkers.OK(t, err)
+		req.Header.Set("Range", test.rangeHdr)
+		if test.ifRange != "" {
+			req.Header.Set("If-Range", test.ifRange)
+		}
+		resp, err := ts.Client().Do(req)
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+
+		checkers.Equals(t, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, resp.Header.Get("X-Cache"), "HIT")
+		checkers.Equals(t, resp.Header.Get("Content-Range"), test.wantRange)
+		if test.wantCode != 416 {
+			checkers.Equals(t, string(body), test.wantBody)
+		}
+	}
+	checkers.Equals(t, hits, 1)
+}
+
+func TestPartialContentWithoutRange(t *testing.T) {
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-3/%d", len(rangeBody)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(rangeBody[:4]))
+	}))
+	defer tsBE.Close()
+
+	ts := newTestServer(tsBE.URL+"/file.pdf", zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.MaxSize = 100 },
+	)
+	ts.Client().Transport.(*http.Transport).DisableCompression = true
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/sig/url")
+	checkers.OK(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	checkers.OK(t, err)
+	resp.Body.Close()
+	checkers.Equals(t, resp.StatusCode, http.StatusBadGateway)
+	checkers.Assert(t, strings.Contains(string(body), "without a range"), "unexpected body %q", body)
+}
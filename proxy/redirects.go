@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bepress/camo/logging"
+	"github.com/bepress/camo/rxid"
+)
+
+// ErrRedirectDowngrade is returned when RefuseDowngrade is set and upstream
+// redirects from https to http.
+var ErrRedirectDowngrade = errors.New("refused redirect from https to http")
+
+// RedirectLimitError is returned when upstream redirects us more than
+// MaxRedirects times.
+type RedirectLimitError struct {
+	Limit int
+}
+
+// Error implements error.
+func (e *RedirectLimitError) Error() string {
+	return fmt.Sprintf("stopped after %d redirects", e.Limit)
+}
+
+// checkRedirect implements the redirect policy for http.Client. Redirects to
+// URLs that are taken down are refused as the URLs themselves would be.
+func (p *Proxy) checkRedirect(r *http.Request, via []*http.Request) error {
+	if p.takenDown(r.URL) {
+		return ErrTakenDown
+	}
+	if err := p.validateTarget(r.URL); err != nil {
+		p.logger.Error().Err(err).Str("request_id", rxid.FromContext(r.Context())).Msg(logging.ErrDetails())
+		if errors.Is(err, ErrFilteredAddress) {
+			return ErrFilteredAddress
+		}
+		return err
+	}
+
+	if p.RefuseDowngrade && len(via) > 0 &&
+		via[len(via)-1].URL.Scheme == "https" && r.URL.Scheme == "http" {
+		return ErrRedirectDowngrade
+	}
+
+	if len(via) >= p.MaxRedirects {
+		return &RedirectLimitError{Limit: p.MaxRedirects}
+	}
+	return nil
+}
+
+// redirectChain lists the redirects that led to resp, oldest first, as
+// "host status" pairs. If resp is itself a redirect we didn't follow it is
+// the last entry.
+func redirectChain(resp *http.Response) []string {
+	if resp == nil || resp.Request == nil {
+		return nil
+	}
+	var chain []string
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		chain = append(chain, hop(resp))
+	}
+	for req := resp.Request; req.Response != nil && req.Response.Request != nil; req = req.Response.Request {
+		chain = append([]string{hop(req.Response)}, chain...)
+	}
+	return chain
+}
+
+func hop(resp *http.Response) string {
+	return resp.Request.URL.Host + " " + strconv.Itoa(resp.StatusCode)
+}
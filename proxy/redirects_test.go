@@ -0,0 +1,120 @@
+package proxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+func TestRedirectLimitError(t *testing.T) {
+	tut := proxy.MustNew([]byte("test"),
+		zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.MaxRedirects = 2 },
+		func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+		func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("72.5.9.223")}}.LookupIP },
+	)
+
+	r, err := http.NewRequest("GET", "http://example.com/foo", nil)
+	checkers.OK(t, err)
+
+	err = tut.RedirFunc(r, []*http.Request{r, r})
+	rle, ok := err.(*proxy.RedirectLimitError)
+	checkers.Assert(t, ok, "expected a *proxy.RedirectLimitError got %T", err)
+	checkers.Equals(t, rle.Limit, 2)
+}
+
+func TestRedirectDowngrade(t *testing.T) {
+	table := []struct {
+		refuse bool
+		from   string
+		to     string
+		want   error
+	}{
+		{true, "https://example.com/a", "http://example.com/b", proxy.ErrRedirectDowngrade},
+		{true, "https://example.com/a", "https://example.com/b", nil},
+		{true, "http://example.com/a", "http://example.com/b", nil},
+		{true, "http://example.com/a", "https://example.com/b", nil},
+		{false, "https://example.com/a", "http://example.com/b", nil},
+	}
+
+	for _, test := range table {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.RefuseDowngrade = test.refuse },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("72.5.9.223")}}.LookupIP },
+		)
+		from, err := http.NewRequest("GET", test.from, nil)
+		checkers.OK(t, err)
+		to, err := http.NewRequest("GET", test.to, nil)
+		checkers.OK(t, err)
+
+		checkers.Equals(t, tut.RedirFunc(to, []*http.Request{from}), test.want)
+	}
+}
+
+func TestRedirectChainLogged(t *testing.T) {
+	table := []struct {
+		desc      string
+		hops      int
+		max       int
+		wantCode  int
+		wantChain int
+	}{
+		{"followed", 2, 10, http.StatusOK, 2},
+		{"limit", 3, 2, http.StatusBadGateway, 2},
+		{"limit reached on last hop", 2, 1, http.StatusBadGateway, 1},
+	}
+
+	for _, test := range table {
+		var tsBE *httptest.Server
+		tsBE = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+			if n < test.hops {
+				http.Redirect(w, r, tsBE.URL+"/"+strconv.Itoa(n+1), http.StatusFound)
+				return
+			}
+			w.Write([]byte("done"))
+		}))
+
+		out := &bytes.Buffer{}
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(out),
+			func(p *proxy.Proxy) { p.MaxRedirects = test.max },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + "/0"} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		resp, err := ts.Client().Get(ts.URL + "/sig/url")
+		checkers.OK(t, err)
+		resp.Body.Close()
+		checkers.Equals(t, resp.StatusCode, test.wantCode)
+
+		var rec struct {
+			RedirectChain []string `json:"redirect_chain"`
+		}
+		line := strings.SplitN(out.String(), "\n", 2)[0]
+		checkers.OK(t, json.Unmarshal([]byte(line), &rec))
+		checkers.Equals(t, len(rec.RedirectChain), test.wantChain)
+		for _, hop := range rec.RedirectChain {
+			checkers.Equals(t, hop, tsBE.Listener.Addr().String()+" 302")
+		}
+
+		ts.Close()
+		tsBE.Close()
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bepress/camo/rxid"
+)
+
+// DefaultRetryPolicy makes a single attempt. The backoff and statuses are used
+// if Attempts is raised.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:  1,
+	BaseDelay: 50 * time.Millisecond,
+	MaxDelay:  time.Second,
+	Statuses:  []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+}
+
+// RetryPolicy controls retries of upstream GET and HEAD requests that fail
+// with a connection error or one of Statuses.
+type RetryPolicy struct {
+	// Attempts is the most tries we make, including the first. Less than two
+	// disables retries.
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Statuses  []int
+}
+
+// backoff returns the jittered delay before retry n, counting from one.
+func (rp RetryPolicy) backoff(n int) time.Duration {
+	d := rp.BaseDelay << uint(n-1)
+	if d > rp.MaxDelay || d <= 0 {
+		d = rp.MaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryable reports whether the status is worth another try.
+func (rp RetryPolicy) retryable(status int) bool {
+	for _, s := range rp.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// retry does req, retrying under p.Retry. Nothing has been written to the
+// client when retry runs, so a retry is always safe; once it returns the
+// response is the client's. A retry is only made if it can start before
+// deadline. It also returns the number of attempts made.
+func (p *Proxy) retry(req *http.Request, deadline time.Time) (*http.Response, int, error) {
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		resp, err := p.client.Do(req)
+		if attempt >= p.Retry.Attempts || (req.Method != "GET" && req.Method != "HEAD") {
+			return resp, attempt, err
+		}
+
+		var (
+			reason string
+			delay  time.Duration
+		)
+		switch {
+		case err != nil:
+			class := Classify(err)
+			if class != ClassConnRefused && class != ClassConnection {
+				return resp, attempt, err
+			}
+			reason, delay = string(class), p.Retry.backoff(attempt)
+		case p.Retry.retryable(resp.StatusCode):
+			reason = strconv.Itoa(resp.StatusCode)
+			var ok bool
+			if delay, ok = retryAfter(resp.Header.Get("Retry-After"), time.Now()); !ok {
+				delay = p.Retry.backoff(attempt)
+			}
+		default:
+			return resp, attempt, err
+		}
+		if time.Until(deadline) <= delay {
+			return resp, attempt, err
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		p.logger.Info().
+			Str("type", "info").
+			Str("request_id", rxid.FromContext(ctx)).
+			Str("upstream_domain", req.URL.Host).
+			Int("attempt", attempt).
+			Str("retry_reason", reason).
+			Dur("retry_delay", delay).Msg("retrying upstream request")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, attempt, ctx.Err()
+		}
+	}
+}
+
+// retryAfter parses a Retry-After header, which is either a number of seconds
+// or a date.
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
@@ -0,0 +1,115 @@
+package proxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/proxy"
+	"github.com/rs/zerolog"
+)
+
+func TestRetries(t *testing.T) {
+	table := []struct {
+		desc       string
+		attempts   int
+		failures   int32
+		status     int
+		retryAfter string
+		wantCode   int
+		wantHits   int32
+	}{
+		{"recovers", 3, 2, http.StatusServiceUnavailable, "", http.StatusOK, 3},
+		{"gives up", 2, 5, http.StatusServiceUnavailable, "", http.StatusBadGateway, 2},
+		{"disabled", 1, 1, http.StatusServiceUnavailable, "", http.StatusBadGateway, 1},
+		{"not retryable", 3, 1, http.StatusNotFound, "", http.StatusNotFound, 1},
+		{"server error not retried", 3, 1, http.StatusInternalServerError, "", http.StatusBadGateway, 1},
+		{"retry after", 3, 1, http.StatusServiceUnavailable, "0", http.StatusOK, 2},
+		{"retry after past budget", 3, 1, http.StatusServiceUnavailable, "30", http.StatusBadGateway, 1},
+		{"connection reset", 3, 1, 0, "", http.StatusOK, 2},
+	}
+
+	for _, test := range table {
+		var hits int32
+		tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&hits, 1) > test.failures {
+				w.Write([]byte("image"))
+				return
+			}
+			if test.status == 0 {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				checkers.OK(t, err)
+				conn.(*net.TCPConn).SetLinger(0)
+				conn.Close()
+				return
+			}
+			if test.retryAfter != "" {
+				w.Header().Set("Retry-After", test.retryAfter)
+			}
+			w.WriteHeader(test.status)
+		}))
+
+		out := &bytes.Buffer{}
+		ts := newTestServer(tsBE.URL+"/image.png", zerolog.New(out),
+			func(p *proxy.Proxy) { p.RequestTimeout = 150 * time.Millisecond },
+			func(p *proxy.Proxy) { p.Retry.Attempts = test.attempts },
+			func(p *proxy.Proxy) { p.Retry.BaseDelay = time.Millisecond },
+		)
+
+		resp, err := ts.Client().Get(ts.URL + "/sig/url")
+		checkers.OK(t, err)
+		resp.Body.Close()
+		checkers.Equals(t, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, atomic.LoadInt32(&hits), test.wantHits)
+
+		if test.wantCode == http.StatusOK {
+			var rec struct {
+				Attempts int32 `json:"attempts"`
+			}
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				if strings.Contains(line, `"upstream_response"`) {
+					checkers.OK(t, json.Unmarshal([]byte(line), &rec))
+				}
+			}
+			checkers.Equals(t, rec.Attempts, test.wantHits)
+		}
+
+		ts.Close()
+		tsBE.Close()
+	}
+}
+
+func TestRetryWithinBudget(t *testing.T) {
+	var hits int32
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(40 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer tsBE.Close()
+
+	ts := newTestServer(tsBE.URL+"/image.png", zerolog.New(ioutil.Discard),
+		func(p *proxy.Proxy) { p.RequestTimeout = 150 * time.Millisecond },
+		func(p *proxy.Proxy) { p.Retry.Attempts = 10 },
+		func(p *proxy.Proxy) { p.Retry.BaseDelay = time.Millisecond },
+	)
+	defer ts.Close()
+
+	start := time.Now()
+	resp, err := ts.Client().Get(ts.URL + "/sig/url")
+	checkers.OK(t, err)
+	resp.Body.Close()
+	// Depending on timing the budget runs out waiting or mid attempt.
+	checkers.Assert(t, resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout,
+		"expected a 502 or 504 got %d", resp.StatusCode)
+	checkers.Assert(t, time.Since(start) < 200*time.Millisecond, "took %s, longer than the budget", time.Since(start))
+	checkers.Assert(t, atomic.LoadInt32(&hits) < 10, "expected the budget to run out before the attempts, got %d", hits)
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/bepress/camo/svg"
+	"github.com/bepress/camo/transform"
+)
+
+// DefaultMaxSVGSize is the largest SVG we sanitize.
+const DefaultMaxSVGSize = 1024 * 1024
+
+// svgCSP is the Content-Security-Policy for SVGs. Sanitizing should leave
+// nothing for it to stop, but if we miss something it keeps scripts from
+// running and the image from fetching anything, even when opened directly.
+const svgCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+
+// ErrPartialSVG is returned for SVG range responses, which we can't
+// sanitize.
+var ErrPartialSVG = errors.New("partial SVG content")
+
+// isSVG tells us if h is for an SVG.
+func isSVG(h http.Header) bool {
+	mt, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mt == "image/svg+xml"
+}
+
+// writeSVG sanitizes the upstream SVG, stores the result and serves it. The
+// result gets its own strong ETag.
+func (p *Proxy) writeSVG(w http.ResponseWriter, r *http.Request, u *url.URL, opts transform.Options, resp *http.Response, sums *bodySums) {
+	body, sum, ok := p.readBody(w, r, u, resp, sums, p.MaxSVGSize)
+	if !ok {
+		return
+	}
+	out, err := svg.Sanitize(bytes.NewReader(body))
+	if err != nil {
+		p.fail(w, r, ClassInvalidSVG, err, "Unable to sanitize SVG: "+err.Error(), resp)
+		return
+	}
+
+	e := p.newEntry(u, resp, out, true)
+	e.Header.Set("Content-Type", "image/svg+xml")
+	e.Header.Del("Content-Security-Policy")
+	e.Sum = sum
+	p.store(p.cacheKey(u, opts), r.Header, e)
+	p.serveEntry(w, r, e)
+}
@@ -0,0 +1,104 @@
+package proxy_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+func TestSVG(t *testing.T) {
+	const (
+		src = `<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"><script>alert(2)</script><rect width="10" height="10"/></svg>`
+		csp = "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox"
+	)
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := src
+		switch r.URL.Path {
+		case "/bad.svg":
+			body = "<html><script>alert(1)</script></html>"
+		case "/big.svg":
+			body = strings.Replace(src, "<rect", "<desc>"+strings.Repeat("x", 2048)+"</desc><rect", 1)
+		}
+		w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "script-src 'unsafe-inline'")
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer tsBE.Close()
+
+	table := []struct {
+		desc      string
+		path      string
+		method    string
+		rng       string
+		wantCode  int
+		wantCache string
+	}{
+		{"sanitized", "/image.svg", "GET", "", http.StatusOK, "MISS"},
+		{"cached", "/image.svg", "GET", "", http.StatusOK, "HIT"},
+		{"cached range", "/image.svg", "GET", "bytes=0-9", http.StatusPartialContent, "HIT"},
+		{"head", "/head.svg", "HEAD", "", http.StatusOK, "MISS"},
+		{"upstream range", "/range.svg", "GET", "bytes=0-9", http.StatusBadGateway, "MISS"},
+		{"not svg", "/bad.svg", "GET", "", http.StatusBadGateway, "MISS"},
+		{"too large", "/big.svg", "GET", "", http.StatusRequestEntityTooLarge, "MISS"},
+	}
+
+	c := cache.MustNewMemory(1024 * 1024)
+	for _, test := range table {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Cache = c },
+			func(p *proxy.Proxy) { p.MaxSVGSize = 1024 },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + test.path} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		req, err := http.NewRequest(test.method, ts.URL+"/sig/url", nil)
+		checkers.OK(t, err)
+		if test.rng != "" {
+			req.Header.Set("Range", test.rng)
+		}
+		before := upstreamErrorCount(proxy.ClassInvalidSVG)
+		resp, err := ts.Client().Do(req)
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+
+		checkers.Assert(t, resp.StatusCode == test.wantCode, "%s: got %d want %d", test.desc, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, resp.Header.Get("X-Cache"), test.wantCache)
+		switch test.wantCode {
+		case http.StatusOK, http.StatusPartialContent:
+			checkers.Equals(t, resp.Header["Content-Security-Policy"], []string{csp})
+			checkers.Assert(t, !bytes.Contains(body, []byte("alert")), "%s: script left in: %s", test.desc, body)
+		case http.StatusBadGateway:
+			checkers.Equals(t, upstreamErrorCount(proxy.ClassInvalidSVG), before+1)
+		}
+		if test.method == "GET" && test.wantCode == http.StatusOK {
+			checkers.Equals(t, resp.Header.Get("Content-Type"), "image/svg+xml")
+			checkers.Assert(t, bytes.Contains(body, []byte(`<rect width="10" height="10">`)), "%s: got %s", test.desc, body)
+		}
+		if test.method == "HEAD" {
+			// Sized as the sanitized GET would be.
+			checkers.Equals(t, resp.Header.Get("Content-Type"), "image/svg+xml")
+			checkers.Assert(t, resp.ContentLength > 0, "%s: got length %d", test.desc, resp.ContentLength)
+		}
+
+		ts.Close()
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bepress/camo/blocklist"
+	"github.com/bepress/camo/transform"
+)
+
+// writeTransformed transforms the upstream image as opts say, stores the
+// result and serves it. The result gets its own strong ETag and the sum of the
+// image it was made from.
+func (p *Proxy) writeTransformed(w http.ResponseWriter, r *http.Request, u *url.URL, opts transform.Options, resp *http.Response, sums *bodySums) {
+	var (
+		out         []byte
+		contentType string
+		sum         blocklist.Sum
+		err         error
+	)
+	if opts.Partial() {
+		// Only the frames we keep are read, so the image needn't fit in
+		// MaxSize. The rest is read only to hash it, see checkBody.
+		mr := &maxReader{r: resp.Body, n: p.MaxSize}
+		out, contentType, err = transform.Apply(mr, opts)
+		if mr.err != nil {
+			p.fail(w, r, Classify(mr.err), mr.err, "Error Fetching Resource: "+mr.err.Error(), resp)
+			return
+		}
+		var ok bool
+		if sum, ok = p.checkBody(w, r, u, sums, resp); !ok {
+			return
+		}
+	} else {
+		var (
+			body []byte
+			ok   bool
+		)
+		body, sum, ok = p.readBody(w, r, u, resp, sums, p.MaxSize)
+		if !ok {
+			return
+		}
+		out, contentType, err = transform.Apply(bytes.NewReader(body), opts)
+	}
+	if errors.Is(err, transform.ErrTooManyPixels) {
+		p.fail(w, r, ClassTooManyPixels, err, "Image too large", resp)
+		return
+	}
+	if err != nil {
+		p.fail(w, r, ClassTransform, err, "Unable to transform image: "+err.Error(), resp)
+		return
+	}
+
+	e := p.newEntry(u, resp, out, true)
+	e.Header.Set("Content-Type", contentType)
+	e.Sum = sum
+	p.store(p.cacheKey(u, opts), r.Header, e)
+	p.serveEntry(w, r, e)
+}
+
+// sanitize tells us if images from u are always to be re-encoded, either
+// because Sanitize is set or u is on one of SanitizeHosts.
+func (p *Proxy) sanitize(u *url.URL) bool {
+	if p.Sanitize {
+		return true
+	}
+	for _, h := range p.SanitizeHosts {
+		if strings.EqualFold(u.Hostname(), h) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody reads the whole upstream body at u, up to max bytes, and returns it
+// with the sum of what upstream sent, see checkBody. If it can't, or the body
+// is on BlockedHashes, it answers the client and returns false.
+func (p *Proxy) readBody(w http.ResponseWriter, r *http.Request, u *url.URL, resp *http.Response, sums *bodySums, max int64) ([]byte, blocklist.Sum, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		p.fail(w, r, Classify(err), err, "Error Fetching Resource: "+err.Error(), resp)
+		return nil, blocklist.Sum{}, false
+	}
+	if int64(len(body)) > max {
+		p.fail(w, r, ClassTooLarge, ErrTooLarge, "Payload too large", resp)
+		return nil, blocklist.Sum{}, false
+	}
+	sum, ok := p.checkBody(w, r, u, sums, resp)
+	if !ok {
+		return nil, blocklist.Sum{}, false
+	}
+	return body, sum, true
+}
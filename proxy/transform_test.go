@@ -0,0 +1,224 @@
+package proxy_test
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/bepress/camo/cache"
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/filter"
+	"github.com/bepress/camo/proxy"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+func TestTransform(t *testing.T) {
+	var buf bytes.Buffer
+	checkers.OK(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 100, 50))))
+	src := buf.Bytes()
+
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/text.png":
+			w.Write([]byte("not an image at all"))
+			return
+		case "/huge.png":
+			w.Write(pngHeader(50000, 50000))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"upstream"`)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(src)
+	}))
+	defer tsBE.Close()
+
+	table := []struct {
+		desc      string
+		payload   string
+		method    string
+		wantCode  int
+		wantType  string
+		wantW     int
+		wantCache string
+	}{
+		{"resize and convert", "w=20&fm=jpeg|" + tsBE.URL + "/image.png", "GET", http.StatusOK, "image/jpeg", 20, "MISS"},
+		{"cached", "w=20&fm=jpeg|" + tsBE.URL + "/image.png", "GET", http.StatusOK, "image/jpeg", 20, "HIT"},
+		{"another size", "w=10|" + tsBE.URL + "/image.png", "HEAD", http.StatusOK, "image/png", 0, "MISS"},
+		{"untransformed", tsBE.URL + "/image.png", "GET", http.StatusOK, "image/png", 100, "MISS"},
+		{"bad options", "w=wide|" + tsBE.URL + "/image.png", "GET", http.StatusBadRequest, "text/plain; charset=utf-8", 0, ""},
+		{"not an image", "w=10|" + tsBE.URL + "/text.png", "GET", http.StatusBadGateway, "text/plain; charset=utf-8", 0, "MISS"},
+		{"too many pixels", "w=10|" + tsBE.URL + "/huge.png", "GET", http.StatusRequestEntityTooLarge, "text/plain; charset=utf-8", 0, "MISS"},
+	}
+
+	c := cache.MustNewMemory(1024 * 1024)
+	for _, test := range table {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			func(p *proxy.Proxy) { p.Cache = c },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: test.payload} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			// Off, so the transform's own limits are what refuse huge images.
+			func(p *proxy.Proxy) { p.MaxDimension = 0 },
+			func(p *proxy.Proxy) { p.MaxPixels = 0 },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		req, err := http.NewRequest(test.method, ts.URL+"/sig/url", nil)
+		checkers.OK(t, err)
+		resp, err := ts.Client().Do(req)
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+
+		checkers.Assert(t, resp.StatusCode == test.wantCode, "%s: got %d want %d", test.desc, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, resp.Header.Get("Content-Type"), test.wantType)
+		checkers.Equals(t, resp.Header.Get("X-Cache"), test.wantCache)
+		if test.wantCode == http.StatusOK {
+			checkers.Assert(t, resp.Header.Get("ETag") != "", "%s: no ETag", test.desc)
+		}
+		if test.wantW > 0 {
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+			checkers.OK(t, err)
+			checkers.Equals(t, cfg.Width, test.wantW)
+		}
+		if test.method == "HEAD" {
+			checkers.Equals(t, len(body), 0)
+			checkers.Assert(t, resp.ContentLength > 0, "%s: no Content-Length", test.desc)
+		}
+
+		ts.Close()
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	var buf bytes.Buffer
+	checkers.OK(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 20, 10))))
+	// A PNG that is also an HTML page.
+	src := append(buf.Bytes(), "<html><script>alert(1)</script></html>"...)
+
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/text.png" {
+			w.Write([]byte("<html><script>alert(1)</script></html>"))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer tsBE.Close()
+
+	table := []struct {
+		desc     string
+		path     string
+		opt      func(*proxy.Proxy)
+		wantCode int
+		wantType string
+		wantHTML bool
+	}{
+		{"off", "/image.png", func(p *proxy.Proxy) {}, http.StatusOK, "image/png", true},
+		{"everything", "/image.png", func(p *proxy.Proxy) { p.Sanitize = true }, http.StatusOK, "image/png", false},
+		{"host", "/image.png", func(p *proxy.Proxy) { p.SanitizeHosts = []string{"example.com", "127.0.0.1"} }, http.StatusOK, "image/png", false},
+		{"other host", "/image.png", func(p *proxy.Proxy) { p.SanitizeHosts = []string{"example.com"} }, http.StatusOK, "image/png", true},
+		{"target format", "/image.png", func(p *proxy.Proxy) { p.Sanitize, p.SanitizeFormat = true, "jpeg" }, http.StatusOK, "image/jpeg", false},
+		{"not an image", "/text.png", func(p *proxy.Proxy) { p.Sanitize = true }, http.StatusBadGateway, "text/plain; charset=utf-8", false},
+	}
+
+	for _, test := range table {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			test.opt,
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: tsBE.URL + test.path} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		resp, err := ts.Client().Get(ts.URL + "/sig/url")
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+
+		checkers.Assert(t, resp.StatusCode == test.wantCode, "%s: got %d want %d", test.desc, resp.StatusCode, test.wantCode)
+		checkers.Equals(t, resp.Header.Get("Content-Type"), test.wantType)
+		checkers.Assert(t, bytes.Contains(body, []byte("<script>")) == test.wantHTML, "%s: got %q", test.desc, body)
+
+		ts.Close()
+	}
+}
+
+func TestAnimated(t *testing.T) {
+	g := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 200, 200), palette.Plan9)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(j*j + i)
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	checkers.OK(t, gif.EncodeAll(&buf, g))
+	src := buf.Bytes()
+
+	tsBE := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Set("Content-Length", strconv.Itoa(len(src)))
+		w.Write(src)
+	}))
+	defer tsBE.Close()
+
+	table := []struct {
+		desc       string
+		payload    string
+		wantCode   int
+		wantFrames int
+	}{
+		{"untransformed", tsBE.URL + "/a.gif", http.StatusRequestEntityTooLarge, 0},
+		{"resized", "w=20|" + tsBE.URL + "/a.gif", http.StatusRequestEntityTooLarge, 0},
+		{"static", "static=1|" + tsBE.URL + "/a.gif", http.StatusOK, 1},
+		{"frame cap", "frames=1|" + tsBE.URL + "/a.gif", http.StatusOK, 1},
+		{"frame cap beyond max size", "frames=3|" + tsBE.URL + "/a.gif", http.StatusRequestEntityTooLarge, 0},
+	}
+
+	for _, test := range table {
+		tut := proxy.MustNew([]byte("test"),
+			zerolog.New(ioutil.Discard),
+			// Room for the first frame but not the rest.
+			func(p *proxy.Proxy) { p.MaxSize = int64(len(src) * 2 / 3) },
+			func(p *proxy.Proxy) { p.Decoder = DummyDecoder{url: test.payload} },
+			func(p *proxy.Proxy) { p.Filter = filter.MustNewCIDR([]string{}) },
+			func(p *proxy.Proxy) { p.LookupIP = DummyResolver{ips: []net.IP{net.ParseIP("127.0.0.1")}}.LookupIP },
+			func(p *proxy.Proxy) { p.CheckUnicast = false },
+		)
+		ts := httptest.NewTLSServer(rxid.Handler(tut))
+
+		resp, err := ts.Client().Get(ts.URL + "/sig/url")
+		checkers.OK(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkers.OK(t, err)
+		resp.Body.Close()
+
+		checkers.Assert(t, resp.StatusCode == test.wantCode, "%s: got %d want %d", test.desc, resp.StatusCode, test.wantCode)
+		if test.wantCode == http.StatusOK {
+			out, err := gif.DecodeAll(bytes.NewReader(body))
+			checkers.OK(t, err)
+			checkers.Equals(t, len(out.Image), test.wantFrames)
+		}
+
+		ts.Close()
+	}
+}
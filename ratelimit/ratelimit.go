@@ -0,0 +1,231 @@
+// Package ratelimit limits the rate of client requests with token buckets
+// keyed by client IP and, optionally, by Referer host.
+package ratelimit
+
+import (
+	"expvar"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultIPBurst is the most requests a client IP may make at once.
+	DefaultIPBurst = 100
+
+	// DefaultRefererBurst is the most requests a Referer host may make at
+	// once.
+	DefaultRefererBurst = 1000
+
+	// sweepInterval is how often we forget buckets that have filled up.
+	sweepInterval = time.Minute
+)
+
+// limited counts limited requests by what limited them.
+var limited = expvar.NewMap("rateLimited")
+
+// MustNew returns a rate limiting handler wrapping next or panics. Limits
+// are off unless their rate is set.
+func MustNew(next http.Handler, logger zerolog.Logger, options ...func(*Limiter)) *Limiter {
+	if next == nil {
+		panic("next handler must not be nil")
+	}
+
+	l := &Limiter{
+		IPBurst:      DefaultIPBurst,
+		RefererBurst: DefaultRefererBurst,
+
+		next:   next,
+		logger: logger,
+	}
+
+	for _, opt := range options {
+		opt(l)
+	}
+
+	if l.IPRate < 0 || l.RefererRate < 0 {
+		panic("rates must not be negative")
+	}
+	if (l.IPRate > 0 && l.IPBurst < 1) || (l.RefererRate > 0 && l.RefererBurst < 1) {
+		panic("bursts must be at least 1")
+	}
+	for _, cidr := range l.TrustedProxies {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic("failed to parse trusted proxy: " + err.Error())
+		}
+		l.trusted = append(l.trusted, n)
+	}
+	l.ips = newBuckets(l.IPRate, l.IPBurst)
+	l.referers = newBuckets(l.RefererRate, l.RefererBurst)
+	return l
+}
+
+// Limiter is an http.Handler that answers 429 Too Many Requests to clients
+// over their limit and passes everything else to the next handler. Rates are
+// in requests per second. X-Forwarded-For is only believed from
+// TrustedProxies, given as CIDRs.
+type Limiter struct {
+	IPBurst        int
+	IPRate         float64
+	RefererBurst   int
+	RefererRate    float64
+	TrustedProxies []string
+
+	next     http.Handler
+	logger   zerolog.Logger
+	trusted  []*net.IPNet
+	ips      *buckets
+	referers *buckets
+}
+
+// ServeHTTP implements http.Handler.
+func (l *Limiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Never limit the load balancer's health checks.
+	if r.URL.Path == "/health" {
+		l.next.ServeHTTP(w, r)
+		return
+	}
+
+	now := time.Now()
+	if ip := l.clientIP(r); ip != "" {
+		if wait, ok := l.ips.take(ip, now); !ok {
+			l.reject(w, r, "client_ip", ip, wait)
+			return
+		}
+	}
+	if host := refererHost(r); host != "" {
+		if wait, ok := l.referers.take(host, now); !ok {
+			l.reject(w, r, "referer", host, wait)
+			return
+		}
+	}
+	l.next.ServeHTTP(w, r)
+}
+
+func (l *Limiter) reject(w http.ResponseWriter, r *http.Request, by, key string, wait time.Duration) {
+	limited.Add(by, 1)
+	l.logger.Info().
+		Str("type", "info").
+		Str("request_id", rxid.FromContext(r.Context())).
+		Str("rate_limited_by", by).
+		Str("rate_limit_key", key).Msg("")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// clientIP is the address the request came from. The listener takes care of
+// the proxy protocol. If that is a trusted proxy the nearest untrusted
+// address in X-Forwarded-For is used instead.
+func (l *Limiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !l.isTrusted(host) {
+		return host
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		host = hop
+		if !l.isTrusted(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func (l *Limiter) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func refererHost(r *http.Request) string {
+	ref := r.Referer()
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// buckets is a set of token buckets with the same rate and burst. A rate of 0
+// means no limit.
+type buckets struct {
+	rate  float64
+	burst float64
+
+	mu    sync.Mutex // protects everything below
+	m     map[string]*bucket
+	swept time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newBuckets(rate float64, burst int) *buckets {
+	return &buckets{rate: rate, burst: float64(burst), m: make(map[string]*bucket)}
+}
+
+// take takes a token from key's bucket. If there isn't one it returns how
+// long until there will be.
+func (bs *buckets) take(key string, now time.Time) (time.Duration, bool) {
+	if bs.rate == 0 {
+		return 0, true
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.sweep(now)
+	b, ok := bs.m[key]
+	if !ok {
+		b = &bucket{tokens: bs.burst, last: now}
+		bs.m[key] = b
+	}
+	b.tokens = math.Min(bs.burst, b.tokens+now.Sub(b.last).Seconds()*bs.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / bs.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep forgets buckets that would be full by now, as a new one is the same.
+func (bs *buckets) sweep(now time.Time) {
+	if now.Sub(bs.swept) < sweepInterval {
+		return
+	}
+	bs.swept = now
+	for key, b := range bs.m {
+		if b.tokens+now.Sub(b.last).Seconds()*bs.rate >= bs.burst {
+			delete(bs.m, key)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package ratelimit_test
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/ratelimit"
+	"github.com/bepress/camo/rxid"
+	"github.com/rs/zerolog"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestLimitByIP(t *testing.T) {
+	tut := newLimiter(
+		func(l *ratelimit.Limiter) { l.IPRate = 0.5 },
+		func(l *ratelimit.Limiter) { l.IPBurst = 2 },
+	)
+
+	before := limitedCount("client_ip")
+	for i := 0; i < 2; i++ {
+		checkers.Equals(t, do(tut, "192.0.2.1:1234", nil).Code, http.StatusOK)
+	}
+	w := do(tut, "192.0.2.1:1234", nil)
+	checkers.Equals(t, w.Code, http.StatusTooManyRequests)
+	checkers.Equals(t, w.Header().Get("Retry-After"), "2")
+	checkers.Equals(t, limitedCount("client_ip"), before+1)
+
+	// Other clients have their own bucket.
+	checkers.Equals(t, do(tut, "192.0.2.2:1234", nil).Code, http.StatusOK)
+
+	// Health checks are never limited.
+	r := httptest.NewRequest("GET", "/health", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w = httptest.NewRecorder()
+	rxid.Handler(tut).ServeHTTP(w, r)
+	checkers.Equals(t, w.Code, http.StatusOK)
+}
+
+func TestForwardedFor(t *testing.T) {
+	table := []struct {
+		desc   string
+		remote string
+		xff    string
+		other  string
+		want   int
+	}{
+		{"untrusted peer shares a bucket", "192.0.2.1:1234", "198.51.100.1", "198.51.100.2", http.StatusTooManyRequests},
+		{"trusted peer", "10.0.0.1:1234", "198.51.100.1", "198.51.100.2", http.StatusOK},
+		{"trusted chain", "10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "198.51.100.2, 10.0.0.2", http.StatusOK},
+		{"spoofed leftmost", "10.0.0.1:1234", "198.51.100.9, 198.51.100.1", "198.51.100.8, 198.51.100.1", http.StatusTooManyRequests},
+	}
+
+	for _, test := range table {
+		tut := newLimiter(
+			func(l *ratelimit.Limiter) { l.IPRate = 0.001 },
+			func(l *ratelimit.Limiter) { l.IPBurst = 1 },
+			func(l *ratelimit.Limiter) { l.TrustedProxies = []string{"10.0.0.0/8"} },
+		)
+		checkers.Equals(t, do(tut, test.remote, http.Header{"X-Forwarded-For": {test.xff}}).Code, http.StatusOK)
+		got := do(tut, test.remote, http.Header{"X-Forwarded-For": {test.other}}).Code
+		checkers.Assert(t, got == test.want, "%s: got %d want %d", test.desc, got, test.want)
+	}
+}
+
+func TestLimitByReferer(t *testing.T) {
+	tut := newLimiter(
+		func(l *ratelimit.Limiter) { l.RefererRate = 0.001 },
+		func(l *ratelimit.Limiter) { l.RefererBurst = 1 },
+	)
+
+	before := limitedCount("referer")
+	checkers.Equals(t, do(tut, "192.0.2.1:1234", http.Header{"Referer": {"https://scraper.example.com/a"}}).Code, http.StatusOK)
+	checkers.Equals(t, do(tut, "192.0.2.2:1234", http.Header{"Referer": {"https://SCRAPER.example.com/b"}}).Code, http.StatusTooManyRequests)
+	checkers.Equals(t, limitedCount("referer"), before+1)
+
+	checkers.Equals(t, do(tut, "192.0.2.1:1234", http.Header{"Referer": {"https://blog.example.com/"}}).Code, http.StatusOK)
+	checkers.Equals(t, do(tut, "192.0.2.1:1234", nil).Code, http.StatusOK)
+}
+
+func TestMustNewPanics(t *testing.T) {
+	table := []func(*ratelimit.Limiter){
+		func(l *ratelimit.Limiter) { l.IPRate = -1 },
+		func(l *ratelimit.Limiter) { l.IPRate, l.IPBurst = 1, 0 },
+		func(l *ratelimit.Limiter) { l.TrustedProxies = []string{"not a cidr"} },
+	}
+
+	for _, opt := range table {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Error("ratelimit.MustNew failed to panic")
+				}
+			}()
+			ratelimit.MustNew(ok, zerolog.New(ioutil.Discard), opt)
+		}()
+	}
+}
+
+func newLimiter(options ...func(*ratelimit.Limiter)) http.Handler {
+	return rxid.Handler(ratelimit.MustNew(ok, zerolog.New(ioutil.Discard), options...))
+}
+
+func do(h http.Handler, remote string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/sig/url", nil)
+	r.RemoteAddr = remote
+	for k, vv := range header {
+		r.Header[k] = vv
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func limitedCount(by string) int64 {
+	v := expvar.Get("rateLimited").(*expvar.Map).Get(by)
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.String(), 10, 64)
+	return n
+}
@@ -0,0 +1,166 @@
+// Package shed protects a handler from overload by bounding the requests it
+// serves at once and shedding those that would wait too long for a turn.
+package shed
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxInflight is the most requests served at once.
+	DefaultMaxInflight = 1024
+
+	// DefaultMaxQueue is the most requests waiting for a turn.
+	DefaultMaxQueue = 512
+
+	// DefaultMaxWait is the longest a request waits for a turn.
+	DefaultMaxWait = 500 * time.Millisecond
+
+	// DefaultTarget is the queue latency above which we are overloaded.
+	DefaultTarget = 50 * time.Millisecond
+
+	// interval is the period over which queue latency is judged.
+	interval = 100 * time.Millisecond
+)
+
+// shed counts shed requests by why they were shed.
+var shed = expvar.NewMap("shed")
+
+// MustNew returns a handler that sheds load in front of next or panics.
+func MustNew(next http.Handler, options ...func(*Shedder)) *Shedder {
+	if next == nil {
+		panic("next handler must not be nil")
+	}
+
+	s := &Shedder{
+		MaxInflight: DefaultMaxInflight,
+		MaxQueue:    DefaultMaxQueue,
+		MaxWait:     DefaultMaxWait,
+		Target:      DefaultTarget,
+
+		next: next,
+	}
+
+	for _, opt := range options {
+		opt(s)
+	}
+
+	if s.MaxInflight <= 0 {
+		panic("max inflight must be positive")
+	}
+	if s.MaxQueue < 0 || s.MaxWait < 0 || s.Target < 0 {
+		panic("queue, wait and target must not be negative")
+	}
+	s.slots = make(chan struct{}, s.MaxInflight)
+	return s
+}
+
+// Shedder is an http.Handler serving at most MaxInflight requests at once.
+// Others wait in turn, up to MaxQueue of them for up to MaxWait. If every
+// request in the last interval waited longer than Target we are overloaded
+// and requests that can't be served straight away are shed at once rather
+// than waiting. Shed requests get a 503. Health checks are never shed.
+type Shedder struct {
+	MaxInflight int
+	MaxQueue    int
+	MaxWait     time.Duration
+	Target      time.Duration
+
+	next  http.Handler
+	slots chan struct{}
+
+	mu         sync.Mutex // protects everything below
+	waiting    int
+	start      time.Time // of the current interval
+	minWait    time.Duration
+	overloaded bool
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Shedder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		s.record(0)
+	default:
+		if !s.wait(w, r) {
+			return
+		}
+	}
+	defer func() { <-s.slots }()
+
+	s.next.ServeHTTP(w, r)
+}
+
+// wait queues for a slot. It answers the client and returns false if the
+// request is shed.
+func (s *Shedder) wait(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	switch {
+	case s.overloaded:
+		s.mu.Unlock()
+		s.reject(w, "latency")
+		return false
+	case s.waiting >= s.MaxQueue:
+		s.mu.Unlock()
+		s.reject(w, "queue_full")
+		return false
+	}
+	s.waiting++
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.waiting--
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	timer := time.NewTimer(s.MaxWait)
+	defer timer.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		s.record(time.Since(start))
+		return true
+	case <-timer.C:
+		s.record(time.Since(start))
+		s.reject(w, "timeout")
+		return false
+	case <-r.Context().Done():
+		// Nobody is listening.
+		return false
+	}
+}
+
+// record notes how long a request waited. At the end of each interval we
+// are overloaded if even the shortest wait was over Target.
+func (s *Shedder) record(wait time.Duration) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.start) >= interval {
+		// A quiet spell in between tells us nothing about now.
+		s.overloaded = now.Sub(s.start) < 2*interval && s.minWait > s.Target
+		s.start, s.minWait = now, wait
+		return
+	}
+	if wait < s.minWait {
+		s.minWait = wait
+	}
+}
+
+func (s *Shedder) reject(w http.ResponseWriter, why string) {
+	shed.Add(why, 1)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Service overloaded", http.StatusServiceUnavailable)
+}
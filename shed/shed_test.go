@@ -0,0 +1,140 @@
+package shed_test
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/shed"
+)
+
+func TestShedding(t *testing.T) {
+	table := []struct {
+		desc     string
+		maxQueue int
+		maxWait  time.Duration
+		release  time.Duration
+		want     int
+		wantWhy  string
+	}{
+		{"queue full", 0, time.Second, 0, http.StatusServiceUnavailable, "queue_full"},
+		{"waited too long", 1, 20 * time.Millisecond, 0, http.StatusServiceUnavailable, "timeout"},
+		{"served in turn", 1, time.Second, 20 * time.Millisecond, http.StatusOK, ""},
+	}
+
+	for _, test := range table {
+		tut, hold, release := newShedder(
+			func(s *shed.Shedder) { s.MaxInflight = 1 },
+			func(s *shed.Shedder) { s.MaxQueue = test.maxQueue },
+			func(s *shed.Shedder) { s.MaxWait = test.maxWait },
+			func(s *shed.Shedder) { s.Target = time.Second },
+		)
+		hold()
+
+		// Health checks get through regardless.
+		checkers.Equals(t, do(tut, "/health").Code, http.StatusOK)
+
+		if test.release > 0 {
+			time.AfterFunc(test.release, release)
+		}
+		before := shedCount(test.wantWhy)
+		w := do(tut, "/sig/url")
+		checkers.Equals(t, w.Code, test.want)
+		if test.wantWhy != "" {
+			checkers.Equals(t, w.Header().Get("Retry-After"), "1")
+			checkers.Equals(t, shedCount(test.wantWhy), before+1)
+		}
+		if test.release == 0 {
+			release()
+		}
+	}
+}
+
+func TestShedOnLatency(t *testing.T) {
+	tut, hold, release := newShedder(
+		func(s *shed.Shedder) { s.MaxInflight = 1 },
+		func(s *shed.Shedder) { s.MaxQueue = 10 },
+		func(s *shed.Shedder) { s.MaxWait = 110 * time.Millisecond },
+		func(s *shed.Shedder) { s.Target = 0 },
+	)
+	hold()
+	defer release()
+
+	// Two intervals of long waits.
+	for i := 0; i < 2; i++ {
+		checkers.Equals(t, do(tut, "/sig/url").Code, http.StatusServiceUnavailable)
+	}
+
+	// Now we're overloaded there's no waiting.
+	before := shedCount("latency")
+	start := time.Now()
+	checkers.Equals(t, do(tut, "/sig/url").Code, http.StatusServiceUnavailable)
+	checkers.Assert(t, time.Since(start) < 50*time.Millisecond, "waited %s", time.Since(start))
+	checkers.Equals(t, shedCount("latency"), before+1)
+}
+
+func TestMustNewPanics(t *testing.T) {
+	table := []func(*shed.Shedder){
+		func(s *shed.Shedder) { s.MaxInflight = 0 },
+		func(s *shed.Shedder) { s.MaxQueue = -1 },
+	}
+
+	for _, opt := range table {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Error("shed.MustNew failed to panic")
+				}
+			}()
+			shed.MustNew(http.NotFoundHandler(), opt)
+		}()
+	}
+}
+
+// newShedder returns a Shedder in front of a handler that blocks requests for
+// /hold until release is called. hold returns once such a request is being
+// served.
+func newShedder(options ...func(*shed.Shedder)) (h http.Handler, hold func(), release func()) {
+	var (
+		started  = make(chan struct{})
+		unblock  = make(chan struct{})
+		released bool
+	)
+	h = shed.MustNew(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			close(started)
+			<-unblock
+		}
+	}), options...)
+
+	hold = func() {
+		go do(h, "/hold")
+		<-started
+	}
+	release = func() {
+		if !released {
+			released = true
+			close(unblock)
+		}
+	}
+	return h, hold, release
+}
+
+func do(h http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func shedCount(why string) int64 {
+	v := expvar.Get("shed").(*expvar.Map).Get(why)
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.String(), 10, 64)
+	return n
+}
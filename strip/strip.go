@@ -0,0 +1,338 @@
+// Package strip removes metadata from images as they stream.
+//
+// EXIF, XMP, IPTC and comments are dropped from JPEG, PNG and WebP images.
+// JPEGs and PNGs are handled a segment or chunk at a time and the image data
+// itself is copied as is. WebP keeps its size up front so it is buffered.
+// Anything else passes through untouched.
+package strip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+
+	"github.com/bepress/camo/imageutil"
+)
+
+const (
+	jpegMagic = "\xff\xd8"
+	pngMagic  = "\x89PNG\r\n\x1a\n"
+	webpMagic = "RIFF????WEBP"
+)
+
+// NewReader returns a reader of r with the metadata stripped. If
+// keepOrientation is set the EXIF orientation, if any, is kept so the image
+// still displays the right way up.
+func NewReader(r io.Reader, keepOrientation bool) io.Reader {
+	s := &reader{
+		r:               bufio.NewReader(r),
+		keepOrientation: keepOrientation,
+	}
+	s.next = s.detect
+	return s
+}
+
+type reader struct {
+	r               *bufio.Reader
+	keepOrientation bool
+
+	out   bytes.Buffer // ready to be read
+	copyN int64        // bytes to copy from r as they are
+	pass  bool         // copy the rest of r as it is
+	next  func() error // adds to out or sets copyN or pass
+	err   error
+}
+
+// Read implements io.Reader.
+func (s *reader) Read(b []byte) (int, error) {
+	for {
+		switch {
+		case s.out.Len() > 0:
+			return s.out.Read(b)
+		case s.copyN > 0:
+			if int64(len(b)) > s.copyN {
+				b = b[:s.copyN]
+			}
+			n, err := s.r.Read(b)
+			s.copyN -= int64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		case s.pass:
+			return s.r.Read(b)
+		case s.err != nil:
+			return 0, s.err
+		}
+		s.err = s.next()
+	}
+}
+
+// detect works out the format, reading no more than it takes to tell it's
+// not an image we know so anything else streams as it would.
+func (s *reader) detect() error {
+	var head []byte
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			s.out.Write(head)
+			return err
+		}
+		head = append(head, c)
+
+		switch {
+		case string(head) == jpegMagic:
+			s.out.Write(head)
+			s.next = s.jpegSegment
+			return nil
+		case string(head) == pngMagic:
+			s.out.Write(head)
+			s.next = s.pngChunk
+			return nil
+		case len(head) == len(webpMagic) && imageutil.PrefixMatches(head, webpMagic):
+			return s.webp(head)
+		case !imageutil.PrefixMatches(head, jpegMagic) && !imageutil.PrefixMatches(head, pngMagic) && !imageutil.PrefixMatches(head, webpMagic):
+			s.out.Write(head)
+			s.pass = true
+			return nil
+		}
+	}
+}
+
+// JPEG markers we care about.
+const (
+	markerSOS   = 0xda
+	markerEOI   = 0xd9
+	markerAPP1  = 0xe1 // EXIF and XMP
+	markerAPP13 = 0xed // Photoshop, with IPTC
+	markerCOM   = 0xfe
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// maxEXIF is the largest PNG eXIf chunk we read to find the orientation.
+// JPEG segments can't be bigger.
+const maxEXIF = 64 * 1024
+
+// jpegSegment handles the next JPEG segment. Everything from the start of
+// the scan on is copied as is.
+func (s *reader) jpegSegment() error {
+	var m [4]byte
+	if _, err := io.ReadFull(s.r, m[:2]); err != nil {
+		return imageutil.Unexpected(err)
+	}
+	marker := m[1]
+	if m[0] != 0xff || marker == markerEOI || marker == 0xff {
+		// Not what we expected, leave the rest alone.
+		s.out.Write(m[:2])
+		s.pass = true
+		return nil
+	}
+	if (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+		// Standalone markers have no length.
+		s.out.Write(m[:2])
+		return nil
+	}
+
+	if _, err := io.ReadFull(s.r, m[2:]); err != nil {
+		return imageutil.Unexpected(err)
+	}
+	n := int64(binary.BigEndian.Uint16(m[2:])) - 2
+	if marker == markerSOS || n < 0 {
+		s.out.Write(m[:])
+		s.pass = true
+		return nil
+	}
+
+	switch marker {
+	case markerAPP1, markerAPP13, markerCOM:
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(s.r, seg); err != nil {
+			return imageutil.Unexpected(err)
+		}
+		if marker == markerAPP1 && s.keepOrientation && bytes.HasPrefix(seg, exifHeader) {
+			if o := orientation(seg[len(exifHeader):]); o > 1 {
+				exif := append(append([]byte{}, exifHeader...), orientationTIFF(o)...)
+				s.out.Write([]byte{0xff, markerAPP1})
+				binary.Write(&s.out, binary.BigEndian, uint16(len(exif)+2))
+				s.out.Write(exif)
+			}
+		}
+	default:
+		s.out.Write(m[:])
+		s.copyN = n
+	}
+	return nil
+}
+
+// pngChunk handles the next PNG chunk. Once we've seen IEND the rest is copied
+// as is.
+func (s *reader) pngChunk() error {
+	var hdr [8]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		return imageutil.Unexpected(err)
+	}
+	n := int64(binary.BigEndian.Uint32(hdr[:4]))
+	typ := string(hdr[4:])
+
+	switch typ {
+	case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		if typ != "eXIf" || !s.keepOrientation || n > maxEXIF {
+			_, err := io.CopyN(ioutil.Discard, s.r, n+4) // and the CRC
+			return imageutil.Unexpected(err)
+		}
+		data := make([]byte, n+4)
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			return imageutil.Unexpected(err)
+		}
+		if o := orientation(data[:n]); o > 1 {
+			writePNGChunk(&s.out, "eXIf", orientationTIFF(o))
+		}
+	default:
+		s.out.Write(hdr[:])
+		s.copyN = n + 4
+		if typ == "IEND" {
+			s.next = s.rest
+		}
+	}
+	return nil
+}
+
+// rest copies what's left as is.
+func (s *reader) rest() error {
+	s.pass = true
+	return nil
+}
+
+func writePNGChunk(w *bytes.Buffer, typ string, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	w.WriteString(typ)
+	w.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+// VP8X flags.
+const (
+	vp8xXMP  = 0x04
+	vp8xEXIF = 0x08
+)
+
+// webp reads the whole WebP, as the RIFF header has the size of what
+// follows, and drops its EXIF and XMP chunks. Anything we can't make sense
+// of is left as it was.
+func (s *reader) webp(head []byte) error {
+	rest, err := ioutil.ReadAll(s.r)
+	if err != nil {
+		return err
+	}
+	s.out.Write(stripWebP(append(head, rest...), s.keepOrientation))
+	s.pass = true
+	return nil
+}
+
+func stripWebP(data []byte, keepOrientation bool) []byte {
+	var (
+		out   bytes.Buffer
+		vp8x  = -1 // offset of the VP8X flags in out
+		flags byte
+	)
+	out.Write(data[:12])
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return data
+		}
+		typ := string(data[i : i+4])
+		n := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		end := i + 8 + n + n%2
+		if n < 0 || end > len(data) {
+			return data
+		}
+		chunk := data[i:end]
+		i = end
+
+		switch typ {
+		case "VP8X":
+			if n < 1 {
+				return data
+			}
+			vp8x = out.Len() + 8
+			flags = chunk[8] &^ (vp8xXMP | vp8xEXIF)
+			out.Write(chunk)
+		case "EXIF":
+			tiff := bytes.TrimPrefix(chunk[8:8+n], exifHeader)
+			if o := orientation(tiff); keepOrientation && o > 1 {
+				exif := orientationTIFF(o)
+				out.WriteString("EXIF")
+				binary.Write(&out, binary.LittleEndian, uint32(len(exif)))
+				out.Write(exif)
+				flags |= vp8xEXIF
+			}
+		case "XMP ":
+		default:
+			out.Write(chunk)
+		}
+	}
+
+	b := out.Bytes()
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(b)-8))
+	if vp8x != -1 {
+		b[vp8x] = flags
+	}
+	return b
+}
+
+// orientationTag is the EXIF orientation tag.
+const orientationTag = 0x0112
+
+// orientation returns the orientation in the TIFF structure of EXIF data, or
+// 0 if there isn't one.
+func orientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[e:]) == orientationTag && order.Uint16(tiff[e+2:]) == 3 {
+			return int(order.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
+
+// orientationTIFF returns EXIF data with only the orientation o.
+func orientationTIFF(o int) []byte {
+	var b bytes.Buffer
+	b.WriteString("MM\x00\x2a")
+	binary.Write(&b, binary.BigEndian, uint32(8)) // IFD0 offset
+	binary.Write(&b, binary.BigEndian, uint16(1)) // entries
+	binary.Write(&b, binary.BigEndian, uint16(orientationTag))
+	binary.Write(&b, binary.BigEndian, uint16(3)) // SHORT
+	binary.Write(&b, binary.BigEndian, uint32(1)) // count
+	binary.Write(&b, binary.BigEndian, uint16(o))
+	binary.Write(&b, binary.BigEndian, uint16(0)) // padding
+	binary.Write(&b, binary.BigEndian, uint32(0)) // no next IFD
+	return b.Bytes()
+}
@@ -0,0 +1,209 @@
+package strip_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/strip"
+)
+
+const secret = "GPS 51.5N 0.1W serial 12345"
+
+func TestStripJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	checkers.OK(t, jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil))
+	src := buf.Bytes()
+
+	// Put our metadata straight after SOI.
+	var img bytes.Buffer
+	img.Write(src[:2])
+	img.Write(jpegSegment(0xe1, append([]byte("Exif\x00\x00"), tiff(6, secret)...)))
+	img.Write(jpegSegment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00"+secret)))
+	img.Write(jpegSegment(0xed, []byte("Photoshop 3.0\x00"+secret)))
+	img.Write(jpegSegment(0xfe, []byte(secret)))
+	img.Write(src[2:])
+
+	table := []struct {
+		desc            string
+		keepOrientation bool
+		wantOrientation bool
+	}{
+		{"strip all", false, false},
+		{"keep orientation", true, true},
+	}
+
+	for _, test := range table {
+		got, err := ioutil.ReadAll(strip.NewReader(bytes.NewReader(img.Bytes()), test.keepOrientation))
+		checkers.OK(t, err)
+		checkers.Assert(t, !bytes.Contains(got, []byte(secret)), "%s: metadata left in", test.desc)
+		checkers.Equals(t, bytes.Contains(got, []byte("Exif\x00\x00MM")), test.wantOrientation)
+		_, err = jpeg.Decode(bytes.NewReader(got))
+		checkers.OK(t, err)
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	var buf bytes.Buffer
+	checkers.OK(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))))
+	src := buf.Bytes()
+
+	// Put our metadata after IHDR, which is 8+25 bytes in.
+	var img bytes.Buffer
+	img.Write(src[:33])
+	img.Write(pngChunk("tEXt", []byte("Comment\x00"+secret)))
+	img.Write(pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"+secret)))
+	img.Write(pngChunk("eXIf", tiff(3, secret)))
+	img.Write(src[33:])
+
+	table := []struct {
+		desc            string
+		keepOrientation bool
+		wantOrientation bool
+	}{
+		{"strip all", false, false},
+		{"keep orientation", true, true},
+	}
+
+	for _, test := range table {
+		got, err := ioutil.ReadAll(strip.NewReader(bytes.NewReader(img.Bytes()), test.keepOrientation))
+		checkers.OK(t, err)
+		checkers.Assert(t, !bytes.Contains(got, []byte(secret)), "%s: metadata left in", test.desc)
+		checkers.Equals(t, bytes.Contains(got, []byte("eXIf")), test.wantOrientation)
+		_, err = png.Decode(bytes.NewReader(got))
+		checkers.OK(t, err)
+	}
+}
+
+func TestStripWebP(t *testing.T) {
+	var chunks bytes.Buffer
+	chunks.Write(webpChunk("VP8X", []byte{0x0c, 0, 0, 0, 7, 0, 0, 7, 0, 0}))
+	chunks.Write(webpChunk("VP8L", []byte("not really image data")))
+	chunks.Write(webpChunk("EXIF", tiff(8, secret)))
+	chunks.Write(webpChunk("XMP ", []byte(secret)))
+
+	table := []struct {
+		desc            string
+		keepOrientation bool
+		wantFlags       byte
+	}{
+		{"strip all", false, 0x00},
+		{"keep orientation", true, 0x08},
+	}
+
+	for _, test := range table {
+		got, err := ioutil.ReadAll(strip.NewReader(bytes.NewReader(riff(chunks.Bytes())), test.keepOrientation))
+		checkers.OK(t, err)
+		checkers.Assert(t, !bytes.Contains(got, []byte(secret)), "%s: metadata left in", test.desc)
+		checkers.Equals(t, int(binary.LittleEndian.Uint32(got[4:8])), len(got)-8)
+		checkers.Equals(t, got[20], test.wantFlags)
+		checkers.Assert(t, bytes.Contains(got, []byte("not really image data")), "%s: image data lost", test.desc)
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	table := []string{
+		"",
+		"hello",
+		"\xff\x00 not a jpeg",
+		"RIFF\x00\x00\x00\x00WAVEfmt ",
+	}
+
+	for _, in := range table {
+		got, err := ioutil.ReadAll(strip.NewReader(bytes.NewReader([]byte(in)), false))
+		checkers.OK(t, err)
+		checkers.Equals(t, string(got), in)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	// Other bodies come through as they arrive.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("first"))
+
+	got := make(chan string)
+	go func() {
+		b := make([]byte, 64)
+		n, _ := strip.NewReader(pr, false).Read(b)
+		got <- string(b[:n])
+	}()
+
+	select {
+	case s := <-got:
+		checkers.Equals(t, s[:1], "f")
+	case <-time.After(time.Second):
+		t.Error("reader waited for more than it needed")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	checkers.OK(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))))
+
+	_, err := ioutil.ReadAll(strip.NewReader(bytes.NewReader(buf.Bytes()[:40]), false))
+	checkers.Equals(t, err, io.ErrUnexpectedEOF)
+}
+
+func jpegSegment(marker byte, data []byte) []byte {
+	b := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(data)+2))
+	return append(b, data...)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(len(data)))
+	b.WriteString(typ)
+	b.Write(data)
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(typ), data...)))
+	return b.Bytes()
+}
+
+func webpChunk(typ string, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(typ)
+	binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	if len(data)%2 == 1 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+func riff(chunks []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(len(chunks)+4))
+	b.WriteString("WEBP")
+	b.Write(chunks)
+	return b.Bytes()
+}
+
+// tiff returns little endian EXIF data with an orientation and a camera
+// serial number.
+func tiff(orientation uint16, serial string) []byte {
+	var b bytes.Buffer
+	b.WriteString("II\x2a\x00")
+	binary.Write(&b, binary.LittleEndian, uint32(8))
+	binary.Write(&b, binary.LittleEndian, uint16(2))
+	// Orientation, SHORT.
+	binary.Write(&b, binary.LittleEndian, []uint16{0x0112, 3})
+	binary.Write(&b, binary.LittleEndian, uint32(1))
+	binary.Write(&b, binary.LittleEndian, []uint16{orientation, 0})
+	// BodySerialNumber, ASCII, after the IFD.
+	binary.Write(&b, binary.LittleEndian, []uint16{0xa431, 2})
+	binary.Write(&b, binary.LittleEndian, uint32(len(serial)))
+	binary.Write(&b, binary.LittleEndian, uint32(8+2+2*12+4))
+	binary.Write(&b, binary.LittleEndian, uint32(0))
+	b.WriteString(serial)
+	return b.Bytes()
+}
@@ -0,0 +1,207 @@
+// Package svg sanitizes SVG images so they are safe to serve from our origin.
+//
+// The document is parsed and written out again keeping only the elements we
+// allow. Scripts, event handlers, references to anything outside the document
+// and anything we don't know, foreignObject and animation included, are
+// dropped along with everything inside them.
+package svg
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Namespaces we keep.
+const (
+	nsSVG   = "http://www.w3.org/2000/svg"
+	nsXLink = "http://www.w3.org/1999/xlink"
+	nsXML   = "http://www.w3.org/XML/1998/namespace"
+)
+
+// ErrInvalid is returned for documents that aren't well formed SVG.
+var ErrInvalid = errors.New("invalid SVG")
+
+// elements are the elements we keep. They draw, group or describe and none
+// of them can run anything or fetch anything but what their href allows.
+var elements = map[string]bool{
+	"a": true, "circle": true, "clipPath": true, "defs": true, "desc": true,
+	"ellipse": true, "filter": true, "g": true, "image": true, "line": true,
+	"linearGradient": true, "marker": true, "mask": true, "path": true,
+	"pattern": true, "polygon": true, "polyline": true, "radialGradient": true,
+	"rect": true, "stop": true, "svg": true, "symbol": true, "text": true,
+	"textPath": true, "title": true, "tspan": true, "use": true,
+
+	"feBlend": true, "feColorMatrix": true, "feComponentTransfer": true,
+	"feComposite": true, "feConvolveMatrix": true, "feDiffuseLighting": true,
+	"feDisplacementMap": true, "feDistantLight": true, "feDropShadow": true,
+	"feFlood": true, "feFuncA": true, "feFuncB": true, "feFuncG": true,
+	"feFuncR": true, "feGaussianBlur": true, "feMerge": true,
+	"feMergeNode": true, "feMorphology": true, "feOffset": true,
+	"fePointLight": true, "feSpecularLighting": true, "feSpotLight": true,
+	"feTile": true, "feTurbulence": true,
+}
+
+// imageData are the data URLs an image element may embed. SVG isn't one of
+// them as it would escape sanitizing.
+var imageData = []string{
+	"data:image/png;base64,",
+	"data:image/jpeg;base64,",
+	"data:image/gif;base64,",
+	"data:image/webp;base64,",
+}
+
+// Sanitize reads an SVG document from r and returns it sanitized.
+func Sanitize(r io.Reader) ([]byte, error) {
+	var (
+		d     = xml.NewDecoder(r)
+		out   bytes.Buffer
+		depth int // of the elements written
+		skip  int // depth inside a dropped element
+		root  bool
+	)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 {
+				skip++
+				continue
+			}
+			if depth == 0 {
+				if root || !isSVG(t.Name) || t.Name.Local != "svg" {
+					return nil, fmt.Errorf("%w: root element must be svg", ErrInvalid)
+				}
+				root = true
+			}
+			if !isSVG(t.Name) || !elements[t.Name.Local] {
+				skip = 1
+				continue
+			}
+			writeStart(&out, t, depth == 0)
+			depth++
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			out.WriteString("</" + t.Name.Local + ">")
+			depth--
+		case xml.CharData:
+			if skip == 0 && depth > 0 {
+				xml.EscapeText(&out, t)
+			}
+		}
+		// Comments, processing instructions and directives are dropped.
+	}
+	if !root {
+		return nil, fmt.Errorf("%w: no svg element", ErrInvalid)
+	}
+	return out.Bytes(), nil
+}
+
+// isSVG tells us if name is in the SVG namespace. Documents that don't
+// declare it are taken to mean it.
+func isSVG(name xml.Name) bool {
+	return name.Space == nsSVG || name.Space == ""
+}
+
+// writeStart writes the start tag t with only the attributes we allow. The
+// root element declares the namespaces we write.
+func writeStart(out *bytes.Buffer, t xml.StartElement, root bool) {
+	out.WriteString("<" + t.Name.Local)
+	if root {
+		out.WriteString(` xmlns="` + nsSVG + `" xmlns:xlink="` + nsXLink + `"`)
+	}
+	for _, a := range t.Attr {
+		name, ok := attrName(t.Name.Local, a)
+		if !ok {
+			continue
+		}
+		out.WriteString(" " + name + `="`)
+		xml.EscapeText(out, []byte(a.Value))
+		out.WriteString(`"`)
+	}
+	out.WriteString(">")
+}
+
+// attrName returns the name to write attribute a of element elem as, or false
+// if it is to be dropped.
+func attrName(elem string, a xml.Attr) (string, bool) {
+	var name string
+	switch a.Name.Space {
+	case "", nsSVG:
+		name = a.Name.Local
+	case nsXLink:
+		if a.Name.Local != "href" {
+			return "", false
+		}
+		name = "xlink:href"
+	case nsXML, "xml":
+		if a.Name.Local != "space" && a.Name.Local != "lang" {
+			return "", false
+		}
+		name = "xml:" + a.Name.Local
+	default:
+		// Namespace declarations and other vocabularies.
+		return "", false
+	}
+
+	lower := strings.ToLower(name)
+	v := strings.ToLower(strings.TrimSpace(a.Value))
+	switch {
+	case name == "xmlns" || strings.HasPrefix(lower, "on"):
+		return "", false
+	case lower == "href" || lower == "xlink:href":
+		return name, safeHref(elem, v)
+	case strings.Contains(v, `\`):
+		// CSS escapes could hide a url() from us.
+		return "", false
+	case lower == "style" && (strings.Contains(v, "expression(") || strings.Contains(v, "@import") ||
+		strings.Contains(v, "behavior") || strings.Contains(v, "-moz-binding")):
+		return "", false
+	}
+	return name, localURLs(v)
+}
+
+// safeHref tells us if an href, lower cased, refers only to something in the
+// document or, for images, to image data.
+func safeHref(elem, v string) bool {
+	if strings.HasPrefix(v, "#") {
+		return true
+	}
+	if elem != "image" {
+		return false
+	}
+	for _, prefix := range imageData {
+		if strings.HasPrefix(v, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// localURLs tells us if every url() in v, lower cased, refers to something
+// in the document.
+func localURLs(v string) bool {
+	for {
+		i := strings.Index(v, "url(")
+		if i == -1 {
+			return true
+		}
+		v = strings.TrimLeft(v[i+len("url("):], ` "'`)
+		if !strings.HasPrefix(v, "#") {
+			return false
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package svg_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/svg"
+)
+
+const open = `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">`
+
+func TestSanitize(t *testing.T) {
+	table := []struct {
+		desc string
+		in   string
+		want string
+	}{
+		{
+			"shapes kept",
+			`<?xml version="1.0"?><!-- hi --><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"><rect width="10" height="10" fill="red"/></svg>`,
+			`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 10 10"><rect width="10" height="10" fill="red"></rect></svg>`,
+		},
+		{
+			"script",
+			`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script><g><script><![CDATA[alert(2)]]></script></g></svg>`,
+			open + `<g></g></svg>`,
+		},
+		{
+			"event handlers",
+			`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"><circle r="1" ONCLICK="alert(2)"/></svg>`,
+			open + `<circle r="1"></circle></svg>`,
+		},
+		{
+			"foreignObject",
+			`<svg xmlns="http://www.w3.org/2000/svg"><foreignObject><body xmlns="http://www.w3.org/1999/xhtml"><iframe src="https://evil.example/"/></body></foreignObject></svg>`,
+			open + `</svg>`,
+		},
+		{
+			"animation",
+			`<svg xmlns="http://www.w3.org/2000/svg"><a href="#x"><set attributeName="href" to="javascript:alert(1)"/>x</a></svg>`,
+			open + `<a href="#x">x</a></svg>`,
+		},
+		{
+			"style element",
+			`<svg xmlns="http://www.w3.org/2000/svg"><style>@import url(https://evil.example/x.css);</style></svg>`,
+			open + `</svg>`,
+		},
+		{
+			"external hrefs",
+			`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="https://evil.example/s.svg#x"/><use href="#local"/><a href="javascript:alert(1)">x</a></svg>`,
+			open + `<use></use><use href="#local"></use><a>x</a></svg>`,
+		},
+		{
+			"image data",
+			`<svg xmlns="http://www.w3.org/2000/svg"><image href="data:image/png;base64,AAAA"/><image href="data:image/svg+xml;base64,AAAA"/><image href="https://tracker.example/p.gif"/></svg>`,
+			open + `<image href="data:image/png;base64,AAAA"></image><image></image><image></image></svg>`,
+		},
+		{
+			"external urls",
+			`<svg xmlns="http://www.w3.org/2000/svg"><rect fill="url(#grad)" filter="URL( 'https://evil.example/f.svg#x')" style="fill: u\72l(https://evil.example/)"/></svg>`,
+			open + `<rect fill="url(#grad)"></rect></svg>`,
+		},
+		{
+			"other namespaces",
+			`<svg xmlns="http://www.w3.org/2000/svg" xmlns:i="http://ns.example/" i:x="1" xml:space="preserve"><i:meta/><svg:g xmlns:svg="http://www.w3.org/2000/svg">&lt;text&gt;</svg:g></svg>`,
+			open[:len(open)-1] + ` xml:space="preserve"><g>&lt;text&gt;</g></svg>`,
+		},
+	}
+
+	for _, test := range table {
+		got, err := svg.Sanitize(strings.NewReader(test.in))
+		checkers.OK(t, err)
+		checkers.Assert(t, string(got) == test.want, "%s:\ngot  %s\nwant %s", test.desc, got, test.want)
+	}
+}
+
+func TestSanitizeInvalid(t *testing.T) {
+	table := []struct {
+		desc string
+		in   string
+	}{
+		{"not xml", "GIF89a"},
+		{"not svg", `<html><script>alert(1)</script></html>`},
+		{"unclosed", `<svg xmlns="http://www.w3.org/2000/svg"><g>`},
+		{"entities", `<!DOCTYPE svg [<!ENTITY x "xx">]><svg xmlns="http://www.w3.org/2000/svg">&x;</svg>`},
+		{"two roots", `<svg xmlns="http://www.w3.org/2000/svg"></svg><svg xmlns="http://www.w3.org/2000/svg"></svg>`},
+		{"empty", ""},
+	}
+
+	for _, test := range table {
+		_, err := svg.Sanitize(strings.NewReader(test.in))
+		checkers.Assert(t, errors.Is(err, svg.ErrInvalid), "%s: got %v", test.desc, err)
+	}
+}
@@ -0,0 +1,286 @@
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"io/ioutil"
+
+	"github.com/bepress/camo/imageutil"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+var errGIFBlock = errors.New("gif: unknown block")
+
+// decodeFirst decodes the image from br or, if it's animated, its first
+// frame.
+func decodeFirst(br *bufio.Reader) (image.Image, string, error) {
+	switch {
+	case isGIF(br):
+		img, err := gifFirst(br)
+		return img, FormatGIF, err
+	case isAnimatedWebP(br):
+		img, err := webpFirst(br)
+		return img, "webp", err
+	}
+	// An APNG decodes as its default image, which is usually the first
+	// frame.
+	return image.Decode(br)
+}
+
+func isGIF(br *bufio.Reader) bool {
+	b, _ := br.Peek(4)
+	return string(b) == "GIF8"
+}
+
+func isAnimatedWebP(br *bufio.Reader) bool {
+	b, _ := br.Peek(21)
+	return len(b) == 21 && string(b[:4]) == "RIFF" && string(b[8:16]) == "WEBPVP8X" && b[20]&imageutil.VP8XAnimation != 0
+}
+
+// gifScreen returns the bounds of the GIF's logical screen, which frames are
+// drawn on.
+func gifScreen(br *bufio.Reader) (image.Rectangle, error) {
+	b, err := br.Peek(10)
+	if err != nil {
+		return image.Rectangle{}, imageutil.Unexpected(err)
+	}
+	return image.Rect(0, 0, int(binary.LittleEndian.Uint16(b[6:])), int(binary.LittleEndian.Uint16(b[8:]))), nil
+}
+
+// gifFirst decodes the first frame of a GIF, drawn on its logical screen.
+// Nothing after the first frame is read.
+func gifFirst(br *bufio.Reader) (image.Image, error) {
+	screen, err := gifScreen(br)
+	if err != nil {
+		return nil, err
+	}
+	img, err := gif.Decode(br)
+	if err != nil || img.Bounds() == screen || screen.Empty() {
+		return img, err
+	}
+	dst := image.NewRGBA(screen)
+	draw.Draw(dst, img.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst, nil
+}
+
+// webpFirst decodes the first frame of an animated WebP, skipping to it
+// chunk by chunk. Nothing after it is read.
+func webpFirst(br *bufio.Reader) (image.Image, error) {
+	if _, err := br.Discard(12); err != nil {
+		return nil, imageutil.Unexpected(err)
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return nil, imageutil.Unexpected(err)
+		}
+		n := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		if string(hdr[:4]) != "ANMF" {
+			if _, err := io.CopyN(ioutil.Discard, br, n+n%2); err != nil {
+				return nil, imageutil.Unexpected(err)
+			}
+			continue
+		}
+
+		// The frame header is followed by the frame's own chunks.
+		frame, err := ioutil.ReadAll(io.LimitReader(br, n))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(frame)) < n || n < 16 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		w, h := uint24(frame[6:])+1, uint24(frame[9:])+1
+		return webp.Decode(bytes.NewReader(stillWebP(frame[16:], w, h)))
+	}
+}
+
+// stillWebP wraps the chunks of an animation frame up as a WebP of its own.
+func stillWebP(chunks []byte, w, h int) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF\x00\x00\x00\x00WEBP")
+	if bytes.HasPrefix(chunks, []byte("ALPH")) {
+		// Separate alpha needs the extended format.
+		b.WriteString("VP8X")
+		binary.Write(&b, binary.LittleEndian, uint32(10))
+		b.Write([]byte{0x10, 0, 0, 0}) // alpha flag
+		b.Write(putUint24(w - 1))
+		b.Write(putUint24(h - 1))
+	}
+	b.Write(chunks)
+	out := b.Bytes()
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func putUint24(n int) []byte {
+	return []byte{byte(n), byte(n >> 8), byte(n >> 16)}
+}
+
+// applyGIF transforms an animated GIF frame by frame. Frames are drawn on
+// the logical screen in turn and the result scaled, so each frame we write
+// is whole. Frames past the caps in o, or MaxAnimationPixels, are dropped
+// unread.
+func applyGIF(br *bufio.Reader, o Options) ([]byte, string, error) {
+	screen, err := gifScreen(br)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	w, h, _, _ := plan(screen, o)
+	data, err := firstFrames(br, frameLimit(screen, w, h, o))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	out := &gif.GIF{
+		LoopCount: g.LoopCount,
+		Config:    image.Config{Width: w, Height: h},
+	}
+	canvas := image.NewRGBA(screen)
+	for i, frame := range g.Image {
+		var saved *image.RGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			saved = image.NewRGBA(screen)
+			copy(saved.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		scaled := resize(canvas, o)
+		dst := image.NewPaletted(image.Rect(0, 0, w, h), withTransparent(frame.Palette))
+		draw.Draw(dst, dst.Bounds(), scaled, scaled.Bounds().Min, draw.Src)
+		out.Image = append(out.Image, dst)
+		out.Delay = append(out.Delay, g.Delay[i])
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = saved
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, out); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/" + FormatGIF, nil
+}
+
+// frameLimit is how many frames of a GIF on screen we keep when scaled to w
+// by h.
+func frameLimit(screen image.Rectangle, w, h int, o Options) int {
+	n := int64(MaxAnimationPixels)
+	if area := int64(screen.Dx()) * int64(screen.Dy()); area > 0 {
+		n /= area
+	}
+	if o.MaxFrames > 0 && int64(o.MaxFrames) < n {
+		n = int64(o.MaxFrames)
+	}
+	if area := int64(w) * int64(h); o.MaxPixels > 0 && area > 0 && o.MaxPixels/area < n {
+		n = o.MaxPixels / area
+	}
+	return imageutil.AtLeastOne(int(n))
+}
+
+// firstFrames reads a GIF from br up to the end of its nth frame and returns
+// it with a trailer added. Nothing after the nth frame is read.
+func firstFrames(br *bufio.Reader, n int) ([]byte, error) {
+	var out bytes.Buffer
+	copyN := func(n int64) error {
+		_, err := io.CopyN(&out, br, n)
+		return imageutil.Unexpected(err)
+	}
+	copySubBlocks := func() error {
+		for {
+			size, err := br.ReadByte()
+			if err != nil {
+				return imageutil.Unexpected(err)
+			}
+			out.WriteByte(size)
+			if size == 0 {
+				return nil
+			}
+			if err := copyN(int64(size)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := copyN(13); err != nil {
+		return nil, err
+	}
+	if flags := out.Bytes()[10]; flags&0x80 != 0 {
+		if err := copyN(3 << (flags&0x07 + 1)); err != nil { // global colour table
+			return nil, err
+		}
+	}
+	for frames := 0; frames < n; {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, imageutil.Unexpected(err)
+		}
+		out.WriteByte(c)
+		switch c {
+		case 0x21: // extension, its label then data sub-blocks
+			if err := copyN(1); err != nil {
+				return nil, err
+			}
+			if err := copySubBlocks(); err != nil {
+				return nil, err
+			}
+		case 0x2c: // image descriptor
+			if err := copyN(9); err != nil {
+				return nil, err
+			}
+			if flags := out.Bytes()[out.Len()-1]; flags&0x80 != 0 {
+				if err := copyN(3 << (flags&0x07 + 1)); err != nil { // local colour table
+					return nil, err
+				}
+			}
+			if err := copyN(1); err != nil { // LZW minimum code size
+				return nil, err
+			}
+			if err := copySubBlocks(); err != nil {
+				return nil, err
+			}
+			frames++
+		case 0x3b: // trailer
+			return out.Bytes(), nil
+		default:
+			return nil, errGIFBlock
+		}
+	}
+	out.WriteByte(0x3b)
+	return out.Bytes(), nil
+}
+
+// withTransparent returns p with a transparent colour in it, adding one if
+// there's room, so transparent pixels stay that way.
+func withTransparent(p color.Palette) color.Palette {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+	if len(p) >= 256 {
+		return p
+	}
+	return append(append(color.Palette{}, p...), color.RGBA{})
+}
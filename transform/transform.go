@@ -0,0 +1,362 @@
+// Package transform resizes and re-encodes images.
+//
+// Transformations are asked for in the signed camo payload, ahead of the URL
+// and separated from it by a "|":
+//
+//	w=200&h=100&fit=cover&q=80&fm=jpeg|https://example.com/image.png
+//
+// As the options are signed along with the URL clients can't ask for
+// transformations we didn't give them.
+//
+// Transformed images are always decoded and encoded again, so what we serve
+// is only ever pixels. The sanitize option asks for that alone, to neutralise
+// files that are an image and something else at once.
+//
+// Animated GIFs stay animated unless static is asked for, with frames=N and
+// pixels=N capping their frame count and the pixels of all frames together.
+// Animated WebP and APNG can only be served as their first frame.
+package transform
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bepress/camo/imageutil"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// MaxDimension is the largest width or height we will resize to.
+	MaxDimension = 4096
+
+	// DefaultQuality is the JPEG quality used when none is given.
+	DefaultQuality = 85
+
+	// MaxAnimationPixels is the most pixels, all frames together, of an
+	// animated GIF we decode. Frames beyond it are dropped.
+	MaxAnimationPixels = 100 * 1000 * 1000
+
+	// MaxSourcePixels and MaxSourceDimension bound the images we decode, so
+	// a small file can't claim a huge image and run us out of memory.
+	MaxSourcePixels    = 50 * 1000 * 1000
+	MaxSourceDimension = 16384
+)
+
+// Fit is how an image is fitted to a width and height.
+type Fit string
+
+// Fit modes.
+const (
+	// FitContain scales the image to fit inside the box, keeping its aspect
+	// ratio.
+	FitContain Fit = "contain"
+
+	// FitCover scales the image to cover the box, keeping its aspect ratio,
+	// and crops what overhangs about the centre.
+	FitCover Fit = "cover"
+
+	// FitFill stretches the image to the box.
+	FitFill Fit = "fill"
+)
+
+// Output formats.
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+)
+
+var (
+	// ErrUnsupported is returned for images we can't decode.
+	ErrUnsupported = errors.New("unsupported image format")
+
+	// ErrTooManyPixels is returned for images wider or taller than
+	// MaxSourceDimension or with more than MaxSourcePixels.
+	ErrTooManyPixels = errors.New("image has too many pixels")
+)
+
+// Options are the transformations to apply. The zero value changes nothing.
+type Options struct {
+	// Width and Height bound the output. If only one is given the other
+	// follows the aspect ratio.
+	Width  int
+	Height int
+
+	// Fit is used when both Width and Height are given. It defaults to
+	// FitContain.
+	Fit Fit
+
+	// Quality is the JPEG quality, 1 to 100.
+	Quality int
+
+	// Format is the output format. Empty keeps the source format if we can
+	// encode it and gives PNG otherwise.
+	Format string
+
+	// Sanitize re-encodes the image even if nothing else is asked for.
+	Sanitize bool
+
+	// Static serves only the first frame of an animated image.
+	Static bool
+
+	// MaxFrames and MaxPixels cap an animated GIF's frame count and the
+	// pixels of all its frames together. Frames past either are dropped.
+	MaxFrames int
+	MaxPixels int64
+}
+
+// IsZero tells us if there is nothing to do.
+func (o Options) IsZero() bool {
+	return o == Options{}
+}
+
+// Partial tells us if the options may need only the start of an animated
+// image, so it's worth trying one too large to read whole.
+func (o Options) Partial() bool {
+	return o.Static || o.MaxFrames > 0 || o.MaxPixels > 0
+}
+
+// String returns the options in the form Parse takes, with keys in a fixed
+// order so equal options give equal strings.
+func (o Options) String() string {
+	var parts []string
+	if o.Width > 0 {
+		parts = append(parts, "w="+strconv.Itoa(o.Width))
+	}
+	if o.Height > 0 {
+		parts = append(parts, "h="+strconv.Itoa(o.Height))
+	}
+	if o.Fit != "" {
+		parts = append(parts, "fit="+string(o.Fit))
+	}
+	if o.Quality > 0 {
+		parts = append(parts, "q="+strconv.Itoa(o.Quality))
+	}
+	if o.Format != "" {
+		parts = append(parts, "fm="+o.Format)
+	}
+	if o.Sanitize {
+		parts = append(parts, "sanitize=1")
+	}
+	if o.Static {
+		parts = append(parts, "static=1")
+	}
+	if o.MaxFrames > 0 {
+		parts = append(parts, "frames="+strconv.Itoa(o.MaxFrames))
+	}
+	if o.MaxPixels > 0 {
+		parts = append(parts, "pixels="+strconv.FormatInt(o.MaxPixels, 10))
+	}
+	return strings.Join(parts, "&")
+}
+
+// Split separates the options from the URL in a decoded camo payload. A
+// payload without options is returned as is with zero Options.
+func Split(payload string) (Options, string, error) {
+	i := strings.Index(payload, "|")
+	if i == -1 || strings.Contains(payload[:i], "://") {
+		return Options{}, payload, nil
+	}
+	o, err := Parse(payload[:i])
+	if err != nil {
+		return Options{}, "", err
+	}
+	return o, payload[i+1:], nil
+}
+
+// Parse parses options given as a query string. The keys are w, h, fit, q,
+// fm, sanitize, static, frames and pixels.
+func Parse(s string) (Options, error) {
+	var o Options
+	q, err := url.ParseQuery(s)
+	if err != nil {
+		return o, fmt.Errorf("bad transform options: %v", err)
+	}
+	for k, vv := range q {
+		v := vv[len(vv)-1]
+		switch k {
+		case "w", "h", "q", "frames":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return o, fmt.Errorf("bad transform option %s: %q", k, v)
+			}
+			switch k {
+			case "w":
+				o.Width = n
+			case "h":
+				o.Height = n
+			case "q":
+				o.Quality = n
+			case "frames":
+				o.MaxFrames = n
+			}
+		case "pixels":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return o, fmt.Errorf("bad transform option %s: %q", k, v)
+			}
+			o.MaxPixels = n
+		case "fit":
+			o.Fit = Fit(v)
+		case "fm":
+			o.Format = v
+		case "sanitize", "static":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return o, fmt.Errorf("bad transform option %s: %q", k, v)
+			}
+			if k == "sanitize" {
+				o.Sanitize = b
+			} else {
+				o.Static = b
+			}
+		default:
+			return o, fmt.Errorf("unknown transform option: %q", k)
+		}
+	}
+	return o, o.validate()
+}
+
+func (o Options) validate() error {
+	if o.Width < 0 || o.Width > MaxDimension || o.Height < 0 || o.Height > MaxDimension {
+		return fmt.Errorf("transform dimensions must be between 0 and %d", MaxDimension)
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		return errors.New("transform quality must be between 1 and 100")
+	}
+	if o.MaxFrames < 0 || o.MaxPixels < 0 {
+		return errors.New("transform frame and pixel caps must not be negative")
+	}
+	switch o.Fit {
+	case "", FitContain, FitCover, FitFill:
+	default:
+		return fmt.Errorf("unknown transform fit: %q", o.Fit)
+	}
+	switch o.Format {
+	case "", FormatJPEG, FormatPNG, FormatGIF:
+	default:
+		return fmt.Errorf("unknown transform format: %q", o.Format)
+	}
+	return nil
+}
+
+// Apply transforms the image read from r. It returns the new image and its
+// content type. Animated images are read no further than the frames we keep.
+func Apply(r io.Reader, o Options) ([]byte, string, error) {
+	br, err := checkSize(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if isGIF(br) && !o.Static && (o.Format == "" || o.Format == FormatGIF) {
+		return applyGIF(br, o)
+	}
+
+	src, format, err := decodeFirst(br)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	switch {
+	case o.Format != "":
+		format = o.Format
+	case format != FormatJPEG && format != FormatGIF:
+		format = FormatPNG
+	}
+
+	dst := resize(src, o)
+
+	var buf bytes.Buffer
+	switch format {
+	case FormatJPEG:
+		q := o.Quality
+		if q == 0 {
+			q = DefaultQuality
+		}
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: q})
+	case FormatPNG:
+		err = png.Encode(&buf, dst)
+	case FormatGIF:
+		err = gif.Encode(&buf, dst, nil)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/" + format, nil
+}
+
+// checkSize reads the image header from r and returns ErrTooManyPixels if the
+// image is bigger than we'll decode. The reader returned reads from the start.
+func checkSize(r io.Reader) (*bufio.Reader, error) {
+	var buf bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	if cfg.Width > MaxSourceDimension || cfg.Height > MaxSourceDimension ||
+		int64(cfg.Width)*int64(cfg.Height) > MaxSourcePixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrTooManyPixels, cfg.Width, cfg.Height)
+	}
+	return bufio.NewReader(io.MultiReader(&buf, r)), nil
+}
+
+// resize scales src to fit o. Images are only enlarged to fill or cover a box
+// bigger than they are.
+func resize(src image.Image, o Options) image.Image {
+	w, h, crop, ok := plan(src.Bounds(), o)
+	if !ok {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst
+}
+
+// plan works out the size to scale an image with bounds b to for o, and the
+// part of the image to scale. It returns false if the image is to be left as
+// it is.
+func plan(b image.Rectangle, o Options) (w, h int, crop image.Rectangle, ok bool) {
+	sw, sh := b.Dx(), b.Dy()
+	if sw == 0 || sh == 0 || (o.Width == 0 && o.Height == 0) {
+		return sw, sh, b, false
+	}
+
+	var enlarge bool
+	w, h, crop = o.Width, o.Height, b
+	switch {
+	case w == 0:
+		w = imageutil.AtLeastOne(sw * h / sh)
+	case h == 0:
+		h = imageutil.AtLeastOne(sh * w / sw)
+	case o.Fit == FitFill:
+		enlarge = true
+	case o.Fit == FitCover:
+		// Crop the source to the box's aspect ratio about its centre.
+		if sw*h > sh*w {
+			cw := sh * w / h
+			crop = image.Rect(b.Min.X+(sw-cw)/2, b.Min.Y, b.Min.X+(sw-cw)/2+cw, b.Max.Y)
+		} else {
+			ch := sw * h / w
+			crop = image.Rect(b.Min.X, b.Min.Y+(sh-ch)/2, b.Max.X, b.Min.Y+(sh-ch)/2+ch)
+		}
+		enlarge = true
+	default:
+		if sw*h > sh*w {
+			h = imageutil.AtLeastOne(sh * w / sw)
+		} else {
+			w = imageutil.AtLeastOne(sw * h / sh)
+		}
+	}
+	if !enlarge && (w > sw || h > sh) {
+		return sw, sh, b, false
+	}
+	return w, h, crop, true
+}
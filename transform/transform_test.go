@@ -0,0 +1,239 @@
+package transform_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/bepress/camo/checkers"
+	"github.com/bepress/camo/transform"
+)
+
+func TestSplit(t *testing.T) {
+	table := []struct {
+		desc    string
+		payload string
+		want    transform.Options
+		wantURL string
+		wantErr bool
+	}{
+		{"plain url", "http://example.com/a.png", transform.Options{}, "http://example.com/a.png", false},
+		{"plain url with a bar", "http://example.com/a.png?x=a|b", transform.Options{}, "http://example.com/a.png?x=a|b", false},
+		{"options", "w=200&h=100&fit=cover|https://example.com/a.png", transform.Options{Width: 200, Height: 100, Fit: transform.FitCover}, "https://example.com/a.png", false},
+		{"format and quality", "q=70&fm=jpeg|https://example.com/a.png", transform.Options{Quality: 70, Format: transform.FormatJPEG}, "https://example.com/a.png", false},
+		{"animation", "static=1&frames=10&pixels=5000|https://example.com/a.gif", transform.Options{Static: true, MaxFrames: 10, MaxPixels: 5000}, "https://example.com/a.gif", false},
+		{"bad frames", "frames=-1|https://example.com/a.gif", transform.Options{}, "", true},
+		{"sanitize", "sanitize=1|https://example.com/a.png", transform.Options{Sanitize: true}, "https://example.com/a.png", false},
+		{"bad sanitize", "sanitize=maybe|https://example.com/a.png", transform.Options{}, "", true},
+		{"unknown option", "x=1|https://example.com/a.png", transform.Options{}, "", true},
+		{"bad width", "w=wide|https://example.com/a.png", transform.Options{}, "", true},
+		{"too wide", "w=100000|https://example.com/a.png", transform.Options{}, "", true},
+		{"bad quality", "q=101|https://example.com/a.png", transform.Options{}, "", true},
+		{"bad fit", "w=1&h=1&fit=squash|https://example.com/a.png", transform.Options{}, "", true},
+		{"bad format", "fm=bmp|https://example.com/a.png", transform.Options{}, "", true},
+	}
+
+	for _, test := range table {
+		got, gotURL, err := transform.Split(test.payload)
+		checkers.Assert(t, (err != nil) == test.wantErr, "%s: got error %v", test.desc, err)
+		checkers.Equals(t, got, test.want)
+		checkers.Equals(t, gotURL, test.wantURL)
+	}
+}
+
+func TestOptionsString(t *testing.T) {
+	o, err := transform.Parse("pixels=9&frames=3&static=1&sanitize=true&fm=png&fit=fill&h=20&q=50&w=10")
+	checkers.OK(t, err)
+	checkers.Equals(t, o.String(), "w=10&h=20&fit=fill&q=50&fm=png&sanitize=1&static=1&frames=3&pixels=9")
+
+	again, err := transform.Parse(o.String())
+	checkers.OK(t, err)
+	checkers.Equals(t, again, o)
+}
+
+func TestApply(t *testing.T) {
+	table := []struct {
+		desc     string
+		opts     transform.Options
+		wantType string
+		wantW    int
+		wantH    int
+	}{
+		{"nothing to do", transform.Options{}, "image/png", 200, 100},
+		{"width only", transform.Options{Width: 50}, "image/png", 50, 25},
+		{"height only", transform.Options{Height: 50}, "image/png", 100, 50},
+		{"contain", transform.Options{Width: 50, Height: 50}, "image/png", 50, 25},
+		{"cover", transform.Options{Width: 50, Height: 50, Fit: transform.FitCover}, "image/png", 50, 50},
+		{"fill", transform.Options{Width: 50, Height: 50, Fit: transform.FitFill}, "image/png", 50, 50},
+		{"no enlarging", transform.Options{Width: 400}, "image/png", 200, 100},
+		{"cover enlarges", transform.Options{Width: 400, Height: 400, Fit: transform.FitCover}, "image/png", 400, 400},
+		{"to jpeg", transform.Options{Width: 20, Quality: 50, Format: transform.FormatJPEG}, "image/jpeg", 20, 10},
+		{"to gif", transform.Options{Format: transform.FormatGIF}, "image/gif", 200, 100},
+	}
+
+	src := testPNG(t, 200, 100)
+	for _, test := range table {
+		out, contentType, err := transform.Apply(bytes.NewReader(src), test.opts)
+		checkers.OK(t, err)
+		checkers.Equals(t, contentType, test.wantType)
+
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(out))
+		checkers.OK(t, err)
+		checkers.Equals(t, "image/"+format, test.wantType)
+		checkers.Assert(t, cfg.Width == test.wantW && cfg.Height == test.wantH,
+			"%s: got %dx%d want %dx%d", test.desc, cfg.Width, cfg.Height, test.wantW, test.wantH)
+	}
+}
+
+func TestApplySanitize(t *testing.T) {
+	// A PNG that is also an HTML page.
+	src := append(testPNG(t, 20, 10), "<html><script>alert(1)</script></html>"...)
+
+	out, contentType, err := transform.Apply(bytes.NewReader(src), transform.Options{Sanitize: true})
+	checkers.OK(t, err)
+	checkers.Equals(t, contentType, "image/png")
+	checkers.Assert(t, !bytes.Contains(out, []byte("<script>")), "script left in")
+	cfg, err := png.DecodeConfig(bytes.NewReader(out))
+	checkers.OK(t, err)
+	checkers.Assert(t, cfg.Width == 20 && cfg.Height == 10, "got %dx%d", cfg.Width, cfg.Height)
+}
+
+func TestApplyAnimated(t *testing.T) {
+	src := testGIF(t, 3)
+
+	table := []struct {
+		desc       string
+		src        []byte
+		opts       transform.Options
+		wantType   string
+		wantFrames int
+		wantW      int
+	}{
+		{"re-encoded", src, transform.Options{Sanitize: true}, "image/gif", 3, 40},
+		{"resized", src, transform.Options{Width: 20}, "image/gif", 3, 20},
+		{"static", src, transform.Options{Static: true}, "image/gif", 1, 40},
+		{"to png", src, transform.Options{Format: transform.FormatPNG}, "image/png", 1, 40},
+		{"frame cap", src, transform.Options{MaxFrames: 2}, "image/gif", 2, 40},
+		{"pixel cap", src, transform.Options{Width: 20, MaxPixels: 450}, "image/gif", 2, 20},
+		// Only what we keep is read.
+		{"static truncated", src[:len(src)*2/3], transform.Options{Static: true}, "image/gif", 1, 40},
+		{"frame cap truncated", src[:len(src)*2/3], transform.Options{MaxFrames: 1}, "image/gif", 1, 40},
+		{"webp first frame", animatedWebP(t), transform.Options{Static: true}, "image/png", 1, 1},
+	}
+
+	for _, test := range table {
+		out, contentType, err := transform.Apply(bytes.NewReader(test.src), test.opts)
+		checkers.OK(t, err)
+		checkers.Equals(t, contentType, test.wantType)
+
+		frames, w := 1, 0
+		if contentType == "image/gif" {
+			g, err := gif.DecodeAll(bytes.NewReader(out))
+			checkers.OK(t, err)
+			frames, w = len(g.Image), g.Config.Width
+		} else {
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(out))
+			checkers.OK(t, err)
+			w = cfg.Width
+		}
+		checkers.Assert(t, frames == test.wantFrames, "%s: got %d frames want %d", test.desc, frames, test.wantFrames)
+		checkers.Assert(t, w == test.wantW, "%s: got width %d want %d", test.desc, w, test.wantW)
+	}
+}
+
+func TestApplyUnsupported(t *testing.T) {
+	_, _, err := transform.Apply(bytes.NewReader([]byte("<svg></svg>")), transform.Options{Width: 10})
+	checkers.Assert(t, errors.Is(err, transform.ErrUnsupported), "got %v", err)
+}
+
+func TestApplyTooManyPixels(t *testing.T) {
+	table := []struct {
+		desc string
+		src  []byte
+		opts transform.Options
+	}{
+		{"too many pixels", pngHeader(50000, 50000), transform.Options{Width: 10}},
+		{"too wide", pngHeader(20000, 1), transform.Options{Sanitize: true}},
+		{"static gif", gifHeader(60000, 60000), transform.Options{Static: true}},
+		{"animated gif", gifHeader(60000, 60000), transform.Options{Width: 10}},
+	}
+
+	for _, test := range table {
+		_, _, err := transform.Apply(bytes.NewReader(test.src), test.opts)
+		checkers.Assert(t, errors.Is(err, transform.ErrTooManyPixels), "%s: got %v", test.desc, err)
+	}
+}
+
+// pngHeader returns the start of a w by h PNG, up to the end of its header.
+func pngHeader(w, h uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], w)
+	binary.BigEndian.PutUint32(ihdr[8:], h)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 6 // RGBA
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(13))
+	buf.Write(ihdr)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return buf.Bytes()
+}
+
+// gifHeader returns the start of a GIF with a w by h logical screen and no
+// colour table.
+func gifHeader(w, h uint16) []byte {
+	b := []byte("GIF89a\x00\x00\x00\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint16(b[6:], w)
+	binary.LittleEndian.PutUint16(b[8:], h)
+	return b
+}
+
+// testGIF returns a 40 by 20 GIF of n frames, each a different colour.
+func testGIF(t *testing.T, n int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < n; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 20), palette.Plan9)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i * 50)
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	checkers.OK(t, gif.EncodeAll(&buf, g))
+	return buf.Bytes()
+}
+
+// animatedWebP returns a 1 by 1 animated WebP of one lossless frame.
+func animatedWebP(t *testing.T) []byte {
+	b, err := base64.StdEncoding.DecodeString("UklGRlIAAABXRUJQVlA4WAoAAAASAAAAAAAAAAAAQU5JTQYAAAD/////AABBTk1GJgAAAAAAAAAAAAAAAAAAAGQAAABWUDhMDQAAAC8AAAAQBxAREYiI/gcA")
+	checkers.OK(t, err)
+	return b
+}
+
+// testPNG returns a w by h PNG, red on the left half and blue on the right.
+func testPNG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		c := color.RGBA{R: 255, A: 255}
+		if x >= w/2 {
+			c = color.RGBA{B: 255, A: 255}
+		}
+		for y := 0; y < h; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	checkers.OK(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}